@@ -0,0 +1,136 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rwcarlsen/gobitmsg/p2p"
+	"github.com/rwcarlsen/gobitmsg/store"
+)
+
+// Event types pushed to event stream clients.
+const (
+	EventNewMessage    = store.EventNewMessage
+	EventAckReceived   = store.EventAckReceived
+	EventPeerConnected = "peer-connected"
+)
+
+const (
+	eventBuffer    = 64
+	eventHeartbeat = 30 * time.Second
+)
+
+type Event struct {
+	Type string      `json:"type"`
+	Time time.Time   `json:"time"`
+	Data interface{} `json:"data"`
+}
+
+// Hub fans events out to every subscribed event stream.  Slow subscribers
+// miss events rather than blocking publishers.
+type Hub struct {
+	mu     sync.Mutex
+	subs   map[chan Event]struct{}
+	closed bool
+}
+
+func NewHub() *Hub {
+	return &Hub{subs: map[chan Event]struct{}{}}
+}
+
+// Subscribe returns a channel receiving all published events, which is
+// closed when the hub is.  cancel must be called when the subscriber is
+// done.
+func (h *Hub) Subscribe() (events <-chan Event, cancel func()) {
+	ch := make(chan Event, eventBuffer)
+	h.mu.Lock()
+	if h.closed {
+		close(ch)
+	} else {
+		h.subs[ch] = struct{}{}
+	}
+	h.mu.Unlock()
+
+	return ch, func() {
+		h.mu.Lock()
+		delete(h.subs, ch)
+		h.mu.Unlock()
+	}
+}
+
+func (h *Hub) Publish(typ string, data interface{}) {
+	ev := Event{Type: typ, Time: time.Now(), Data: data}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// Close closes every subscriber's channel, ending their event streams.
+// Register it with the http.Server's RegisterOnShutdown so open streams
+// don't hold up a graceful shutdown.
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for ch := range h.subs {
+		close(ch)
+		delete(h.subs, ch)
+	}
+}
+
+// PeerConnected publishes a peer-connected event for p.
+func (s *Server) PeerConnected(p *p2p.Peer) {
+	s.Events.Publish(EventPeerConnected, peerJSON(p))
+}
+
+func (s *Server) storeEvent(event string, m *store.Message) {
+	s.Events.Publish(event, messageJSON(m))
+}
+
+// handleEvents streams events to the client as server-sent events.
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	events, cancel := s.Events.Subscribe()
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(eventHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(ev)
+			if err != nil {
+				s.Log.Error("failed to encode event", "type", ev.Type, "err", err)
+				continue
+			}
+			fmt.Fprintf(w, "event: %v\ndata: %s\n\n", ev.Type, data)
+		}
+		flusher.Flush()
+	}
+}
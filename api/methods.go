@@ -0,0 +1,654 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rwcarlsen/gobitmsg/payload"
+	"github.com/rwcarlsen/gobitmsg/store"
+)
+
+const (
+	defaultTTL = 4 * 24 * time.Hour
+	minTTL     = time.Hour
+	maxTTL     = 28 * 24 * time.Hour
+)
+
+type method func(s *Server, p params) (interface{}, error)
+
+// methods is the PyBitmessage compatible XML-RPC method set.
+var methods = map[string]method{
+	"helloWorld":                 (*Server).helloWorld,
+	"add":                        (*Server).add,
+	"listAddresses":              (*Server).listAddresses,
+	"listAddresses2":             (*Server).listAddresses2,
+	"createRandomAddress":        (*Server).createRandomAddress,
+	"deleteAddress":              (*Server).deleteAddress,
+	"decodeAddress":              (*Server).decodeAddress,
+	"listSubscriptions":          (*Server).listSubscriptions,
+	"addSubscription":            (*Server).addSubscription,
+	"deleteSubscription":         (*Server).deleteSubscription,
+	"listAddressBookEntries":     (*Server).listAddressBookEntries,
+	"listAddressbook":            (*Server).listAddressBookEntries,
+	"addAddressBookEntry":        (*Server).addAddressBookEntry,
+	"addAddressbook":             (*Server).addAddressBookEntry,
+	"deleteAddressBookEntry":     (*Server).deleteAddressBookEntry,
+	"deleteAddressbook":          (*Server).deleteAddressBookEntry,
+	"getAllInboxMessages":        (*Server).getAllInboxMessages,
+	"getAllInboxMessageIds":      (*Server).getAllInboxMessageIds,
+	"getAllInboxMessageIDs":      (*Server).getAllInboxMessageIds,
+	"getInboxMessageById":        (*Server).getInboxMessageById,
+	"getInboxMessageByID":        (*Server).getInboxMessageById,
+	"getInboxMessagesByReceiver": (*Server).getInboxMessagesByReceiver,
+	"getInboxMessagesByAddress":  (*Server).getInboxMessagesByReceiver,
+	"getAllSentMessages":         (*Server).getAllSentMessages,
+	"getAllSentMessageIds":       (*Server).getAllSentMessageIds,
+	"getAllSentMessageIDs":       (*Server).getAllSentMessageIds,
+	"getSentMessageById":         (*Server).getSentMessageById,
+	"getSentMessageByID":         (*Server).getSentMessageById,
+	"getSentMessageByAckData":    (*Server).getSentMessageByAckData,
+	"getSentMessagesBySender":    (*Server).getSentMessagesBySender,
+	"getSentMessagesByAddress":   (*Server).getSentMessagesBySender,
+	"trashMessage":               (*Server).trashMessage,
+	"trashInboxMessage":          (*Server).trashInboxMessage,
+	"trashSentMessage":           (*Server).trashSentMessage,
+	"trashSentMessageByAckData":  (*Server).trashSentMessageByAckData,
+	"sendMessage":                (*Server).sendMessage,
+	"sendBroadcast":              (*Server).sendBroadcast,
+	"getStatus":                  (*Server).getStatus,
+}
+
+// params holds the decoded parameters of a method call.
+type params []interface{}
+
+func (p params) need(n int) error {
+	if len(p) < n {
+		return errorf(0, "I need at least %v parameters!", n)
+	}
+	return nil
+}
+
+func (p params) str(i int) (string, error) {
+	switch v := p[i].(type) {
+	case string:
+		return v, nil
+	case []byte:
+		return string(v), nil
+	case int:
+		return strconv.Itoa(v), nil
+	}
+	return "", errorf(0, "parameter %v must be a string", i+1)
+}
+
+func (p params) intDefault(i, def int) (int, error) {
+	if i >= len(p) {
+		return def, nil
+	}
+	switch v := p[i].(type) {
+	case int:
+		return v, nil
+	case float64:
+		return int(v), nil
+	case string:
+		if n, err := strconv.Atoi(strings.TrimSpace(v)); err == nil {
+			return n, nil
+		}
+	}
+	return 0, errorf(0, "parameter %v must be an integer", i+1)
+}
+
+func (p params) boolDefault(i int, def bool) (bool, error) {
+	if i >= len(p) {
+		return def, nil
+	}
+	switch v := p[i].(type) {
+	case bool:
+		return v, nil
+	case int:
+		return v != 0, nil
+	case string:
+		if b, err := strconv.ParseBool(strings.TrimSpace(v)); err == nil {
+			return b, nil
+		}
+	}
+	return false, errorf(0, "parameter %v must be a boolean", i+1)
+}
+
+// base64 decodes the base64 encoded string parameter i.
+func (p params) base64(i int) (string, error) {
+	s, err := p.str(i)
+	if err != nil {
+		return "", err
+	}
+	data, err := base64.StdEncoding.DecodeString(stripSpace(s))
+	if err != nil {
+		return "", errorf(22, "Decode error - %v. Had trouble while decoding string: %q", err, s)
+	}
+	return string(data), nil
+}
+
+func (p params) base64Default(i int, def string) (string, error) {
+	if i >= len(p) {
+		return def, nil
+	}
+	return p.base64(i)
+}
+
+// address decodes and validates the address parameter i, returning it in
+// canonical form.
+func (p params) address(i int) (string, *payload.Address, error) {
+	s, err := p.str(i)
+	if err != nil {
+		return "", nil, err
+	}
+	return checkAddress(s)
+}
+
+func jsonResult(v interface{}) (interface{}, error) {
+	data, err := json.MarshalIndent(v, "", "    ")
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+func b64(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+func (s *Server) helloWorld(p params) (interface{}, error) {
+	if err := p.need(2); err != nil {
+		return nil, err
+	}
+	a, err := p.str(0)
+	if err != nil {
+		return nil, err
+	}
+	b, err := p.str(1)
+	if err != nil {
+		return nil, err
+	}
+	return a + "-" + b, nil
+}
+
+func (s *Server) add(p params) (interface{}, error) {
+	if err := p.need(2); err != nil {
+		return nil, err
+	}
+	a, err := p.intDefault(0, 0)
+	if err != nil {
+		return nil, err
+	}
+	b, err := p.intDefault(1, 0)
+	if err != nil {
+		return nil, err
+	}
+	return a + b, nil
+}
+
+func (s *Server) listAddresses(p params) (interface{}, error) {
+	return s.addressList(false)
+}
+
+func (s *Server) listAddresses2(p params) (interface{}, error) {
+	return s.addressList(true)
+}
+
+func (s *Server) addressList(b64Labels bool) (interface{}, error) {
+	list := []map[string]interface{}{}
+	for _, id := range s.Store.Identities() {
+		label := id.Label
+		if b64Labels {
+			label = b64(label)
+		}
+		list = append(list, map[string]interface{}{
+			"label":   label,
+			"address": id.Address,
+			"stream":  id.Stream,
+			"enabled": id.Enabled,
+			"chan":    false,
+		})
+	}
+	return jsonResult(map[string]interface{}{"addresses": list})
+}
+
+func (s *Server) createRandomAddress(p params) (interface{}, error) {
+	if err := p.need(1); err != nil {
+		return nil, err
+	}
+	label, err := p.base64(0)
+	if err != nil {
+		return nil, err
+	}
+	short, err := p.boolDefault(1, false)
+	if err != nil {
+		return nil, err
+	}
+
+	// difficulties are multiples of the network minimum, as in PyBitmessage
+	total, err := p.intDefault(2, 1)
+	if err != nil {
+		return nil, err
+	}
+	small, err := p.intDefault(3, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	zeros := 1
+	if short {
+		zeros = 2
+	}
+	id, err := s.Store.NewIdentity(label, s.streams()[0], zeros)
+	if err != nil {
+		return nil, err
+	}
+	s.Store.SetDifficulty(id.Address, total*payload.PowTrialsPerByte, small*payload.PowExtraLen)
+	if err := s.publishPubKey(id.Address); err != nil {
+		s.Log.Error("failed to queue pubkey", "addr", id.Address, "err", err)
+	}
+	s.save()
+	return id.Address, nil
+}
+
+func (s *Server) deleteAddress(p params) (interface{}, error) {
+	if err := p.need(1); err != nil {
+		return nil, err
+	}
+	addr, _, err := p.address(0)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.Store.DeleteIdentity(addr); err != nil {
+		return nil, errorf(13, "Could not find this address in your keys.dat file.")
+	}
+	s.save()
+	return "success", nil
+}
+
+func (s *Server) decodeAddress(p params) (interface{}, error) {
+	if err := p.need(1); err != nil {
+		return nil, err
+	}
+	_, a, err := p.address(0)
+	if err != nil {
+		return nil, err
+	}
+	return jsonResult(map[string]interface{}{
+		"status":         "success",
+		"addressVersion": a.Version,
+		"streamNumber":   a.Stream,
+		"ripe":           base64.StdEncoding.EncodeToString(a.Ripe),
+	})
+}
+
+func (s *Server) listSubscriptions(p params) (interface{}, error) {
+	list := []map[string]interface{}{}
+	for _, e := range s.Store.Subscriptions() {
+		list = append(list, map[string]interface{}{
+			"label":   b64(e.Label),
+			"address": e.Address,
+			"enabled": e.Enabled,
+		})
+	}
+	return jsonResult(map[string]interface{}{"subscriptions": list})
+}
+
+func (s *Server) addSubscription(p params) (interface{}, error) {
+	if err := p.need(1); err != nil {
+		return nil, err
+	}
+	addr, _, err := p.address(0)
+	if err != nil {
+		return nil, err
+	}
+	label, err := p.base64Default(1, "")
+	if err != nil {
+		return nil, err
+	}
+	if err := s.Store.Subscribe(label, addr); err != nil {
+		return nil, errorf(16, "You are already subscribed to that address.")
+	}
+	s.save()
+	return "Added subscription.", nil
+}
+
+func (s *Server) deleteSubscription(p params) (interface{}, error) {
+	if err := p.need(1); err != nil {
+		return nil, err
+	}
+	addr, _, err := p.address(0)
+	if err != nil {
+		return nil, err
+	}
+	if s.Store.Unsubscribe(addr) == nil {
+		s.save()
+	}
+	return "Deleted subscription if it existed.", nil
+}
+
+func (s *Server) listAddressBookEntries(p params) (interface{}, error) {
+	list := []map[string]interface{}{}
+	for _, e := range s.Store.AddressBook() {
+		list = append(list, map[string]interface{}{
+			"label":   b64(e.Label),
+			"address": e.Address,
+		})
+	}
+	return jsonResult(map[string]interface{}{"addresses": list})
+}
+
+func (s *Server) addAddressBookEntry(p params) (interface{}, error) {
+	if err := p.need(2); err != nil {
+		return nil, err
+	}
+	addr, _, err := p.address(0)
+	if err != nil {
+		return nil, err
+	}
+	label, err := p.base64(1)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.Store.AddContact(label, addr); err != nil {
+		return nil, errorf(16, "You already have this address in your address book.")
+	}
+	s.save()
+	return "Added address " + addr + " to address book", nil
+}
+
+func (s *Server) deleteAddressBookEntry(p params) (interface{}, error) {
+	if err := p.need(1); err != nil {
+		return nil, err
+	}
+	addr, _, err := p.address(0)
+	if err != nil {
+		return nil, err
+	}
+	if s.Store.DeleteContact(addr) == nil {
+		s.save()
+	}
+	return "Deleted address book entry for " + addr + " if it existed", nil
+}
+
+func inboxJSON(m *store.Message) map[string]interface{} {
+	read := 0
+	if m.Read {
+		read = 1
+	}
+	return map[string]interface{}{
+		"msgid":        m.ID,
+		"toAddress":    m.To,
+		"fromAddress":  m.From,
+		"subject":      b64(m.Subject),
+		"message":      b64(m.Body),
+		"encodingType": m.Encoding,
+		"receivedTime": strconv.FormatInt(m.Time.Unix(), 10),
+		"read":         read,
+	}
+}
+
+func sentJSON(m *store.Message) map[string]interface{} {
+	return map[string]interface{}{
+		"msgid":          m.ID,
+		"toAddress":      m.To,
+		"fromAddress":    m.From,
+		"subject":        b64(m.Subject),
+		"message":        b64(m.Body),
+		"encodingType":   m.Encoding,
+		"lastActionTime": strconv.FormatInt(m.Time.Unix(), 10),
+		"status":         m.Status,
+		"ackData":        hex.EncodeToString(m.AckData),
+	}
+}
+
+func (s *Server) messageList(key, folder string, filter func(*store.Message) bool) (interface{}, error) {
+	list := []map[string]interface{}{}
+	for _, m := range s.Store.Messages(folder) {
+		if filter != nil && !filter(m) {
+			continue
+		}
+		if folder == store.Inbox {
+			list = append(list, inboxJSON(m))
+		} else {
+			list = append(list, sentJSON(m))
+		}
+	}
+	return jsonResult(map[string]interface{}{key: list})
+}
+
+func (s *Server) messageIds(key, folder string) (interface{}, error) {
+	list := []map[string]interface{}{}
+	for _, m := range s.Store.Messages(folder) {
+		list = append(list, map[string]interface{}{"msgid": m.ID})
+	}
+	return jsonResult(map[string]interface{}{key: list})
+}
+
+func (s *Server) getAllInboxMessages(p params) (interface{}, error) {
+	return s.messageList("inboxMessages", store.Inbox, nil)
+}
+
+func (s *Server) getAllInboxMessageIds(p params) (interface{}, error) {
+	return s.messageIds("inboxMessageIds", store.Inbox)
+}
+
+func (s *Server) getInboxMessageById(p params) (interface{}, error) {
+	if err := p.need(1); err != nil {
+		return nil, err
+	}
+	id, err := p.str(0)
+	if err != nil {
+		return nil, err
+	}
+	if len(p) > 1 {
+		read, err := p.boolDefault(1, false)
+		if err != nil {
+			return nil, err
+		}
+		if s.Store.MarkRead(id, read) == nil {
+			s.save()
+		}
+	}
+
+	list := []map[string]interface{}{}
+	if m, err := s.Store.Message(id); err == nil && m.Folder == store.Inbox {
+		list = append(list, inboxJSON(m))
+	}
+	return jsonResult(map[string]interface{}{"inboxMessage": list})
+}
+
+func (s *Server) getInboxMessagesByReceiver(p params) (interface{}, error) {
+	if err := p.need(1); err != nil {
+		return nil, err
+	}
+	to, err := p.str(0)
+	if err != nil {
+		return nil, err
+	}
+	return s.messageList("inboxMessages", store.Inbox, func(m *store.Message) bool { return m.To == to })
+}
+
+func (s *Server) getAllSentMessages(p params) (interface{}, error) {
+	return s.messageList("sentMessages", store.Sent, nil)
+}
+
+func (s *Server) getAllSentMessageIds(p params) (interface{}, error) {
+	return s.messageIds("sentMessageIds", store.Sent)
+}
+
+func (s *Server) getSentMessageById(p params) (interface{}, error) {
+	if err := p.need(1); err != nil {
+		return nil, err
+	}
+	id, err := p.str(0)
+	if err != nil {
+		return nil, err
+	}
+	list := []map[string]interface{}{}
+	if m, err := s.Store.Message(id); err == nil && m.Folder == store.Sent {
+		list = append(list, sentJSON(m))
+	}
+	return jsonResult(map[string]interface{}{"sentMessage": list})
+}
+
+func (s *Server) getSentMessageByAckData(p params) (interface{}, error) {
+	if err := p.need(1); err != nil {
+		return nil, err
+	}
+	m, err := s.messageByAck(p)
+	if err != nil {
+		return nil, err
+	}
+	list := []map[string]interface{}{}
+	if m != nil {
+		list = append(list, sentJSON(m))
+	}
+	return jsonResult(map[string]interface{}{"sentMessage": list})
+}
+
+func (s *Server) getSentMessagesBySender(p params) (interface{}, error) {
+	if err := p.need(1); err != nil {
+		return nil, err
+	}
+	from, err := p.str(0)
+	if err != nil {
+		return nil, err
+	}
+	return s.messageList("sentMessages", store.Sent, func(m *store.Message) bool { return m.From == from })
+}
+
+// messageByAck returns the message with the hex encoded ack data in
+// parameter 0 or nil if there is no such message.
+func (s *Server) messageByAck(p params) (*store.Message, error) {
+	ackHex, err := p.str(0)
+	if err != nil {
+		return nil, err
+	}
+	ack, err := hex.DecodeString(strings.TrimSpace(ackHex))
+	if err != nil {
+		return nil, errorf(22, "Decode error - %v. Had trouble while decoding string: %q", err, ackHex)
+	}
+	m, err := s.Store.MessageByAck(ack)
+	if err != nil {
+		return nil, nil
+	}
+	return m, nil
+}
+
+func (s *Server) trash(p params, folder, result string) (interface{}, error) {
+	if err := p.need(1); err != nil {
+		return nil, err
+	}
+	id, err := p.str(0)
+	if err != nil {
+		return nil, err
+	}
+	if m, err := s.Store.Message(id); err == nil && (folder == "" || m.Folder == folder) {
+		s.Store.TrashMessage(id)
+		s.save()
+	}
+	return result, nil
+}
+
+func (s *Server) trashMessage(p params) (interface{}, error) {
+	return s.trash(p, "", "Trashed message (assuming message existed).")
+}
+
+func (s *Server) trashInboxMessage(p params) (interface{}, error) {
+	return s.trash(p, store.Inbox, "Trashed inbox message (assuming message existed).")
+}
+
+func (s *Server) trashSentMessage(p params) (interface{}, error) {
+	return s.trash(p, store.Sent, "Trashed sent message (assuming message existed).")
+}
+
+func (s *Server) trashSentMessageByAckData(p params) (interface{}, error) {
+	if err := p.need(1); err != nil {
+		return nil, err
+	}
+	m, err := s.messageByAck(p)
+	if err != nil {
+		return nil, err
+	}
+	if m != nil {
+		s.Store.TrashMessage(m.ID)
+		s.save()
+	}
+	return "Trashed sent message (assuming message existed).", nil
+}
+
+// outgoing reads the subject, message, encoding type and TTL parameters
+// starting at index i.
+func outgoing(p params, i int) (subject, body string, enc int, ttl time.Duration, err error) {
+	if subject, err = p.base64(i); err != nil {
+		return
+	} else if body, err = p.base64(i + 1); err != nil {
+		return
+	} else if enc, err = p.intDefault(i+2, payload.EncSimple); err != nil {
+		return
+	}
+	secs, err := p.intDefault(i+3, int(defaultTTL/time.Second))
+	return subject, body, enc, time.Duration(secs) * time.Second, err
+}
+
+func (s *Server) sendMessage(p params) (interface{}, error) {
+	if err := p.need(4); err != nil {
+		return nil, err
+	}
+	to, err := p.str(0)
+	if err != nil {
+		return nil, err
+	}
+	from, err := p.str(1)
+	if err != nil {
+		return nil, err
+	}
+	subject, body, enc, ttl, err := outgoing(p, 2)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := s.queueMessage(from, to, subject, body, enc, ttl)
+	if err != nil {
+		return nil, err
+	}
+	return hex.EncodeToString(m.AckData), nil
+}
+
+func (s *Server) sendBroadcast(p params) (interface{}, error) {
+	if err := p.need(3); err != nil {
+		return nil, err
+	}
+	from, err := p.str(0)
+	if err != nil {
+		return nil, err
+	}
+	subject, body, enc, ttl, err := outgoing(p, 1)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := s.queueMessage(from, "", subject, body, enc, ttl)
+	if err != nil {
+		return nil, err
+	}
+	return hex.EncodeToString(m.AckData), nil
+}
+
+func (s *Server) getStatus(p params) (interface{}, error) {
+	if err := p.need(1); err != nil {
+		return nil, err
+	}
+	m, err := s.messageByAck(p)
+	if err != nil {
+		return nil, err
+	} else if m == nil {
+		return "notfound", nil
+	}
+	return m.Status, nil
+}
@@ -0,0 +1,173 @@
+package api
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/rwcarlsen/gobitmsg/msg"
+	"github.com/rwcarlsen/gobitmsg/payload"
+	"github.com/rwcarlsen/gobitmsg/pow"
+	"github.com/rwcarlsen/gobitmsg/store"
+)
+
+// ObjectReceived handles an object added to the node's inventory.  Messages
+// to our identities and broadcasts from our subscriptions are put in the
+// inbox.  The pubkeys of other addresses are kept, and messages waiting for
+// them are sent.  Requests for the pubkeys of our identities are answered.
+func (s *Server) ObjectReceived(m *msg.Msg) {
+	switch m.Cmd() {
+	case msg.Cmsg:
+		s.msgReceived(m)
+	case msg.Cbroadcast:
+		s.broadcastReceived(m)
+	case msg.Cpubkey:
+		s.pubKeyReceived(m)
+	case msg.CgetpubKey:
+		g, err := payload.GetPubKeyDecode(m.Payload())
+		if err != nil {
+			return
+		}
+		addr := (&payload.Address{Version: g.AddrVersion, Stream: g.Stream, Ripe: g.RipeHash}).String()
+		if id, err := s.Store.Identity(addr); err != nil || !id.Enabled || s.queued(pow.KindPubKey, addr) != nil {
+			return
+		}
+		if err := s.publishPubKey(addr); err != nil {
+			s.Log.Error("failed to queue pubkey", "addr", addr, "err", err)
+		}
+	}
+}
+
+// msgReceived marks the sent message a msg object acknowledges as acked.
+// Otherwise a msg object that decrypts with the key of one of our identities
+// is put in the inbox and the ack it carries is published.  Messages that are
+// badly signed or were meant for another address are dropped.
+func (s *Server) msgReceived(m *msg.Msg) {
+	obj, err := payload.MessageDecode(m.Payload())
+	if err != nil {
+		return
+	}
+	if sent, err := s.Store.MessageByAck(obj.Data); err == nil {
+		if sent.Status == store.StatusSent {
+			if err := s.Store.SetStatus(sent.ID, store.StatusAcked); err != nil {
+				s.Log.Error("failed to mark message acked", "id", sent.ID, "err", err)
+				return
+			}
+			s.save()
+		}
+		return
+	}
+	for _, id := range s.Store.Identities() {
+		if !id.Enabled || id.Stream != obj.Stream {
+			continue
+		}
+		data, err := id.EncryptKey.Decrypt(obj.Data)
+		if err != nil {
+			// for someone else
+			continue
+		}
+		mi, err := payload.MsgInfoDecode(data)
+		if err != nil {
+			s.Log.Info("dropped malformed msg", "to", id.Address, "err", err)
+			return
+		} else if err := mi.VerifySignature(); err != nil {
+			s.Log.Info("dropped badly signed msg", "to", id.Address)
+			return
+		}
+		to, err := payload.AddressDecode(id.Address)
+		if err != nil || !bytes.Equal(mi.DestRipe, to.Ripe) {
+			s.Log.Info("dropped msg encrypted to us for another address", "to", id.Address)
+			return
+		}
+
+		from := &payload.Address{Version: mi.AddrVersion, Stream: mi.Stream, Ripe: payload.RipeHash(mi.SignKey, mi.EncryptKey)}
+		subject, body := parseContent(mi.Encoding, mi.Content)
+		s.addInbox(&store.Message{From: from.String(), To: id.Address, Subject: subject, Body: body, Encoding: mi.Encoding})
+		if len(mi.AckData) > 0 && s.Node != nil {
+			if err := s.Node.Publish(msg.New(msg.Cmsg, mi.AckData)); err != nil {
+				s.Log.Debug("failed to publish ack", "from", from, "err", err)
+			}
+		}
+		return
+	}
+}
+
+// broadcastReceived puts a broadcast from one of our subscriptions in the
+// inbox.  Broadcasts that are badly signed or not from the address whose
+// key they decrypt with are dropped.
+func (s *Server) broadcastReceived(m *msg.Msg) {
+	obj, err := payload.BroadcastDecode(m.Payload())
+	if err != nil {
+		return
+	}
+	for _, sub := range s.Store.Subscriptions() {
+		from, err := payload.AddressDecode(sub.Address)
+		if !sub.Enabled || err != nil || from.Stream != obj.Stream {
+			continue
+		}
+		key, err := from.BroadcastKey()
+		if err != nil {
+			continue
+		}
+		data, err := key.Decrypt(obj.Data)
+		if err != nil {
+			continue
+		}
+		bi, err := payload.BroadcastInfoDecode(data)
+		if err != nil {
+			s.Log.Info("dropped malformed broadcast", "from", sub.Address, "err", err)
+			return
+		} else if err := bi.VerifySignature(); err != nil {
+			s.Log.Info("dropped badly signed broadcast", "from", sub.Address)
+			return
+		} else if !bytes.Equal(payload.RipeHash(bi.SignKey, bi.EncryptKey), from.Ripe) {
+			// the broadcast key is public to anyone who knows the address
+			s.Log.Info("dropped broadcast signed by someone else", "from", sub.Address)
+			return
+		}
+
+		subject, body := parseContent(bi.Encoding, bi.Msg)
+		s.addInbox(&store.Message{From: sub.Address, To: broadcastRecipient, Broadcast: true,
+			Subject: subject, Body: body, Encoding: bi.Encoding})
+		return
+	}
+}
+
+func (s *Server) addInbox(m *store.Message) {
+	m.Folder = store.Inbox
+	if err := s.Store.AddMessage(m); err != nil {
+		s.Log.Error("failed to store received message", "from", m.From, "err", err)
+		return
+	}
+	s.save()
+}
+
+// parseContent splits received message content in encoding into its
+// subject and body.  It is the reverse of content.
+func parseContent(encoding int, data []byte) (subject, body string) {
+	text := string(data)
+	if encoding != payload.EncSimple {
+		return "", text
+	}
+	text = strings.TrimPrefix(text, "Subject:")
+	subject, body, _ = strings.Cut(text, "\nBody:")
+	return subject, body
+}
+
+// pubKeyReceived keeps a verified pubkey and sends the messages waiting for
+// it.
+func (s *Server) pubKeyReceived(m *msg.Msg) {
+	k, err := payload.PubKeyDecode(m.Payload())
+	if err != nil || k.VerifySignature() != nil {
+		return
+	}
+	addr := s.Store.AddPubKey(k)
+	for _, out := range s.Store.Messages(store.Sent) {
+		if out.To != addr || out.Status != store.StatusAwaitingPubKey {
+			continue
+		}
+		if err := s.send(out); err != nil {
+			s.Log.Error("failed to start sending message", "id", out.ID, "err", err)
+		}
+	}
+	s.save()
+}
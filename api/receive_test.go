@@ -0,0 +1,159 @@
+package api
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/rwcarlsen/gobitmsg/msg"
+	"github.com/rwcarlsen/gobitmsg/payload"
+	"github.com/rwcarlsen/gobitmsg/store"
+)
+
+// remoteIdentity returns an identity kept outside the server's store.
+func remoteIdentity(t *testing.T) *store.Identity {
+	t.Helper()
+	st, err := store.Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := st.NewIdentity("them", 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestReceiveMsg(t *testing.T) {
+	s, _ := newTestServer(t)
+	me, err := s.Store.NewIdentity("me", 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meAddr, err := payload.AddressDecode(me.Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	them := remoteIdentity(t)
+
+	mi := &payload.MsgInfo{MsgVersion: 1, AddrVersion: payload.AddressVersion, Stream: 1,
+		SignKey: them.SignKey, EncryptKey: them.EncryptKey, DestRipe: meAddr.Ripe,
+		Encoding: payload.EncSimple, Content: []byte("Subject:hi\nBody:hello there")}
+	receive := func(data []byte) {
+		t.Helper()
+		encrypted, err := me.EncryptKey.Encrypt(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		obj := &payload.Message{Time: payload.FuzzyTime(payload.DefaultFuzz), Stream: 1, Data: encrypted}
+		s.ObjectReceived(msg.New(msg.Cmsg, obj.Bytes()))
+	}
+
+	// altered content breaks the signature
+	receive(bytes.Replace(mi.Encode(), []byte("hello"), []byte("jello"), 1))
+	mi.DestRipe = make([]byte, 20)
+	receive(mi.Encode())
+	if n := len(s.Store.Messages(store.Inbox)); n != 0 {
+		t.Fatalf("%v badly signed or misaddressed messages put in the inbox", n)
+	}
+
+	mi.DestRipe = meAddr.Ripe
+	receive(mi.Encode())
+	inbox := s.Store.Messages(store.Inbox)
+	if len(inbox) != 1 {
+		t.Fatalf("expected 1 message in the inbox, got %v", len(inbox))
+	} else if m := inbox[0]; m.From != them.Address || m.To != me.Address || m.Subject != "hi" || m.Body != "hello there" {
+		t.Errorf("unexpected received message %+v", m)
+	}
+}
+
+func TestReceiveBroadcast(t *testing.T) {
+	s, _ := newTestServer(t)
+	them := remoteIdentity(t)
+	other := remoteIdentity(t)
+	if err := s.Store.Subscribe("news", them.Address); err != nil {
+		t.Fatal(err)
+	}
+
+	broadcast := func(from *store.Identity, signer *payload.Key) {
+		t.Helper()
+		bi := &payload.BroadcastInfo{BroadcastVersion: payload.BroadcastVersion, AddrVersion: payload.AddressVersion,
+			Stream: 1, SignKey: signer, EncryptKey: from.EncryptKey, Encoding: payload.EncTrivial, Msg: []byte("news")}
+		obj, err := payload.NewBroadcast(bi, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.ObjectReceived(msg.New(msg.Cbroadcast, obj.Bytes()))
+	}
+
+	broadcast(other, other.SignKey)
+	// signed with another key, so it was encrypted for a different address
+	broadcast(them, other.SignKey)
+	if n := len(s.Store.Messages(store.Inbox)); n != 0 {
+		t.Fatalf("%v broadcasts from elsewhere put in the inbox", n)
+	}
+
+	broadcast(them, them.SignKey)
+	inbox := s.Store.Messages(store.Inbox)
+	if len(inbox) != 1 {
+		t.Fatalf("expected 1 broadcast in the inbox, got %v", len(inbox))
+	} else if m := inbox[0]; m.From != them.Address || !m.Broadcast || m.Body != "news" {
+		t.Errorf("unexpected received broadcast %+v", m)
+	}
+}
+
+func TestReceiveEvents(t *testing.T) {
+	s, _ := newTestServer(t)
+	me, err := s.Store.NewIdentity("me", 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meAddr, err := payload.AddressDecode(me.Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	them := remoteIdentity(t)
+	sent := &store.Message{Folder: store.Sent, From: me.Address, To: them.Address, Subject: "question",
+		Status: store.StatusSent, AckData: []byte("0123456789abcdef0123456789abcdef")}
+	if err := s.Store.AddMessage(sent); err != nil {
+		t.Fatal(err)
+	}
+	events, cancel := s.Events.Subscribe()
+	defer cancel()
+	next := func(typ string) *messageView {
+		t.Helper()
+		for {
+			select {
+			case ev := <-events:
+				if ev.Type == typ {
+					return ev.Data.(*messageView)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("timed out waiting for %v event", typ)
+			}
+		}
+	}
+
+	// they acknowledge our message by publishing the ack we solved
+	ack := &payload.Message{Time: payload.FuzzyTime(payload.DefaultFuzz), Stream: 1, Data: sent.AckData}
+	s.ObjectReceived(msg.New(msg.Cmsg, ack.Bytes()))
+	if v := next(EventAckReceived); v.ID != sent.ID {
+		t.Errorf("ack-received for %v, want %v", v.ID, sent.ID)
+	}
+	if m, _ := s.Store.Message(sent.ID); m.Status != store.StatusAcked {
+		t.Errorf("sent message has status %v after its ack was received", m.Status)
+	}
+
+	// and reply
+	mi := &payload.MsgInfo{MsgVersion: 1, AddrVersion: payload.AddressVersion, Stream: 1,
+		SignKey: them.SignKey, EncryptKey: them.EncryptKey, DestRipe: meAddr.Ripe,
+		Encoding: payload.EncSimple, Content: []byte("Subject:answer\nBody:yes")}
+	obj, err := payload.NewMessage(mi, me.EncryptKey, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.ObjectReceived(msg.New(msg.Cmsg, obj.Bytes()))
+	if v := next(EventNewMessage); v.Subject != "answer" || v.From != them.Address {
+		t.Errorf("unexpected new-message event %+v", v)
+	}
+}
@@ -0,0 +1,682 @@
+package api
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rwcarlsen/gobitmsg/logging"
+	"github.com/rwcarlsen/gobitmsg/p2p"
+	"github.com/rwcarlsen/gobitmsg/payload"
+	"github.com/rwcarlsen/gobitmsg/store"
+)
+
+const restPrefix = "/api/v1/"
+
+type identityView struct {
+	Label   string `json:"label"`
+	Address string `json:"address"`
+	Stream  int    `json:"stream"`
+	Enabled bool   `json:"enabled"`
+	// proof of work difficulty advertised in the identity's pubkey
+	TrialsPerByte int `json:"trialsPerByte"`
+	ExtraBytes    int `json:"extraBytes"`
+}
+
+// exportView holds everything needed to restore an identity, with the
+// private keys in hex and in wallet import format.
+type exportView struct {
+	identityView
+	SignKey       string `json:"signKey"`
+	EncryptKey    string `json:"encryptKey"`
+	SignKeyWIF    string `json:"signKeyWIF"`
+	EncryptKeyWIF string `json:"encryptKeyWIF"`
+}
+
+type entryView struct {
+	Label   string `json:"label"`
+	Address string `json:"address"`
+	Enabled bool   `json:"enabled"`
+}
+
+type messageView struct {
+	ID        string    `json:"id"`
+	Folder    string    `json:"folder"`
+	To        string    `json:"to"`
+	From      string    `json:"from"`
+	Subject   string    `json:"subject"`
+	Body      string    `json:"body"`
+	Encoding  int       `json:"encoding"`
+	Time      time.Time `json:"time"`
+	Read      bool      `json:"read"`
+	Broadcast bool      `json:"broadcast"`
+	Status    string    `json:"status,omitempty"`
+	AckData   string    `json:"ackData,omitempty"`
+	TTL       int       `json:"ttl,omitempty"`
+}
+
+type peerView struct {
+	Address   string      `json:"address"`
+	Inbound   bool        `json:"inbound"`
+	UserAgent string      `json:"userAgent"`
+	Services  uint64      `json:"services"`
+	Streams   []int       `json:"streams"`
+	Protocol  uint32      `json:"protocol"`
+	Time      time.Time   `json:"time"`
+	Traffic   p2p.Traffic `json:"traffic"`
+}
+
+func identityJSON(id *store.Identity) *identityView {
+	k := id.PubKey()
+	return &identityView{
+		Label:         id.Label,
+		Address:       id.Address,
+		Stream:        id.Stream,
+		Enabled:       id.Enabled,
+		TrialsPerByte: k.TrialsPerByte,
+		ExtraBytes:    k.ExtraBytes,
+	}
+}
+
+func exportJSON(id *store.Identity) *exportView {
+	return &exportView{
+		identityView:  *identityJSON(id),
+		SignKey:       id.SignKey.EncodeHex(),
+		EncryptKey:    id.EncryptKey.EncodeHex(),
+		SignKeyWIF:    id.SignKey.EncodeWIF(),
+		EncryptKeyWIF: id.EncryptKey.EncodeWIF(),
+	}
+}
+
+func entriesJSON(entries []*store.Entry) []*entryView {
+	views := []*entryView{}
+	for _, e := range entries {
+		views = append(views, &entryView{Label: e.Label, Address: e.Address, Enabled: e.Enabled})
+	}
+	return views
+}
+
+func messageJSON(m *store.Message) *messageView {
+	return &messageView{
+		ID:        m.ID,
+		Folder:    m.Folder,
+		To:        m.To,
+		From:      m.From,
+		Subject:   m.Subject,
+		Body:      m.Body,
+		Encoding:  m.Encoding,
+		Time:      m.Time,
+		Read:      m.Read,
+		Broadcast: m.Broadcast,
+		Status:    m.Status,
+		AckData:   hex.EncodeToString(m.AckData),
+		TTL:       int(m.TTL / time.Second),
+	}
+}
+
+func peerJSON(p *p2p.Peer) *peerView {
+	ver := p.Ver
+	return &peerView{
+		Address:   p.Addr,
+		Inbound:   p.Inbound,
+		UserAgent: ver.UserAgent,
+		Services:  ver.Services,
+		Streams:   ver.Streams,
+		Protocol:  ver.Protocol(),
+		Time:      ver.Timestamp,
+		Traffic:   p.Traffic(),
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	code := http.StatusInternalServerError
+	var apiErr *apiError
+	if errors.Is(err, store.ErrNotFound) {
+		code = http.StatusNotFound
+	} else if errors.As(err, &apiErr) {
+		code = http.StatusBadRequest
+	}
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+func readJSON(r *http.Request, v interface{}) error {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return errorf(22, "malformed json request body (%v)", err)
+	}
+	return nil
+}
+
+// handleREST dispatches requests for the JSON API:
+//
+//	GET    /api/v1/identities          list identities
+//	POST   /api/v1/identities          create an identity {label, short,
+//	                                   stream, trialsPerByte, extraBytes}, or restore
+//	                                   one {label, address, signKey,
+//	                                   encryptKey} with WIF or hex keys
+//	GET    /api/v1/identities/{addr}/export   identity with private keys
+//	DELETE /api/v1/identities/{addr}   delete an identity
+//	GET    /api/v1/contacts            list the address book
+//	POST   /api/v1/contacts            add an entry {label, address}
+//	DELETE /api/v1/contacts/{addr}     remove an entry
+//	GET    /api/v1/subscriptions       list subscriptions
+//	POST   /api/v1/subscriptions       subscribe {label, address}
+//	DELETE /api/v1/subscriptions/{addr}
+//	GET    /api/v1/inbox               list received messages
+//	GET    /api/v1/inbox/{id}          get a message and mark it read
+//	DELETE /api/v1/inbox/{id}          trash a message
+//	GET    /api/v1/outbox              list sent messages
+//	POST   /api/v1/outbox              send {from, to, subject, body, encoding, ttl}
+//	GET    /api/v1/outbox/{id}
+//	DELETE /api/v1/outbox/{id}
+//	POST   /api/v1/outbox/{id}/confirm send despite the recipient's difficulty
+//	GET    /api/v1/peers               list connected peers
+//	GET    /api/v1/inventory           inventory statistics
+//	GET    /api/v1/inventory/streams   inventory statistics by stream
+//	GET    /api/v1/inventory/sync      progress fetching advertised objects
+//	GET    /api/v1/traffic             bytes and messages sent and received
+//	GET    /api/v1/bans                list banned peer addresses
+//	POST   /api/v1/bans                ban {ip, duration, reason}
+//	DELETE /api/v1/bans/{ip}           lift a ban
+//	GET    /api/v1/pow                 list proof of work jobs, next to run first
+//	PUT    /api/v1/pow/{id}            reprioritize a job {priority}
+//	DELETE /api/v1/pow/{id}            cancel a job
+//	GET    /api/v1/loglevels           log level of each subsystem
+//	PUT    /api/v1/loglevels/{sys}     set a subsystem's level {level}
+//	GET    /api/v1/events              server-sent event stream
+//	GET    /api/v1/session             check that the request is logged in
+//	POST   /api/v1/login               log in {username, password}
+//	POST   /api/v1/logout
+//
+// An empty "to" address sends a broadcast.
+func (s *Server) handleREST(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, restPrefix), "/")
+	resource, arg, _ := strings.Cut(path, "/")
+
+	var h func(w http.ResponseWriter, r *http.Request, arg string)
+	switch resource {
+	case "identities":
+		h = s.restIdentities
+	case "contacts":
+		h = s.restContacts
+	case "subscriptions":
+		h = s.restSubscriptions
+	case "inbox":
+		h = s.restInbox
+	case "outbox":
+		h = s.restOutbox
+	case "peers":
+		h = s.restPeers
+	case "inventory":
+		h = s.restInventory
+	case "bans":
+		h = s.restBans
+	case "traffic":
+		h = s.restTraffic
+	case "pow":
+		h = s.restPOW
+	case "loglevels":
+		h = s.restLogLevels
+	case "events":
+		s.handleEvents(w, r)
+		return
+	case "session":
+		s.handleSession(w, r)
+		return
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	h(w, r, arg)
+}
+
+func methodNotAllowed(w http.ResponseWriter) {
+	writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+}
+
+func (s *Server) restIdentities(w http.ResponseWriter, r *http.Request, addr string) {
+	addr, export := strings.CutSuffix(addr, "/export")
+	switch {
+	case r.Method == "GET" && export:
+		id, err := s.Store.Identity(addr)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, exportJSON(id))
+	case r.Method == "GET" && addr == "":
+		views := []*identityView{}
+		for _, id := range s.Store.Identities() {
+			views = append(views, identityJSON(id))
+		}
+		writeJSON(w, http.StatusOK, views)
+	case r.Method == "GET":
+		id, err := s.Store.Identity(addr)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, identityJSON(id))
+	case r.Method == "POST" && addr == "":
+		var req struct {
+			Label         string `json:"label"`
+			Short         bool   `json:"short"`
+			TrialsPerByte int    `json:"trialsPerByte"`
+			ExtraBytes    int    `json:"extraBytes"`
+			Stream        int    `json:"stream"`
+			Address       string `json:"address"`
+			SignKey       string `json:"signKey"`
+			EncryptKey    string `json:"encryptKey"`
+		}
+		if err := readJSON(r, &req); err != nil {
+			writeError(w, err)
+			return
+		}
+		stream, err := s.checkStream(req.Stream)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		var id *store.Identity
+		if req.SignKey != "" || req.EncryptKey != "" {
+			id, err = s.importIdentity(req.Label, req.Address, stream, req.SignKey, req.EncryptKey)
+		} else {
+			zeros := 1
+			if req.Short {
+				zeros = 2
+			}
+			id, err = s.Store.NewIdentity(req.Label, stream, zeros)
+		}
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		s.Store.SetDifficulty(id.Address, req.TrialsPerByte, req.ExtraBytes)
+		id.TrialsPerByte, id.ExtraBytes = req.TrialsPerByte, req.ExtraBytes
+		if err := s.publishPubKey(id.Address); err != nil {
+			s.Log.Error("failed to queue pubkey", "addr", id.Address, "err", err)
+		}
+		s.save()
+		writeJSON(w, http.StatusCreated, identityJSON(id))
+	case r.Method == "DELETE" && addr != "":
+		if err := s.Store.DeleteIdentity(addr); err != nil {
+			writeError(w, err)
+			return
+		}
+		s.save()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		methodNotAllowed(w)
+	}
+}
+
+// importIdentity restores an identity from its private keys in wallet
+// import format or hex.  Without an address it is put in stream.
+func (s *Server) importIdentity(label, address string, stream int, signKey, encryptKey string) (*store.Identity, error) {
+	sign, err := payload.ParsePrivKey(signKey)
+	if err != nil {
+		return nil, errorf(0, "invalid signing key (%v)", err)
+	}
+	enc, err := payload.ParsePrivKey(encryptKey)
+	if err != nil {
+		return nil, errorf(0, "invalid encryption key (%v)", err)
+	}
+	if address != "" {
+		var a *payload.Address
+		if address, a, err = checkAddress(address); err != nil {
+			return nil, err
+		} else if _, err := s.checkStream(a.Stream); err != nil {
+			return nil, err
+		}
+	}
+	id, err := s.Store.ImportIdentity(label, address, stream, sign, enc)
+	if err != nil {
+		return nil, errorf(0, "%v", err)
+	}
+	return id, nil
+}
+
+func (s *Server) restContacts(w http.ResponseWriter, r *http.Request, addr string) {
+	s.restEntries(w, r, addr, s.Store.AddressBook, s.Store.AddContact, s.Store.DeleteContact)
+}
+
+func (s *Server) restSubscriptions(w http.ResponseWriter, r *http.Request, addr string) {
+	s.restEntries(w, r, addr, s.Store.Subscriptions, s.Store.Subscribe, s.Store.Unsubscribe)
+}
+
+func (s *Server) restEntries(w http.ResponseWriter, r *http.Request, addr string,
+	list func() []*store.Entry, add func(label, addr string) error, del func(addr string) error) {
+	switch {
+	case r.Method == "GET" && addr == "":
+		writeJSON(w, http.StatusOK, entriesJSON(list()))
+	case r.Method == "POST" && addr == "":
+		var req entryView
+		if err := readJSON(r, &req); err != nil {
+			writeError(w, err)
+			return
+		}
+		addr, _, err := checkAddress(req.Address)
+		if err != nil {
+			writeError(w, err)
+			return
+		} else if err := add(req.Label, addr); err != nil {
+			writeError(w, errorf(16, "%v", err))
+			return
+		}
+		s.save()
+		writeJSON(w, http.StatusCreated, &entryView{Label: req.Label, Address: addr, Enabled: true})
+	case r.Method == "DELETE" && addr != "":
+		if err := del(addr); err != nil {
+			writeError(w, err)
+			return
+		}
+		s.save()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		methodNotAllowed(w)
+	}
+}
+
+func (s *Server) restInbox(w http.ResponseWriter, r *http.Request, id string) {
+	s.restMessages(w, r, store.Inbox, id)
+}
+
+func (s *Server) restOutbox(w http.ResponseWriter, r *http.Request, id string) {
+	if id, ok := strings.CutSuffix(id, "/confirm"); ok {
+		if r.Method != "POST" {
+			methodNotAllowed(w)
+			return
+		}
+		m, err := s.Store.Message(id)
+		if err == nil && (m.Folder != store.Sent || m.Status != store.StatusTooDifficult) {
+			err = errorf(0, "message %v isn't waiting for confirmation", id)
+		}
+		if err == nil {
+			err = s.Store.ConfirmDifficulty(id)
+		}
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		m, _ = s.Store.Message(id)
+		if err := s.send(m); err != nil {
+			s.Log.Error("failed to start sending message", "id", id, "err", err)
+		}
+		s.save()
+		m, _ = s.Store.Message(id)
+		writeJSON(w, http.StatusOK, messageJSON(m))
+		return
+	}
+	if r.Method != "POST" || id != "" {
+		s.restMessages(w, r, store.Sent, id)
+		return
+	}
+
+	var req struct {
+		From     string `json:"from"`
+		To       string `json:"to"`
+		Subject  string `json:"subject"`
+		Body     string `json:"body"`
+		Encoding int    `json:"encoding"`
+		TTL      int    `json:"ttl"`
+	}
+	if err := readJSON(r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+	if req.Encoding == 0 {
+		req.Encoding = payload.EncSimple
+	}
+	ttl := defaultTTL
+	if req.TTL != 0 {
+		ttl = time.Duration(req.TTL) * time.Second
+	}
+
+	m, err := s.queueMessage(req.From, req.To, req.Subject, req.Body, req.Encoding, ttl)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, messageJSON(m))
+}
+
+func (s *Server) restMessages(w http.ResponseWriter, r *http.Request, folder, id string) {
+	switch {
+	case r.Method == "GET" && id == "":
+		views := []*messageView{}
+		for _, m := range s.Store.Messages(folder) {
+			views = append(views, messageJSON(m))
+		}
+		writeJSON(w, http.StatusOK, views)
+	case r.Method == "GET":
+		m, err := s.Store.Message(id)
+		if err == nil && m.Folder != folder {
+			err = store.ErrNotFound
+		}
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if !m.Read {
+			s.Store.MarkRead(id, true)
+			s.save()
+			m.Read = true
+		}
+		writeJSON(w, http.StatusOK, messageJSON(m))
+	case r.Method == "DELETE" && id != "":
+		m, err := s.Store.Message(id)
+		if err == nil && m.Folder != folder {
+			err = store.ErrNotFound
+		}
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		s.Store.TrashMessage(id)
+		s.save()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		methodNotAllowed(w)
+	}
+}
+
+func (s *Server) restPeers(w http.ResponseWriter, r *http.Request, arg string) {
+	if r.Method != "GET" {
+		methodNotAllowed(w)
+		return
+	}
+	views := []*peerView{}
+	if s.Node != nil {
+		for _, p := range s.Node.Peers() {
+			views = append(views, peerJSON(p))
+		}
+	}
+	writeJSON(w, http.StatusOK, views)
+}
+
+func (s *Server) restInventory(w http.ResponseWriter, r *http.Request, arg string) {
+	if r.Method != "GET" {
+		methodNotAllowed(w)
+		return
+	}
+	type invStats struct {
+		Objects int `json:"objects"`
+		Peers   int `json:"peers"`
+	}
+	if arg == "streams" {
+		streams := map[int]invStats{}
+		if s.Node != nil {
+			for _, st := range s.Node.Streams() {
+				streams[st] = invStats{s.Node.StreamInvSize(st), len(s.Node.StreamPeers(st))}
+			}
+		}
+		writeJSON(w, http.StatusOK, streams)
+		return
+	} else if arg == "sync" {
+		var p p2p.SyncProgress
+		if s.Sync != nil {
+			p = s.Sync.Progress()
+		}
+		writeJSON(w, http.StatusOK, &p)
+		return
+	}
+
+	var stats invStats
+	if s.Node != nil {
+		stats.Objects = s.Node.InvSize()
+		stats.Peers = len(s.Node.Peers())
+	}
+	writeJSON(w, http.StatusOK, &stats)
+}
+
+func (s *Server) restTraffic(w http.ResponseWriter, r *http.Request, arg string) {
+	if r.Method != "GET" {
+		methodNotAllowed(w)
+		return
+	}
+	var tr p2p.Traffic
+	if s.Node != nil {
+		tr = s.Node.Traffic()
+	}
+	writeJSON(w, http.StatusOK, &tr)
+}
+
+func (s *Server) restBans(w http.ResponseWriter, r *http.Request, ip string) {
+	if s.Node == nil {
+		writeError(w, store.ErrNotFound)
+		return
+	}
+	switch {
+	case r.Method == "GET" && ip == "":
+		writeJSON(w, http.StatusOK, s.Node.Bans.List())
+	case r.Method == "POST" && ip == "":
+		var req struct {
+			IP       string `json:"ip"`
+			Duration string `json:"duration"`
+			Reason   string `json:"reason"`
+		}
+		if err := readJSON(r, &req); err != nil {
+			writeError(w, err)
+			return
+		}
+		d := 24 * time.Hour
+		if req.Duration != "" {
+			var err error
+			if d, err = time.ParseDuration(req.Duration); err != nil || d <= 0 {
+				writeError(w, errorf(0, "invalid ban duration %q", req.Duration))
+				return
+			}
+		}
+		if net.ParseIP(req.IP) == nil {
+			writeError(w, errorf(0, "invalid ip address %q", req.IP))
+			return
+		} else if err := s.Node.Ban(req.IP, d, req.Reason); err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, s.Node.Bans.List())
+	case r.Method == "DELETE" && ip != "":
+		ok, err := s.Node.Bans.Unban(ip)
+		if err == nil && !ok {
+			err = store.ErrNotFound
+		}
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		methodNotAllowed(w)
+	}
+}
+
+func (s *Server) restPOW(w http.ResponseWriter, r *http.Request, id string) {
+	if s.POW == nil {
+		writeError(w, store.ErrNotFound)
+		return
+	}
+	switch {
+	case r.Method == "GET" && id == "":
+		writeJSON(w, http.StatusOK, s.POW.Jobs())
+	case r.Method == "PUT" && id != "":
+		var req struct {
+			Priority int `json:"priority"`
+		}
+		if err := readJSON(r, &req); err != nil {
+			writeError(w, err)
+			return
+		}
+		ok, err := s.POW.SetPriority(id, req.Priority)
+		if err == nil && !ok {
+			err = store.ErrNotFound
+		}
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, s.POW.Jobs())
+	case r.Method == "DELETE" && id != "":
+		ok, err := s.POW.Cancel(id)
+		if err == nil && !ok {
+			err = store.ErrNotFound
+		}
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		methodNotAllowed(w)
+	}
+}
+
+// defaultLevel names the default log level in the loglevels resource.
+const defaultLevel = "default"
+
+func (s *Server) restLogLevels(w http.ResponseWriter, r *http.Request, sys string) {
+	if s.Levels == nil {
+		writeError(w, store.ErrNotFound)
+		return
+	}
+	switch {
+	case r.Method == "GET" && sys == "":
+	case r.Method == "PUT" && sys != "":
+		var req struct {
+			Level string `json:"level"`
+		}
+		if err := readJSON(r, &req); err != nil {
+			writeError(w, err)
+			return
+		}
+		level, err := logging.ParseLevel(req.Level)
+		if err != nil {
+			writeError(w, errorf(0, "invalid log level %q", req.Level))
+			return
+		}
+		if sys == defaultLevel {
+			sys = ""
+		}
+		s.Levels.SetLevel(sys, level)
+	default:
+		methodNotAllowed(w)
+		return
+	}
+
+	levels := map[string]string{}
+	for name, level := range s.Levels.Levels() {
+		if name == "" {
+			name = defaultLevel
+		}
+		levels[name] = logging.LevelName(level)
+	}
+	writeJSON(w, http.StatusOK, levels)
+}
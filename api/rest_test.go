@@ -0,0 +1,528 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rwcarlsen/gobitmsg/msg"
+	"github.com/rwcarlsen/gobitmsg/p2p"
+	"github.com/rwcarlsen/gobitmsg/payload"
+	"github.com/rwcarlsen/gobitmsg/pow"
+	"github.com/rwcarlsen/gobitmsg/store"
+)
+
+func rest(t *testing.T, ts *httptest.Server, method, path string, body, result interface{}) int {
+	var buf bytes.Buffer
+	if body != nil {
+		json.NewEncoder(&buf).Encode(body)
+	}
+	req, _ := http.NewRequest(method, ts.URL+path, &buf)
+	req.SetBasicAuth("user", "pass")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if result != nil {
+		if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+			t.Fatalf("%v %v: %v", method, path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestREST(t *testing.T) {
+	s, ts := newTestServer(t)
+
+	var id identityView
+	if code := rest(t, ts, "POST", "/api/v1/identities", map[string]string{"label": "me"}, &id); code != http.StatusCreated {
+		t.Fatalf("create identity: status %v", code)
+	} else if id.Label != "me" || !strings.HasPrefix(id.Address, "BM-") {
+		t.Fatalf("unexpected identity %+v", id)
+	}
+
+	var exp exportView
+	rest(t, ts, "GET", "/api/v1/identities/"+id.Address+"/export", nil, &exp)
+	if err := s.Store.DeleteIdentity(id.Address); err != nil {
+		t.Fatal(err)
+	}
+	restore := map[string]string{"label": "me", "address": id.Address, "signKey": exp.SignKeyWIF, "encryptKey": exp.EncryptKey}
+	var restored identityView
+	if code := rest(t, ts, "POST", "/api/v1/identities", restore, &restored); code != http.StatusCreated {
+		t.Fatalf("restore identity: status %v", code)
+	} else if restored.Address != id.Address {
+		t.Errorf("restored %v, expected %v", restored.Address, id.Address)
+	}
+	if code := rest(t, ts, "POST", "/api/v1/identities", restore, nil); code != http.StatusBadRequest {
+		t.Errorf("expected status 400 restoring twice, got %v", code)
+	}
+	restore["signKey"] = "5HueCGU8"
+	if code := rest(t, ts, "POST", "/api/v1/identities", restore, nil); code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for a bad key, got %v", code)
+	}
+
+	send := map[string]string{
+		"from":    id.Address,
+		"to":      "BM-2DAjcCFrqFrp88FUxExhJ9kPqHdunQmiyn",
+		"subject": "subj",
+		"body":    "body",
+	}
+	var m messageView
+	if code := rest(t, ts, "POST", "/api/v1/outbox", send, &m); code != http.StatusCreated {
+		t.Fatalf("send: status %v", code)
+	} else if m.Status != store.StatusQueued || m.Subject != "subj" {
+		t.Errorf("unexpected sent message %+v", m)
+	}
+
+	send["to"] = "BM-garbage"
+	var e map[string]string
+	if code := rest(t, ts, "POST", "/api/v1/outbox", send, &e); code != http.StatusBadRequest {
+		t.Errorf("send to bad address: expected status 400, got %v (%v)", code, e)
+	}
+
+	var outbox []messageView
+	rest(t, ts, "GET", "/api/v1/outbox", nil, &outbox)
+	if len(outbox) != 1 || outbox[0].ID != m.ID {
+		t.Errorf("unexpected outbox %+v", outbox)
+	}
+
+	if code := rest(t, ts, "GET", "/api/v1/inbox/"+m.ID, nil, nil); code != http.StatusNotFound {
+		t.Errorf("expected sent message to be missing from inbox, got status %v", code)
+	}
+	if code := rest(t, ts, "DELETE", "/api/v1/outbox/"+m.ID, nil, nil); code != http.StatusNoContent {
+		t.Errorf("trash: status %v", code)
+	}
+	if n := len(s.Store.Messages(store.Trash)); n != 1 {
+		t.Errorf("expected 1 trashed message, got %v", n)
+	}
+
+	var stats map[string]int
+	if code := rest(t, ts, "GET", "/api/v1/inventory", nil, &stats); code != http.StatusOK {
+		t.Errorf("inventory: status %v", code)
+	}
+	if code := rest(t, ts, "GET", "/api/v1/inventory/sync", nil, &stats); code != http.StatusOK {
+		t.Errorf("inventory/sync: status %v", code)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	s, ts := newTestServer(t)
+
+	req, _ := http.NewRequest("GET", ts.URL+"/api/v1/events", nil)
+	req.SetBasicAuth("user", "pass")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("unexpected content type %v", ct)
+	}
+
+	// the subscription is registered before headers are sent
+	s.Store.AddMessage(&store.Message{Folder: store.Inbox, Subject: "hello"})
+
+	lines := make(chan string)
+	go func() {
+		scan := bufio.NewScanner(resp.Body)
+		for scan.Scan() {
+			lines <- scan.Text()
+		}
+		close(lines)
+	}()
+
+	timeout := time.After(5 * time.Second)
+	var gotEvent bool
+wait:
+	for {
+		select {
+		case line := <-lines:
+			if line == "event: "+EventNewMessage {
+				gotEvent = true
+			} else if gotEvent && strings.HasPrefix(line, "data: ") {
+				var ev Event
+				if err := json.Unmarshal([]byte(line[6:]), &ev); err != nil {
+					t.Fatal(err)
+				}
+				data := ev.Data.(map[string]interface{})
+				if data["subject"] != "hello" {
+					t.Errorf("unexpected event data %v", line)
+				}
+				break wait
+			}
+		case <-timeout:
+			t.Fatal("timed out waiting for new-message event")
+		}
+	}
+
+	// closing the hub ends the stream, as on shutdown
+	s.Events.Close()
+	for {
+		select {
+		case _, ok := <-lines:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatal("event stream not ended by closing the hub")
+		}
+	}
+}
+
+func TestBans(t *testing.T) {
+	s, ts := newTestServer(t)
+	s.Node = p2p.NewNode("127.0.0.1", 22350, s.Levels.Logger("p2p"))
+
+	ban := map[string]string{"ip": "10.1.2.3", "duration": "1h", "reason": "spam"}
+	if code := rest(t, ts, "POST", "/api/v1/bans", ban, nil); code != http.StatusCreated {
+		t.Fatalf("ban: status %v", code)
+	}
+	ban["ip"] = "not an ip"
+	if code := rest(t, ts, "POST", "/api/v1/bans", ban, nil); code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for a bad ip, got %v", code)
+	}
+
+	var bans []p2p.Ban
+	rest(t, ts, "GET", "/api/v1/bans", nil, &bans)
+	if len(bans) != 1 || bans[0].IP != "10.1.2.3" || bans[0].Reason != "spam" {
+		t.Fatalf("unexpected ban list %+v", bans)
+	}
+
+	if code := rest(t, ts, "DELETE", "/api/v1/bans/10.1.2.3", nil, nil); code != http.StatusNoContent {
+		t.Errorf("unban: status %v", code)
+	}
+	if code := rest(t, ts, "DELETE", "/api/v1/bans/10.1.2.3", nil, nil); code != http.StatusNotFound {
+		t.Errorf("expected status 404 unbanning twice, got %v", code)
+	}
+}
+
+func TestLogLevels(t *testing.T) {
+	s, ts := newTestServer(t)
+	s.Levels.Logger("p2p")
+
+	var levels map[string]string
+	if code := rest(t, ts, "PUT", "/api/v1/loglevels/p2p", map[string]string{"level": "error"}, &levels); code != http.StatusOK {
+		t.Fatalf("set level: status %v", code)
+	}
+	if code := rest(t, ts, "PUT", "/api/v1/loglevels/default", map[string]string{"level": "warn"}, nil); code != http.StatusOK {
+		t.Fatalf("set default level: status %v", code)
+	}
+	if code := rest(t, ts, "PUT", "/api/v1/loglevels/p2p", map[string]string{"level": "loud"}, nil); code != http.StatusBadRequest {
+		t.Errorf("expected status 400 for a bad level, got %v", code)
+	}
+
+	rest(t, ts, "GET", "/api/v1/loglevels", nil, &levels)
+	want := map[string]string{"default": "warn", "api": "warn", "p2p": "error"}
+	if len(levels) != len(want) {
+		t.Fatalf("got levels %v, want %v", levels, want)
+	}
+	for sys, level := range want {
+		if levels[sys] != level {
+			t.Errorf("got level %v for %v, want %v", levels[sys], sys, level)
+		}
+	}
+	if s.Log.Enabled(context.Background(), slog.LevelInfo) {
+		t.Error("api logger still logs info records")
+	}
+}
+
+func TestPOWJobs(t *testing.T) {
+	s, ts := newTestServer(t)
+	q, err := pow.OpenQueue("", pow.Local{}, payload.DecodePOWObject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.POW = q
+	for _, kind := range []string{pow.KindBroadcast, pow.KindMsg} {
+		obj := &payload.Message{Time: time.Now(), Stream: 1, Data: []byte(kind)}
+		if err := q.Add(&pow.Job{Kind: kind, Cmd: string(msg.Cmsg), Object: obj, TrialsPerByte: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var jobs []pow.Job
+	rest(t, ts, "GET", "/api/v1/pow", nil, &jobs)
+	if len(jobs) != 2 || jobs[0].Kind != pow.KindMsg {
+		t.Fatalf("unexpected job list %+v", jobs)
+	}
+	bcast := jobs[1].ID
+	if code := rest(t, ts, "PUT", "/api/v1/pow/"+bcast, map[string]int{"priority": 50}, &jobs); code != http.StatusOK {
+		t.Fatalf("reprioritize: status %v", code)
+	}
+	if len(jobs) != 2 || jobs[0].ID != bcast {
+		t.Errorf("reprioritized job not first in %+v", jobs)
+	}
+
+	if code := rest(t, ts, "DELETE", "/api/v1/pow/"+bcast, nil, nil); code != http.StatusNoContent {
+		t.Errorf("cancel: status %v", code)
+	}
+	if code := rest(t, ts, "DELETE", "/api/v1/pow/"+bcast, nil, nil); code != http.StatusNotFound {
+		t.Errorf("expected status 404 cancelling twice, got %v", code)
+	}
+	if n := len(q.Jobs()); n != 1 {
+		t.Errorf("%v jobs left, expected 1", n)
+	}
+}
+
+func TestDifficulty(t *testing.T) {
+	s, ts := newTestServer(t)
+	s.MaxTrialsPerByte = 500
+
+	var id identityView
+	req := map[string]interface{}{"label": "me", "trialsPerByte": 1000, "extraBytes": 20000}
+	if code := rest(t, ts, "POST", "/api/v1/identities", req, &id); code != http.StatusCreated {
+		t.Fatalf("create identity: status %v", code)
+	} else if id.TrialsPerByte != 1000 || id.ExtraBytes != 20000 {
+		t.Errorf("identity advertises difficulty %v/%v", id.TrialsPerByte, id.ExtraBytes)
+	}
+
+	m, err := s.queueMessage(id.Address, "BM-2DAjcCFrqFrp88FUxExhJ9kPqHdunQmiyn", "subj", "body", payload.EncSimple, defaultTTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := &payload.PubKey{TrialsPerByte: 1000}
+	if _, _, ok := s.SendDifficulty(m, k); ok {
+		t.Error("difficulty over the limit was allowed")
+	} else if m, _ := s.Store.Message(m.ID); m.Status != store.StatusTooDifficult {
+		t.Errorf("expected status %v, got %v", store.StatusTooDifficult, m.Status)
+	}
+
+	var view messageView
+	path := "/api/v1/outbox/" + m.ID + "/confirm"
+	if code := rest(t, ts, "POST", path, nil, &view); code != http.StatusOK {
+		t.Fatalf("confirm: status %v", code)
+	} else if view.Status != store.StatusQueued {
+		t.Errorf("expected status %v after confirming, got %v", store.StatusQueued, view.Status)
+	}
+	m, _ = s.Store.Message(m.ID)
+	if trials, extra, ok := s.SendDifficulty(m, k); !ok || trials != 1000 || extra != payload.PowExtraLen {
+		t.Errorf("confirmed message got difficulty %v/%v (%v)", trials, extra, ok)
+	}
+	if code := rest(t, ts, "POST", path, nil, nil); code != http.StatusBadRequest {
+		t.Errorf("expected status 400 confirming twice, got %v", code)
+	}
+}
+
+func TestIdentityStreams(t *testing.T) {
+	s, ts := newTestServer(t)
+	s.Node = p2p.NewNode("127.0.0.1", 22351, s.Levels.Logger("p2p"))
+	s.Node.MyVer.Streams = []int{2, 3}
+
+	var id identityView
+	if code := rest(t, ts, "POST", "/api/v1/identities", map[string]string{"label": "me"}, &id); code != http.StatusCreated {
+		t.Fatalf("create identity: status %v", code)
+	} else if id.Stream != 2 {
+		t.Errorf("identity created in stream %v, expected the node's first stream", id.Stream)
+	}
+	req := map[string]interface{}{"label": "other", "stream": 3}
+	if code := rest(t, ts, "POST", "/api/v1/identities", req, &id); code != http.StatusCreated {
+		t.Fatalf("create identity in stream 3: status %v", code)
+	} else if id.Stream != 3 {
+		t.Errorf("identity created in stream %v, expected 3", id.Stream)
+	}
+	req["stream"] = 1
+	if code := rest(t, ts, "POST", "/api/v1/identities", req, nil); code != http.StatusBadRequest {
+		t.Errorf("expected status 400 creating an identity outside the node's streams, got %v", code)
+	}
+
+	other := &payload.Address{Version: 4, Stream: 1, Ripe: make([]byte, 20)}
+	send := map[string]string{"from": id.Address, "to": other.String(), "subject": "subj", "body": "body"}
+	if code := rest(t, ts, "POST", "/api/v1/outbox", send, nil); code != http.StatusBadRequest {
+		t.Errorf("expected status 400 sending outside the node's streams, got %v", code)
+	}
+	other.Stream = 3
+	send["to"] = other.String()
+	if code := rest(t, ts, "POST", "/api/v1/outbox", send, nil); code != http.StatusCreated {
+		t.Errorf("send within the node's streams: status %v", code)
+	}
+}
+
+func TestSendPOW(t *testing.T) {
+	s, ts := newTestServer(t)
+	q, err := pow.OpenQueue("", pow.Local{}, payload.DecodePOWObject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.POW = q
+	s.MaxTrialsPerByte = 500
+
+	var from identityView
+	if code := rest(t, ts, "POST", "/api/v1/identities", map[string]string{"label": "me"}, &from); code != http.StatusCreated {
+		t.Fatalf("create identity: status %v", code)
+	}
+	other, err := store.Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	to, err := other.NewIdentity("you", 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := other.SetDifficulty(to.Address, 1000, 0); err != nil {
+		t.Fatal(err)
+	} else if to, err = other.Identity(to.Address); err != nil {
+		t.Fatal(err)
+	}
+	// takeJob removes the only queued job, which must be of kind, as if
+	// the queue had solved it
+	takeJob := func(kind string) *pow.Job {
+		t.Helper()
+		jobs := q.Jobs()
+		if len(jobs) != 1 || jobs[0].Kind != kind {
+			t.Fatalf("expected a %v job, got %+v", kind, jobs)
+		}
+		q.Cancel(jobs[0].ID)
+		return &jobs[0]
+	}
+	status := func(id, expect string) {
+		t.Helper()
+		if m, err := s.Store.Message(id); err != nil {
+			t.Fatal(err)
+		} else if m.Status != expect {
+			t.Fatalf("message status %v, expected %v", m.Status, expect)
+		}
+	}
+
+	// new identities publish their pubkeys
+	if j := takeJob(pow.KindPubKey); j.Ref != from.Address {
+		t.Errorf("pubkey job for %v, expected %v", j.Ref, from.Address)
+	}
+
+	// the recipient's pubkey is asked for first
+	send := map[string]string{"from": from.Address, "to": to.Address, "subject": "subj", "body": "body"}
+	var m messageView
+	if code := rest(t, ts, "POST", "/api/v1/outbox", send, &m); code != http.StatusCreated {
+		t.Fatalf("send: status %v", code)
+	} else if m.Status != store.StatusAwaitingPubKey {
+		t.Errorf("expected status %v, got %v", store.StatusAwaitingPubKey, m.Status)
+	}
+	if j := takeJob(pow.KindGetPubKey); j.Ref != to.Address || j.Cmd != string(msg.CgetpubKey) {
+		t.Errorf("unexpected getpubkey job %+v", j)
+	}
+
+	// it asks for more work than allowed
+	k := to.PubKey()
+	if err := k.Sign(); err != nil {
+		t.Fatal(err)
+	}
+	s.ObjectReceived(msg.New(msg.Cpubkey, k.Bytes()))
+	status(m.ID, store.StatusTooDifficult)
+	if n := len(q.Jobs()); n != 0 {
+		t.Fatalf("%v jobs queued for a message needing confirmation", n)
+	}
+	var view messageView
+	if code := rest(t, ts, "POST", "/api/v1/outbox/"+m.ID+"/confirm", nil, &view); code != http.StatusOK {
+		t.Fatalf("confirm: status %v", code)
+	} else if view.Status != store.StatusQueued {
+		t.Errorf("expected status %v after confirming, got %v", store.StatusQueued, view.Status)
+	}
+
+	ack := takeJob(pow.KindAck)
+	if ack.Ref != m.ID || ack.TrialsPerByte != payload.PowTrialsPerByte {
+		t.Errorf("unexpected ack job %+v", ack)
+	}
+	ack.Object.SetNonce(1)
+	s.POWDone(ack)
+	j := takeJob(pow.KindMsg)
+	if j.Ref != m.ID || j.TrialsPerByte != 1000 || j.ExtraBytes != payload.PowExtraLen {
+		t.Errorf("unexpected msg job %+v", j)
+	}
+	data, err := to.EncryptKey.Decrypt(j.Object.(*payload.Message).Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mi, err := payload.MsgInfoDecode(data)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := mi.VerifySignature(); err != nil {
+		t.Error(err)
+	}
+	if string(mi.Content) != "Subject:subj\nBody:body" || !bytes.Equal(mi.AckData, ack.Object.Bytes()) {
+		t.Errorf("unexpected message content %q", mi.Content)
+	}
+
+	j.Object.SetNonce(1)
+	s.POWDone(j)
+	status(m.ID, store.StatusSent)
+}
+
+func TestPOWRestart(t *testing.T) {
+	s, ts := newTestServer(t)
+	path := filepath.Join(t.TempDir(), "pow.json")
+	q, err := pow.OpenQueue(path, pow.Local{}, payload.DecodePOWObject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.POW = q
+
+	var id identityView
+	if code := rest(t, ts, "POST", "/api/v1/identities", map[string]string{"label": "me"}, &id); code != http.StatusCreated {
+		t.Fatalf("create identity: status %v", code)
+	}
+	addr, err := payload.AddressDecode(id.Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a request for the pubkey already being published adds nothing
+	g := &payload.GetPubKey{Time: time.Now(), AddrVersion: addr.Version, Stream: addr.Stream, RipeHash: addr.Ripe}
+	s.ObjectReceived(msg.New(msg.CgetpubKey, g.Bytes()))
+	var m messageView
+	send := map[string]string{"from": id.Address, "subject": "news", "body": "body"}
+	if code := rest(t, ts, "POST", "/api/v1/outbox", send, &m); code != http.StatusCreated {
+		t.Fatalf("broadcast: status %v", code)
+	}
+
+	// the unsolved objects are resumed by a restarted queue
+	if q, err = pow.OpenQueue(path, pow.Local{}, payload.DecodePOWObject); err != nil {
+		t.Fatal(err)
+	}
+	s.POW = q
+	jobs := q.Jobs()
+	if len(jobs) != 2 || jobs[0].Kind != pow.KindPubKey || jobs[1].Kind != pow.KindBroadcast {
+		t.Fatalf("unexpected jobs after a restart %+v", jobs)
+	}
+	k := jobs[0].Object.(*payload.PubKey)
+	if jobs[0].Ref != id.Address || k.VerifySignature() != nil {
+		t.Errorf("bad pubkey job %+v", jobs[0])
+	}
+
+	b := jobs[1].Object.(*payload.Broadcast)
+	key, err := addr.BroadcastKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := key.Decrypt(b.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bi, err := payload.BroadcastInfoDecode(data)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := bi.VerifySignature(); err != nil {
+		t.Error(err)
+	} else if string(bi.Msg) != "Subject:news\nBody:body" {
+		t.Errorf("unexpected broadcast content %q", bi.Msg)
+	}
+	q.Cancel(jobs[1].ID)
+	s.POWDone(&jobs[1])
+	if m, err := s.Store.Message(m.ID); err != nil {
+		t.Fatal(err)
+	} else if m.Status != store.StatusBroadcastSent {
+		t.Errorf("broadcast status %v, expected %v", m.Status, store.StatusBroadcastSent)
+	}
+
+	// once the pubkey is out, it is published again when asked for
+	q.Cancel(jobs[0].ID)
+	s.ObjectReceived(msg.New(msg.CgetpubKey, g.Bytes()))
+	if jobs := q.Jobs(); len(jobs) != 1 || jobs[0].Kind != pow.KindPubKey {
+		t.Errorf("getpubkey not answered: %+v", jobs)
+	}
+}
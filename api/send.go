@@ -0,0 +1,382 @@
+package api
+
+import (
+	"crypto/rand"
+	"strings"
+	"time"
+
+	"github.com/rwcarlsen/gobitmsg/msg"
+	"github.com/rwcarlsen/gobitmsg/payload"
+	"github.com/rwcarlsen/gobitmsg/pow"
+	"github.com/rwcarlsen/gobitmsg/store"
+)
+
+const broadcastRecipient = "[Broadcast subscribers]"
+
+// checkAddress decodes and validates a bitmessage address, returning it in
+// canonical form.
+func checkAddress(s string) (string, *payload.Address, error) {
+	a, err := payload.AddressDecode(s)
+	if err != nil {
+		if strings.Contains(err.Error(), "checksum") {
+			return "", nil, errorf(8, "Checksum failed for address: %v", s)
+		} else if strings.Contains(err.Error(), "base58") {
+			return "", nil, errorf(9, "Invalid characters in address: %v", s)
+		}
+		return "", nil, errorf(7, "Could not decode address: %v", s)
+	}
+	if a.Version < 2 || a.Version > 4 {
+		return "", nil, errorf(11, "The address version number currently must be 2, 3 or 4. Others aren't supported. Check the address.")
+	}
+	return a.String(), a, nil
+}
+
+// streams returns the streams the node is in, or stream 1 without a node.
+func (s *Server) streams() []int {
+	if s.Node == nil {
+		return []int{1}
+	}
+	return s.Node.Streams()
+}
+
+// checkStream returns an error unless the node is in stream.  Zero means
+// the node's first stream, which is returned.
+func (s *Server) checkStream(stream int) (int, error) {
+	streams := s.streams()
+	if stream == 0 {
+		return streams[0], nil
+	}
+	for _, st := range streams {
+		if st == stream {
+			return stream, nil
+		}
+	}
+	return 0, errorf(12, "The stream number must be one of %v, the streams this node is in.", streams)
+}
+
+// queueMessage validates and stores a new outbound message from one of our
+// identities.  An empty to address queues a broadcast.
+func (s *Server) queueMessage(from, to, subject, body string, enc int, ttl time.Duration) (*store.Message, error) {
+	from, fromAddr, err := checkAddress(from)
+	if err != nil {
+		return nil, err
+	} else if _, err := s.checkStream(fromAddr.Stream); err != nil {
+		return nil, err
+	}
+	id, err := s.Store.Identity(from)
+	if err != nil {
+		return nil, errorf(13, "Could not find your fromAddress in the keys.dat file.")
+	} else if !id.Enabled {
+		return nil, errorf(14, "Your fromAddress is disabled. Cannot send.")
+	}
+
+	if enc != payload.EncTrivial && enc != payload.EncSimple {
+		return nil, errorf(6, "The encoding type must be 1 or 2.")
+	}
+	if ttl < minTTL {
+		ttl = minTTL
+	} else if ttl > maxTTL {
+		ttl = maxTTL
+	}
+
+	m := &store.Message{
+		Folder:   store.Sent,
+		From:     id.Address,
+		Subject:  subject,
+		Body:     body,
+		Encoding: enc,
+		Read:     true,
+		TTL:      ttl,
+		AckData:  make([]byte, 32),
+	}
+	if _, err := rand.Read(m.AckData); err != nil {
+		return nil, err
+	}
+
+	if to == "" {
+		m.To = broadcastRecipient
+		m.Broadcast = true
+		m.Status = store.StatusBroadcast
+	} else {
+		var toAddr *payload.Address
+		if m.To, toAddr, err = checkAddress(to); err != nil {
+			return nil, err
+		} else if _, err := s.checkStream(toAddr.Stream); err != nil {
+			return nil, err
+		}
+		m.Status = store.StatusQueued
+	}
+
+	if err := s.Store.AddMessage(m); err != nil {
+		return nil, err
+	}
+	if err := s.send(m); err != nil {
+		s.Log.Error("failed to start sending message", "id", m.ID, "err", err)
+	}
+	s.save()
+	return s.Store.Message(m.ID)
+}
+
+// send starts sending the outbound message m by queueing the proof of work
+// for it if it is a broadcast, or else for its ack, or for a getpubkey if
+// its recipient's pubkey is unknown.  Without a POW queue messages stay
+// queued.
+func (s *Server) send(m *store.Message) error {
+	if s.POW == nil {
+		return nil
+	} else if m.Broadcast {
+		return s.queueBroadcast(m)
+	}
+	k, err := s.recipientKey(m.To)
+	if err == store.ErrNotFound {
+		return s.requestPubKey(m)
+	} else if err != nil {
+		return err
+	}
+	if _, _, ok := s.SendDifficulty(m, k); !ok {
+		return nil
+	}
+
+	id, err := s.Store.Identity(m.From)
+	if err != nil {
+		return err
+	}
+	// the recipient publishes the ack, solved by us, to acknowledge m
+	ack := &payload.Message{Time: payload.FuzzyTime(payload.DefaultFuzz), Stream: id.Stream, Data: m.AckData}
+	if err := s.Store.SetStatus(m.ID, store.StatusQueued); err != nil {
+		return err
+	}
+	return s.POW.Add(&pow.Job{
+		Kind:          pow.KindAck,
+		Cmd:           string(msg.Cmsg),
+		Ref:           m.ID,
+		Object:        ack,
+		TrialsPerByte: payload.PowTrialsPerByte,
+		ExtraBytes:    payload.PowExtraLen,
+	})
+}
+
+// recipientKey returns the pubkey of addr, which may be one of our own
+// identities.
+func (s *Server) recipientKey(addr string) (*payload.PubKey, error) {
+	if id, err := s.Store.Identity(addr); err == nil {
+		return id.PubKey(), nil
+	}
+	return s.Store.PubKey(addr)
+}
+
+// requestPubKey puts m in StatusAwaitingPubKey and asks the network for its
+// recipient's pubkey, unless that has already been done.
+func (s *Server) requestPubKey(m *store.Message) error {
+	if err := s.Store.SetStatus(m.ID, store.StatusAwaitingPubKey); err != nil {
+		return err
+	} else if s.queued(pow.KindGetPubKey, m.To) != nil {
+		return nil
+	}
+	to, err := payload.AddressDecode(m.To)
+	if err != nil {
+		return err
+	}
+	return s.POW.Add(&pow.Job{
+		Kind: pow.KindGetPubKey,
+		Cmd:  string(msg.CgetpubKey),
+		Ref:  m.To,
+		Object: &payload.GetPubKey{
+			Time:        payload.FuzzyTime(payload.DefaultFuzz),
+			AddrVersion: to.Version,
+			Stream:      to.Stream,
+			RipeHash:    to.Ripe,
+		},
+		TrialsPerByte: payload.PowTrialsPerByte,
+		ExtraBytes:    payload.PowExtraLen,
+	})
+}
+
+// queueMsg encrypts the outbound message with id for its recipient, along
+// with its solved ack, and queues the proof of work for it at the
+// recipient's difficulty.
+func (s *Server) queueMsg(id string, ack []byte) error {
+	m, err := s.Store.Message(id)
+	if err != nil {
+		return err
+	}
+	k, err := s.recipientKey(m.To)
+	if err != nil {
+		return err
+	}
+	trialsPerByte, extraBytes, ok := s.SendDifficulty(m, k)
+	if !ok {
+		return nil
+	}
+	from, err := s.Store.Identity(m.From)
+	if err != nil {
+		return err
+	}
+	fromAddr, err := payload.AddressDecode(from.Address)
+	if err != nil {
+		return err
+	}
+	to, err := payload.AddressDecode(m.To)
+	if err != nil {
+		return err
+	}
+
+	mi := &payload.MsgInfo{
+		MsgVersion:  1,
+		AddrVersion: fromAddr.Version,
+		Stream:      from.Stream,
+		SignKey:     from.SignKey,
+		EncryptKey:  from.EncryptKey,
+		DestRipe:    to.Ripe,
+		Encoding:    m.Encoding,
+		Content:     content(m),
+		AckData:     ack,
+	}
+	obj, err := payload.NewMessage(mi, k.EncryptKey, to.Stream)
+	if err != nil {
+		return err
+	}
+	obj.TrialsPerByte, obj.ExtraBytes = trialsPerByte, extraBytes
+	return s.POW.Add(&pow.Job{
+		Kind:          pow.KindMsg,
+		Cmd:           string(msg.Cmsg),
+		Ref:           m.ID,
+		Object:        obj,
+		TrialsPerByte: trialsPerByte,
+		ExtraBytes:    extraBytes,
+	})
+}
+
+// queueBroadcast encrypts the outbound broadcast m to its sender's
+// broadcast key and queues the proof of work for it.
+func (s *Server) queueBroadcast(m *store.Message) error {
+	from, err := s.Store.Identity(m.From)
+	if err != nil {
+		return err
+	}
+	fromAddr, err := payload.AddressDecode(from.Address)
+	if err != nil {
+		return err
+	}
+	k := from.PubKey()
+	bi := &payload.BroadcastInfo{
+		BroadcastVersion: payload.BroadcastVersion,
+		AddrVersion:      fromAddr.Version,
+		Stream:           from.Stream,
+		SignKey:          from.SignKey,
+		EncryptKey:       from.EncryptKey,
+		TrialsPerByte:    k.TrialsPerByte,
+		ExtraBytes:       k.ExtraBytes,
+		Encoding:         m.Encoding,
+		Msg:              content(m),
+	}
+	obj, err := payload.NewBroadcast(bi, from.Stream)
+	if err != nil {
+		return err
+	}
+	return s.POW.Add(&pow.Job{
+		Kind:          pow.KindBroadcast,
+		Cmd:           string(msg.Cbroadcast),
+		Ref:           m.ID,
+		Object:        obj,
+		TrialsPerByte: payload.PowTrialsPerByte,
+		ExtraBytes:    payload.PowExtraLen,
+	})
+}
+
+// publishPubKey queues the proof of work for the pubkey of our identity
+// addr, replacing a queued one that may advertise an old difficulty.
+func (s *Server) publishPubKey(addr string) error {
+	if s.POW == nil {
+		return nil
+	}
+	id, err := s.Store.Identity(addr)
+	if err != nil {
+		return err
+	}
+	if j := s.queued(pow.KindPubKey, addr); j != nil {
+		if _, err := s.POW.Cancel(j.ID); err != nil {
+			return err
+		}
+	}
+	k := id.PubKey()
+	if err := k.Sign(); err != nil {
+		return err
+	}
+	return s.POW.Add(&pow.Job{
+		Kind:          pow.KindPubKey,
+		Cmd:           string(msg.Cpubkey),
+		Ref:           addr,
+		Object:        k,
+		TrialsPerByte: payload.PowTrialsPerByte,
+		ExtraBytes:    payload.PowExtraLen,
+	})
+}
+
+// queued returns the queued job of kind for ref, or nil if there is none.
+func (s *Server) queued(kind, ref string) *pow.Job {
+	for _, j := range s.POW.Jobs() {
+		if j.Kind == kind && j.Ref == ref {
+			return &j
+		}
+	}
+	return nil
+}
+
+// content returns the text of m in its encoding.
+func content(m *store.Message) []byte {
+	if m.Encoding == payload.EncTrivial {
+		return []byte(m.Body)
+	}
+	return []byte("Subject:" + m.Subject + "\nBody:" + m.Body)
+}
+
+// POWDone handles a job solved by the POW queue.  The objects of most jobs
+// are published, while a solved ack is put in the message it belongs to.
+func (s *Server) POWDone(j *pow.Job) {
+	var err error
+	switch j.Kind {
+	case pow.KindAck:
+		err = s.queueMsg(j.Ref, j.Object.Bytes())
+	case pow.KindMsg:
+		if err = s.publish(j); err == nil {
+			err = s.Store.SetStatus(j.Ref, store.StatusSent)
+		}
+	case pow.KindBroadcast:
+		if err = s.publish(j); err == nil {
+			err = s.Store.SetStatus(j.Ref, store.StatusBroadcastSent)
+		}
+	default:
+		err = s.publish(j)
+	}
+	if err != nil {
+		s.Log.Error("failed to handle finished proof of work", "kind", j.Kind, "job", j.ID, "ref", j.Ref, "err", err)
+	}
+	s.save()
+}
+
+// publish sends the object of the solved job j to the network.
+func (s *Server) publish(j *pow.Job) error {
+	if s.Node == nil {
+		return nil
+	}
+	return s.Node.Publish(msg.New(msg.Command(j.Cmd), j.Object.Bytes()))
+}
+
+// SendDifficulty returns the proof of work difficulty to send the outbound
+// message m with to the owner of k.  If k asks for more than the server's
+// limits and the user hasn't confirmed m, m is put in StatusTooDifficult
+// and ok is false.
+func (s *Server) SendDifficulty(m *store.Message, k *payload.PubKey) (trialsPerByte, extraBytes int, ok bool) {
+	trialsPerByte, extraBytes, err := k.Difficulty(s.MaxTrialsPerByte, s.MaxExtraBytes)
+	if err == nil || m.Confirmed {
+		return trialsPerByte, extraBytes, true
+	}
+	s.Log.Info("recipient asks for too much proof of work", "id", m.ID, "to", m.To,
+		"trialsPerByte", trialsPerByte, "extraBytes", extraBytes)
+	if err := s.Store.SetStatus(m.ID, store.StatusTooDifficult); err != nil {
+		s.Log.Error("failed to update message status", "id", m.ID, "err", err)
+	}
+	s.save()
+	return trialsPerByte, extraBytes, false
+}
@@ -0,0 +1,168 @@
+// Package api implements the HTTP API used to drive a gobitmsg node.  It
+// speaks the PyBitmessage XML-RPC method set at the server root so that
+// existing client tools work unchanged, a JSON API with a server-sent event
+// stream under /api/v1/ and a web frontend under /ui/.
+package api
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/rwcarlsen/gobitmsg/logging"
+	"github.com/rwcarlsen/gobitmsg/p2p"
+	"github.com/rwcarlsen/gobitmsg/pow"
+	"github.com/rwcarlsen/gobitmsg/store"
+)
+
+// apiError is returned by methods for user errors.  Like PyBitmessage,
+// these are reported to the client as a normal string result rather than
+// as an XML-RPC fault.
+type apiError struct {
+	code int
+	msg  string
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("API Error %04d: %v", e.code, e.msg)
+}
+
+func errorf(code int, format string, args ...interface{}) error {
+	return &apiError{code, fmt.Sprintf(format, args...)}
+}
+
+// Server serves the node API and web frontend over HTTP.  API requests must
+// carry HTTP basic auth credentials matching Username and Password or a
+// session cookie from logging in to the web frontend.  If Username is
+// empty, every API request is refused.
+type Server struct {
+	Store *store.Store
+	// Node is used to report on peers and inventory and to publish
+	// objects.  It may be nil.
+	Node     *p2p.Node
+	Events   *Hub
+	Username string
+	Password string
+	Log      *slog.Logger
+	// Levels, if set, lets API clients change log levels.
+	Levels *logging.Levels
+	// Sync, if set, is used to report initial sync progress.
+	Sync *p2p.Syncer
+	// POW, if set, is the proof of work queue clients may manage and
+	// outbound messages are solved on.  Its Done function should be
+	// POWDone.
+	POW *pow.Queue
+	// MaxTrialsPerByte and MaxExtraBytes limit the proof of work done for
+	// a message without the user's confirmation.  Zero means no limit.
+	MaxTrialsPerByte int
+	MaxExtraBytes    int
+	mux              *http.ServeMux
+	ui               http.Handler
+	sessions         sessions
+}
+
+func NewServer(st *store.Store, node *p2p.Node, user, pass string, lg *slog.Logger) *Server {
+	s := &Server{
+		Store:    st,
+		Node:     node,
+		Events:   NewHub(),
+		Username: user,
+		Password: pass,
+		Log:      lg,
+		mux:      http.NewServeMux(),
+		ui:       uiHandler(),
+	}
+	s.mux.HandleFunc("/", s.handleXMLRPC)
+	s.mux.HandleFunc(restPrefix, s.handleREST)
+	st.Watch(s.storeEvent)
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch path := r.URL.Path; {
+	case path == "/" && r.Method == "GET", path == "/ui":
+		http.Redirect(w, r, uiPrefix, http.StatusFound)
+		return
+	case strings.HasPrefix(path, uiPrefix):
+		s.ui.ServeHTTP(w, r)
+		return
+	case path == restPrefix+"login":
+		s.handleLogin(w, r)
+		return
+	case path == restPrefix+"logout":
+		s.handleLogout(w, r)
+		return
+	}
+
+	if !s.authorized(r) {
+		if !strings.HasPrefix(r.URL.Path, restPrefix) {
+			w.Header().Set("WWW-Authenticate", `Basic realm="gobitmsg"`)
+		}
+		http.Error(w, "RPC Username or password incorrect or HTTP header lacks authentication at all.", http.StatusUnauthorized)
+		return
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+// authorized reports whether r carries valid basic auth credentials or a
+// web frontend session cookie.
+func (s *Server) authorized(r *http.Request) bool {
+	if s.sessionValid(r) {
+		return true
+	}
+	user, pass, ok := r.BasicAuth()
+	return ok && s.credentialsOK(user, pass)
+}
+
+func (s *Server) credentialsOK(user, pass string) bool {
+	if s.Username == "" {
+		return false
+	}
+	userOK := subtle.ConstantTimeCompare([]byte(user), []byte(s.Username)) == 1
+	passOK := subtle.ConstantTimeCompare([]byte(pass), []byte(s.Password)) == 1
+	return userOK && passOK
+}
+
+func (s *Server) handleXMLRPC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "xml-rpc requests must be POSTed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/xml")
+
+	name, params, err := decodeCall(r.Body)
+	if err != nil {
+		encodeFault(w, 1, err.Error())
+		return
+	}
+
+	m, ok := methods[name]
+	if !ok {
+		encodeResponse(w, errorf(20, "Invalid method: %v", name).Error())
+		return
+	}
+
+	result, err := m(s, params)
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		result = apiErr.Error()
+	} else if err != nil {
+		s.Log.Error("api method failed", "method", name, "err", err)
+		encodeFault(w, 1, fmt.Sprintf("%v failed: %v", name, err))
+		return
+	}
+
+	if err := encodeResponse(w, result); err != nil {
+		s.Log.Error("api method response failed", "method", name, "err", err)
+	}
+}
+
+// save flushes the store after a method has modified it.
+func (s *Server) save() {
+	if err := s.Store.Save(); err != nil {
+		s.Log.Error("failed to save store", "err", err)
+	}
+}
@@ -0,0 +1,156 @@
+package api
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/rwcarlsen/gobitmsg/logging"
+	"github.com/rwcarlsen/gobitmsg/store"
+)
+
+func newTestServer(t *testing.T) (*Server, *httptest.Server) {
+	st, err := store.Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	levels := logging.NewText(os.Stdout, slog.LevelDebug)
+	s := NewServer(st, nil, "user", "pass", levels.Logger("api"))
+	s.Levels = levels
+	ts := httptest.NewServer(s)
+	t.Cleanup(ts.Close)
+	return s, ts
+}
+
+// call performs an XML-RPC call with string arguments and returns the
+// decoded result.
+func call(t *testing.T, ts *httptest.Server, user, method string, args ...interface{}) interface{} {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "<?xml version='1.0'?><methodCall><methodName>%v</methodName><params>", method)
+	for _, arg := range args {
+		buf.WriteString("<param>")
+		encodeValue(&buf, arg)
+		buf.WriteString("</param>")
+	}
+	buf.WriteString("</params></methodCall>")
+
+	req, _ := http.NewRequest("POST", ts.URL, &buf)
+	req.SetBasicAuth(user, "pass")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode
+	}
+
+	// reuse the request decoder by dressing the response up as a call
+	data, _ := io.ReadAll(resp.Body)
+	s := strings.Replace(string(data), "<methodResponse>", "<methodCall><methodName>r</methodName>", 1)
+	s = strings.Replace(s, "</methodResponse>", "</methodCall>", 1)
+	_, vals, err := decodeCall(strings.NewReader(s))
+	if err != nil {
+		t.Fatal(err)
+	} else if len(vals) != 1 {
+		t.Fatalf("expected 1 result value from %v, got %v: %s", method, len(vals), data)
+	}
+	return vals[0]
+}
+
+func b64s(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+
+func TestAuth(t *testing.T) {
+	_, ts := newTestServer(t)
+	if code := call(t, ts, "nobody", "helloWorld", "a", "b"); code != http.StatusUnauthorized {
+		t.Errorf("expected status %v, got %v", http.StatusUnauthorized, code)
+	}
+	if got := call(t, ts, "user", "helloWorld", "a", "b"); got != "a-b" {
+		t.Errorf("expected 'a-b', got %v", got)
+	}
+	if got := call(t, ts, "user", "add", 2, 3); got != 5 {
+		t.Errorf("expected 5, got %v", got)
+	}
+}
+
+func TestSendMessage(t *testing.T) {
+	s, ts := newTestServer(t)
+
+	from := call(t, ts, "user", "createRandomAddress", b64s("me")).(string)
+	if !strings.HasPrefix(from, "BM-") {
+		t.Fatalf("bad address from createRandomAddress: %v", from)
+	}
+
+	var addrs struct {
+		Addresses []struct {
+			Label   string
+			Address string
+		}
+	}
+	list := call(t, ts, "user", "listAddresses").(string)
+	if err := json.Unmarshal([]byte(list), &addrs); err != nil {
+		t.Fatal(err)
+	} else if len(addrs.Addresses) != 1 || addrs.Addresses[0].Address != from || addrs.Addresses[0].Label != "me" {
+		t.Fatalf("unexpected address list %v", list)
+	}
+
+	const to = "BM-2DAjcCFrqFrp88FUxExhJ9kPqHdunQmiyn"
+	ack := call(t, ts, "user", "sendMessage", to, from, b64s("subj"), b64s("body"), 2).(string)
+	if strings.HasPrefix(ack, "API Error") {
+		t.Fatal(ack)
+	}
+	if status := call(t, ts, "user", "getStatus", ack); status != store.StatusQueued {
+		t.Errorf("expected status %v, got %v", store.StatusQueued, status)
+	}
+
+	if got := call(t, ts, "user", "sendMessage", to, to, b64s("subj"), b64s("body")).(string); !strings.HasPrefix(got, "API Error 0013") {
+		t.Errorf("expected error 0013 sending from unknown address, got %v", got)
+	}
+	if got := call(t, ts, "user", "sendMessage", "BM-nope", from, b64s("subj"), b64s("body")).(string); !strings.HasPrefix(got, "API Error") {
+		t.Errorf("expected error sending to bad address, got %v", got)
+	}
+
+	var sent struct {
+		SentMessages []struct {
+			Msgid   string
+			Subject string
+			AckData string
+		}
+	}
+	list = call(t, ts, "user", "getAllSentMessages").(string)
+	if err := json.Unmarshal([]byte(list), &sent); err != nil {
+		t.Fatal(err)
+	} else if len(sent.SentMessages) != 1 || sent.SentMessages[0].Subject != b64s("subj") || sent.SentMessages[0].AckData != ack {
+		t.Fatalf("unexpected sent messages %v", list)
+	}
+
+	call(t, ts, "user", "trashMessage", sent.SentMessages[0].Msgid)
+	if n := len(s.Store.Messages(store.Sent)); n != 0 {
+		t.Errorf("expected no sent messages after trashing, got %v", n)
+	}
+}
+
+func TestSubscriptions(t *testing.T) {
+	_, ts := newTestServer(t)
+
+	const addr = "BM-2DAjcCFrqFrp88FUxExhJ9kPqHdunQmiyn"
+	if got := call(t, ts, "user", "addSubscription", addr, b64s("news")); got != "Added subscription." {
+		t.Errorf("unexpected addSubscription result %v", got)
+	}
+	if got := call(t, ts, "user", "addSubscription", addr, b64s("news")).(string); !strings.HasPrefix(got, "API Error 0016") {
+		t.Errorf("expected error 0016 on duplicate subscription, got %v", got)
+	}
+
+	list := call(t, ts, "user", "listSubscriptions").(string)
+	if !strings.Contains(list, addr) || !strings.Contains(list, b64s("news")) {
+		t.Errorf("subscription missing from list %v", list)
+	}
+}
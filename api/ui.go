@@ -0,0 +1,126 @@
+package api
+
+import (
+	"crypto/rand"
+	"embed"
+	"encoding/hex"
+	"io/fs"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	uiPrefix      = "/ui/"
+	sessionCookie = "gobitmsg_session"
+	sessionLife   = 24 * time.Hour
+)
+
+//go:embed web
+var webFiles embed.FS
+
+// uiHandler serves the embedded web frontend.  The frontend itself holds no
+// data; it logs in and uses the JSON API like any other client.
+func uiHandler() http.Handler {
+	sub, err := fs.Sub(webFiles, "web")
+	if err != nil {
+		panic(err)
+	}
+	return http.StripPrefix(uiPrefix, http.FileServer(http.FS(sub)))
+}
+
+// sessions tracks browser logins so the web frontend can authenticate with a
+// cookie instead of basic auth.
+type sessions struct {
+	mu     sync.Mutex
+	tokens map[string]time.Time
+}
+
+func (ss *sessions) create() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	tok := hex.EncodeToString(b)
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	if ss.tokens == nil {
+		ss.tokens = map[string]time.Time{}
+	}
+	now := time.Now()
+	for t, exp := range ss.tokens {
+		if now.After(exp) {
+			delete(ss.tokens, t)
+		}
+	}
+	ss.tokens[tok] = now.Add(sessionLife)
+	return tok, nil
+}
+
+func (ss *sessions) valid(tok string) bool {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	exp, ok := ss.tokens[tok]
+	return ok && time.Now().Before(exp)
+}
+
+func (ss *sessions) remove(tok string) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	delete(ss.tokens, tok)
+}
+
+func (s *Server) sessionValid(r *http.Request) bool {
+	c, err := r.Cookie(sessionCookie)
+	return err == nil && s.sessions.valid(c.Value)
+}
+
+func (s *Server) handleLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		methodNotAllowed(w)
+		return
+	}
+	var req struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if err := readJSON(r, &req); err != nil {
+		writeError(w, err)
+		return
+	} else if !s.credentialsOK(req.Username, req.Password) {
+		s.Log.Warn("failed web login", "remote", r.RemoteAddr)
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid username or password"})
+		return
+	}
+
+	tok, err := s.sessions.create()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    tok,
+		Path:     "/",
+		MaxAge:   int(sessionLife / time.Second),
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+		Secure:   r.TLS != nil,
+	})
+	writeJSON(w, http.StatusOK, map[string]string{"username": req.Username})
+}
+
+func (s *Server) handleLogout(w http.ResponseWriter, r *http.Request) {
+	if c, err := r.Cookie(sessionCookie); err == nil {
+		s.sessions.remove(c.Value)
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Path: "/", MaxAge: -1})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleSession reports whether the request is logged in.  It is only
+// reached by authorized requests.
+func (s *Server) handleSession(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]bool{"ok": true})
+}
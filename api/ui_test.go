@@ -0,0 +1,76 @@
+package api
+
+import (
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"strings"
+	"testing"
+)
+
+func TestWebLogin(t *testing.T) {
+	_, ts := newTestServer(t)
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Jar: jar}
+
+	resp, err := client.Get(ts.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.Contains(string(page), "app.js") {
+		t.Fatalf("expected the frontend page, got status %v: %.100s", resp.StatusCode, page)
+	} else if !strings.Contains(string(page), `id="view-pow"`) {
+		t.Error("frontend page has no proof of work view")
+	}
+
+	resp, err = client.Get(ts.URL + "/api/v1/session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected status 401 before login, got %v", resp.StatusCode)
+	}
+
+	login := func(pass string) int {
+		body := `{"username": "user", "password": "` + pass + `"}`
+		resp, err := client.Post(ts.URL+"/api/v1/login", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := login("wrong"); code != http.StatusUnauthorized {
+		t.Errorf("expected status 401 for bad password, got %v", code)
+	}
+	if code := login("pass"); code != http.StatusOK {
+		t.Fatalf("login failed with status %v", code)
+	}
+
+	resp, err = client.Get(ts.URL + "/api/v1/identities")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected status 200 after login, got %v", resp.StatusCode)
+	}
+
+	resp, err = client.Post(ts.URL+"/api/v1/logout", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	resp, err = client.Get(ts.URL + "/api/v1/session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected status 401 after logout, got %v", resp.StatusCode)
+	}
+}
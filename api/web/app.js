@@ -0,0 +1,370 @@
+'use strict';
+
+const api = '/api/v1/';
+let events = null;
+
+function $(id) {
+	return document.getElementById(id);
+}
+
+async function request(method, path, body) {
+	const opts = {method: method, headers: {}, credentials: 'same-origin'};
+	if (body !== undefined) {
+		opts.headers['Content-Type'] = 'application/json';
+		opts.body = JSON.stringify(body);
+	}
+	const resp = await fetch(api + path, opts);
+	if (resp.status === 401) {
+		showLogin();
+		throw new Error('not logged in');
+	}
+	if (resp.status === 204) {
+		return null;
+	}
+	const data = await resp.json();
+	if (!resp.ok) {
+		throw new Error(data.error || resp.statusText);
+	}
+	return data;
+}
+
+function showError(err) {
+	$('error').textContent = err ? err.message : '';
+}
+
+function row(cells, onclick) {
+	const tr = document.createElement('tr');
+	for (const c of cells) {
+		const td = document.createElement('td');
+		if (c instanceof Node) {
+			td.appendChild(c);
+		} else {
+			td.textContent = c;
+		}
+		tr.appendChild(td);
+	}
+	if (onclick) {
+		tr.addEventListener('click', onclick);
+	}
+	return tr;
+}
+
+function button(text, onclick) {
+	const b = document.createElement('button');
+	b.textContent = text;
+	b.addEventListener('click', (ev) => {
+		ev.stopPropagation();
+		onclick().catch(showError);
+	});
+	return b;
+}
+
+function fill(id, rows) {
+	const tbody = $(id);
+	tbody.replaceChildren(...rows);
+}
+
+function when(t) {
+	return new Date(t).toLocaleString();
+}
+
+// views
+
+async function loadInbox() {
+	const msgs = await request('GET', 'inbox');
+	msgs.reverse();
+	let unread = 0;
+	fill('inbox-list', msgs.map((m) => {
+		if (!m.read) {
+			unread++;
+		}
+		const tr = row([m.from, m.to, m.subject, when(m.time),
+			button('Trash', async () => {
+				await request('DELETE', 'inbox/' + m.id);
+				$('message').classList.add('hidden');
+				await loadInbox();
+			})], () => openMessage(m.id).catch(showError));
+		if (!m.read) {
+			tr.classList.add('unread');
+		}
+		return tr;
+	}));
+	$('unread').textContent = unread ? '(' + unread + ')' : '';
+}
+
+async function openMessage(id) {
+	const m = await request('GET', 'inbox/' + id);
+	$('message-from').textContent = m.from;
+	$('message-to').textContent = m.to;
+	$('message-subject').textContent = m.subject;
+	$('message-body').textContent = m.body;
+	$('message-reply').onclick = () => {
+		$('compose-to').value = m.from;
+		$('compose-subject').value = m.subject.startsWith('Re: ') ? m.subject : 'Re: ' + m.subject;
+		$('compose-body').value = '\n\n------------------------------------------------------\n' + m.body;
+		for (const opt of $('compose-from').options) {
+			opt.selected = opt.value === m.to;
+		}
+		location.hash = '#compose';
+	};
+	$('message').classList.remove('hidden');
+	await loadInbox();
+}
+
+async function loadSent() {
+	const msgs = await request('GET', 'outbox');
+	msgs.reverse();
+	fill('sent-list', msgs.map((m) => row([m.to, m.subject, when(m.time), m.status,
+		button('Trash', async () => {
+			await request('DELETE', 'outbox/' + m.id);
+			await loadSent();
+		})])));
+	fill('work-list', msgs.filter((m) => m.status !== 'msgsent' && m.status !== 'ackreceived' && m.status !== 'broadcastsent')
+		.map((m) => row([m.to, m.subject, m.status])));
+	return msgs;
+}
+
+async function loadIdentities() {
+	const ids = await request('GET', 'identities');
+	fill('identity-list', ids.map((id) => row([id.label, id.address, id.stream,
+		button('Delete', async () => {
+			if (confirm('Delete identity ' + id.address + '? Its keys will be lost.')) {
+				await request('DELETE', 'identities/' + id.address);
+				await loadIdentities();
+			}
+		})])));
+
+	const from = $('compose-from');
+	from.replaceChildren(...ids.filter((id) => id.enabled).map((id) => {
+		const opt = document.createElement('option');
+		opt.value = id.address;
+		opt.textContent = id.label ? id.label + ' (' + id.address + ')' : id.address;
+		return opt;
+	}));
+}
+
+function entryLoader(path, listID) {
+	const load = async () => {
+		const entries = await request('GET', path);
+		fill(listID, entries.map((e) => row([e.label, e.address,
+			button('Remove', async () => {
+				await request('DELETE', path + '/' + e.address);
+				await load();
+			})])));
+		return entries;
+	};
+	return load;
+}
+
+const loadSubscriptions = entryLoader('subscriptions', 'subscription-list');
+const loadContactList = entryLoader('contacts', 'contact-list');
+
+async function loadContacts() {
+	const entries = await loadContactList();
+	$('compose-contacts').replaceChildren(...entries.map((e) => {
+		const opt = document.createElement('option');
+		opt.value = e.address;
+		opt.label = e.label;
+		return opt;
+	}));
+}
+
+async function loadNetwork() {
+	const peers = await request('GET', 'peers');
+	fill('peer-list', peers.map((p) => row([p.address, p.userAgent, (p.streams || []).join(', ')])));
+	const inv = await request('GET', 'inventory');
+	$('inventory').textContent = inv.objects + ' objects in inventory, ' + inv.peers + ' peers';
+}
+
+function duration(secs) {
+	secs = Math.round(secs);
+	if (secs < 60) {
+		return secs + 's';
+	}
+	const mins = Math.round(secs / 60);
+	if (mins < 60) {
+		return mins + 'm';
+	}
+	return Math.floor(mins / 60) + 'h ' + mins % 60 + 'm';
+}
+
+function powProgress(j) {
+	if (j.state === 'failed') {
+		return j.error;
+	} else if (j.state !== 'running') {
+		return '';
+	} else if (!j.eta) {
+		return 'started ' + when(j.started);
+	}
+	return Math.floor(j.progress * 100) + '%, about ' + duration(j.eta) + ' left';
+}
+
+async function loadPOW() {
+	const msgs = await loadSent();
+	const jobs = await request('GET', 'pow');
+	// jobs for messages refer to them by id
+	const subjects = new Map(msgs.map((m) => [m.id, m.subject]));
+	const queued = jobs.filter((j) => j.state === 'queued').length;
+	const running = jobs.filter((j) => j.state === 'running')
+		.map((j) => j.kind + ' (' + powProgress(j) + ')');
+	$('pow-summary').textContent = queued + ' jobs queued, ' +
+		(running.length ? 'working on ' + running.join(', ') : 'none running');
+	fill('pow-list', jobs.map((j) => row([j.kind, subjects.get(j.ref) || j.ref || '', j.priority, j.state, powProgress(j),
+		button('Cancel', async () => {
+			await request('DELETE', 'pow/' + j.id);
+			await loadPOW();
+		})])));
+}
+
+const loaders = {
+	inbox: loadInbox,
+	compose: async () => {
+		await loadIdentities();
+		await loadContacts();
+	},
+	sent: loadSent,
+	identities: loadIdentities,
+	subscriptions: loadSubscriptions,
+	contacts: loadContacts,
+	network: loadNetwork,
+	pow: loadPOW,
+};
+
+function currentView() {
+	const view = location.hash.slice(1);
+	return loaders[view] ? view : 'inbox';
+}
+
+function show() {
+	const view = currentView();
+	for (const s of document.querySelectorAll('.view')) {
+		s.classList.toggle('hidden', s.id !== 'view-' + view);
+	}
+	for (const a of document.querySelectorAll('nav a[data-view]')) {
+		a.classList.toggle('active', a.dataset.view === view);
+	}
+	showError(null);
+	loaders[view]().catch(showError);
+}
+
+// forms
+
+function formData(form) {
+	const data = {};
+	for (const el of form.elements) {
+		if (!el.name) {
+			continue;
+		}
+		data[el.name] = el.type === 'checkbox' ? el.checked : el.value;
+	}
+	return data;
+}
+
+function onSubmit(id, fn) {
+	$(id).addEventListener('submit', (ev) => {
+		ev.preventDefault();
+		fn(ev.target).catch(showError);
+	});
+}
+
+onSubmit('compose-form', async (form) => {
+	const data = formData(form);
+	const msg = {from: data.from, to: data.broadcast ? '' : data.to, subject: data.subject, body: data.body};
+	const m = await request('POST', 'outbox', msg);
+	$('compose-status').textContent = 'Queued (' + m.status + ')';
+	form.reset();
+});
+
+$('compose-broadcast').addEventListener('change', (ev) => {
+	$('compose-to').disabled = ev.target.checked;
+});
+
+onSubmit('identity-form', async (form) => {
+	await request('POST', 'identities', formData(form));
+	form.reset();
+	await loadIdentities();
+});
+
+onSubmit('subscription-form', async (form) => {
+	await request('POST', 'subscriptions', formData(form));
+	form.reset();
+	await loadSubscriptions();
+});
+
+onSubmit('contact-form', async (form) => {
+	await request('POST', 'contacts', formData(form));
+	form.reset();
+	await loadContacts();
+});
+
+// login and live updates
+
+function showLogin() {
+	if (events) {
+		events.close();
+		events = null;
+	}
+	$('app').classList.add('hidden');
+	$('login').classList.remove('hidden');
+}
+
+function showApp() {
+	$('login').classList.add('hidden');
+	$('app').classList.remove('hidden');
+	show();
+
+	events = new EventSource(api + 'events');
+	const refresh = () => {
+		loaders[currentView()]().catch(showError);
+		if (currentView() !== 'inbox') {
+			loadInbox().catch(showError);
+		}
+	};
+	events.addEventListener('new-message', refresh);
+	events.addEventListener('ack-received', refresh);
+	events.addEventListener('peer-connected', () => {
+		if (currentView() === 'network') {
+			loadNetwork().catch(showError);
+		}
+	});
+}
+
+onSubmit('login-form', async (form) => {
+	const resp = await fetch(api + 'login', {
+		method: 'POST',
+		headers: {'Content-Type': 'application/json'},
+		credentials: 'same-origin',
+		body: JSON.stringify(formData(form)),
+	});
+	if (!resp.ok) {
+		$('login-error').textContent = 'Login failed';
+		return;
+	}
+	$('login-error').textContent = '';
+	form.reset();
+	showApp();
+});
+
+$('logout').addEventListener('click', async (ev) => {
+	ev.preventDefault();
+	await fetch(api + 'logout', {method: 'POST', credentials: 'same-origin'});
+	showLogin();
+});
+
+window.addEventListener('hashchange', show);
+
+// the session check decides which screen to start on
+fetch(api + 'session', {credentials: 'same-origin'}).then((resp) => {
+	if (resp.ok) {
+		showApp();
+	} else {
+		showLogin();
+	}
+}, showLogin);
+
+// poll for state that has no events, like outgoing work progress
+setInterval(() => {
+	if (events && ['network', 'sent', 'pow'].includes(currentView())) {
+		loaders[currentView()]().catch(showError);
+	}
+}, 5000);
@@ -0,0 +1,214 @@
+package api
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// xmlValue is the decoded form of an XML-RPC <value> element.
+type xmlValue struct {
+	String *string    `xml:"string"`
+	Int    *string    `xml:"int"`
+	I4     *string    `xml:"i4"`
+	I8     *string    `xml:"i8"`
+	Bool   *string    `xml:"boolean"`
+	Double *string    `xml:"double"`
+	Base64 *string    `xml:"base64"`
+	Nil    *struct{}  `xml:"nil"`
+	Array  *xmlArray  `xml:"array"`
+	Struct *xmlStruct `xml:"struct"`
+	Text   string     `xml:",chardata"`
+}
+
+type xmlArray struct {
+	Values []xmlValue `xml:"data>value"`
+}
+
+type xmlStruct struct {
+	Members []struct {
+		Name  string   `xml:"name"`
+		Value xmlValue `xml:"value"`
+	} `xml:"member"`
+}
+
+type methodCall struct {
+	Name   string     `xml:"methodName"`
+	Params []xmlValue `xml:"params>param>value"`
+}
+
+// decodeCall parses an XML-RPC method call into the method name and its
+// parameters converted to Go values (string, int, bool, float64, []byte,
+// nil, []interface{} and map[string]interface{}).
+func decodeCall(r io.Reader) (method string, params []interface{}, err error) {
+	var call methodCall
+	if err := xml.NewDecoder(r).Decode(&call); err != nil {
+		return "", nil, fmt.Errorf("api: malformed xml-rpc request (%v)", err)
+	}
+
+	for _, v := range call.Params {
+		val, err := v.decode()
+		if err != nil {
+			return "", nil, err
+		}
+		params = append(params, val)
+	}
+	return strings.TrimSpace(call.Name), params, nil
+}
+
+func (v *xmlValue) decode() (interface{}, error) {
+	switch {
+	case v.String != nil:
+		return *v.String, nil
+	case v.Int != nil, v.I4 != nil, v.I8 != nil:
+		s := v.Int
+		if s == nil {
+			s = v.I4
+		}
+		if s == nil {
+			s = v.I8
+		}
+		i, err := strconv.Atoi(strings.TrimSpace(*s))
+		if err != nil {
+			return nil, fmt.Errorf("api: invalid xml-rpc int %q", *s)
+		}
+		return i, nil
+	case v.Bool != nil:
+		switch strings.TrimSpace(*v.Bool) {
+		case "1":
+			return true, nil
+		case "0":
+			return false, nil
+		}
+		return nil, fmt.Errorf("api: invalid xml-rpc boolean %q", *v.Bool)
+	case v.Double != nil:
+		f, err := strconv.ParseFloat(strings.TrimSpace(*v.Double), 64)
+		if err != nil {
+			return nil, fmt.Errorf("api: invalid xml-rpc double %q", *v.Double)
+		}
+		return f, nil
+	case v.Base64 != nil:
+		data, err := base64.StdEncoding.DecodeString(stripSpace(*v.Base64))
+		if err != nil {
+			return nil, fmt.Errorf("api: invalid xml-rpc base64 value (%v)", err)
+		}
+		return data, nil
+	case v.Nil != nil:
+		return nil, nil
+	case v.Array != nil:
+		vals := []interface{}{}
+		for _, elem := range v.Array.Values {
+			val, err := elem.decode()
+			if err != nil {
+				return nil, err
+			}
+			vals = append(vals, val)
+		}
+		return vals, nil
+	case v.Struct != nil:
+		m := map[string]interface{}{}
+		for _, member := range v.Struct.Members {
+			val, err := member.Value.decode()
+			if err != nil {
+				return nil, err
+			}
+			m[member.Name] = val
+		}
+		return m, nil
+	default:
+		// a value without a type element is a string
+		return v.Text, nil
+	}
+}
+
+// encodeResponse writes an XML-RPC method response containing val.
+func encodeResponse(w io.Writer, val interface{}) error {
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	buf.WriteString("<methodResponse><params><param>")
+	if err := encodeValue(&buf, val); err != nil {
+		return err
+	}
+	buf.WriteString("</param></params></methodResponse>\n")
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// encodeFault writes an XML-RPC fault response.
+func encodeFault(w io.Writer, code int, msg string) error {
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	buf.WriteString("<methodResponse><fault>")
+	encodeValue(&buf, map[string]interface{}{"faultCode": code, "faultString": msg})
+	buf.WriteString("</fault></methodResponse>\n")
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+func encodeValue(buf *bytes.Buffer, val interface{}) error {
+	buf.WriteString("<value>")
+	switch v := val.(type) {
+	case nil:
+		buf.WriteString("<nil/>")
+	case string:
+		buf.WriteString("<string>")
+		xml.EscapeText(buf, []byte(v))
+		buf.WriteString("</string>")
+	case int:
+		fmt.Fprintf(buf, "<int>%d</int>", v)
+	case bool:
+		if v {
+			buf.WriteString("<boolean>1</boolean>")
+		} else {
+			buf.WriteString("<boolean>0</boolean>")
+		}
+	case float64:
+		fmt.Fprintf(buf, "<double>%v</double>", v)
+	case []byte:
+		fmt.Fprintf(buf, "<base64>%v</base64>", base64.StdEncoding.EncodeToString(v))
+	case []interface{}:
+		buf.WriteString("<array><data>")
+		for _, elem := range v {
+			if err := encodeValue(buf, elem); err != nil {
+				return err
+			}
+		}
+		buf.WriteString("</data></array>")
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		buf.WriteString("<struct>")
+		for _, k := range keys {
+			buf.WriteString("<member><name>")
+			xml.EscapeText(buf, []byte(k))
+			buf.WriteString("</name>")
+			if err := encodeValue(buf, v[k]); err != nil {
+				return err
+			}
+			buf.WriteString("</member>")
+		}
+		buf.WriteString("</struct>")
+	default:
+		return fmt.Errorf("api: cannot encode %T as xml-rpc value", val)
+	}
+	buf.WriteString("</value>")
+	return nil
+}
+
+func stripSpace(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '\t', '\r', '\n':
+			return -1
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,656 @@
+// bmctl is a command line client for a running gobitmsgd node.
+//
+// It talks to the node's JSON API and prints human readable output, or the
+// raw JSON responses when given -json so it can be used from scripts.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const usage = `usage: bmctl [flags] <command> [args]
+
+commands:
+  identity new [-label L] [-short] [-stream N] [-trials N] [-extra N]
+                                      create a new identity, optionally asking
+                                      senders for more proof of work
+  identity list                       list identities
+  identity export <address>           print an identity with its private keys
+                                      as a keys.dat section
+  identity import [-label L] [file]   restore identities from keys.dat
+                                      sections (read from stdin without a
+                                      file); keys may be WIF or hex
+  send -from A [-to B] -subject S [-body B] [-ttl D]
+                                      send a message (body read from stdin if
+                                      -body isn't given; no -to broadcasts)
+  confirm <id>                        send a message whose recipient asks
+                                      for more proof of work than allowed
+  inbox list                          list inbox messages
+  inbox read <id>                     print a message and mark it read
+  inbox delete <id>                   move a message to the trash
+  subscribe [-label L] <address>      subscribe to a broadcast address
+  peers                               list connected peers
+  inv stats                           show inventory statistics
+  pow list                            list proof of work jobs, next to run first
+  pow priority <id> <n>               change a job's priority (higher runs first)
+  pow cancel <id>                     cancel a job
+  log [<subsystem> <level>]           show log levels or set one (subsystem
+                                      "default" sets the default level)
+
+flags:
+`
+
+func main() {
+	if err := run(os.Args[1:], os.Stdin, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, "bmctl:", err)
+		os.Exit(1)
+	}
+}
+
+// client makes authenticated requests against the node's JSON API.
+type client struct {
+	base     string
+	user     string
+	pass     string
+	jsonOut  bool
+	out      io.Writer
+	http     *http.Client
+	lastBody []byte
+}
+
+func run(args []string, stdin io.Reader, stdout io.Writer) error {
+	fs := flag.NewFlagSet("bmctl", flag.ContinueOnError)
+	api := fs.String("api", envDefault("BMCTL_API", "http://127.0.0.1:8442"), "base URL of the node API")
+	user := fs.String("user", os.Getenv("BMCTL_USER"), "API username")
+	pass := fs.String("pass", os.Getenv("BMCTL_PASS"), "API password")
+	jsonOut := fs.Bool("json", false, "print raw JSON responses")
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), usage)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	c := &client{
+		base:    strings.TrimRight(*api, "/") + "/api/v1/",
+		user:    *user,
+		pass:    *pass,
+		jsonOut: *jsonOut,
+		out:     stdout,
+		http:    &http.Client{Timeout: 30 * time.Second},
+	}
+
+	args = fs.Args()
+	if len(args) == 0 {
+		fs.Usage()
+		return errors.New("no command given")
+	}
+	cmd, args := args[0], args[1:]
+	switch cmd {
+	case "identity":
+		return c.identity(args, stdin)
+	case "send":
+		return c.send(args, stdin)
+	case "confirm":
+		return c.confirm(args)
+	case "inbox":
+		return c.inbox(args)
+	case "subscribe":
+		return c.subscribe(args)
+	case "peers":
+		return c.peers(args)
+	case "inv":
+		return c.inv(args)
+	case "pow":
+		return c.pow(args)
+	case "log":
+		return c.logLevels(args)
+	}
+	return fmt.Errorf("unknown command %q", cmd)
+}
+
+func envDefault(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// do sends a request with an optional JSON body and decodes the response
+// into v if it is non-nil.  Error responses are turned into errors using the
+// API's {"error": ...} body.
+func (c *client) do(method, path string, body, v interface{}) error {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, c.base+path, r)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.user != "" {
+		req.SetBasicAuth(c.user, c.pass)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	c.lastBody = data
+
+	if resp.StatusCode >= 300 {
+		var e struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(data, &e) == nil && e.Error != "" {
+			return fmt.Errorf("%v (%v)", e.Error, resp.Status)
+		}
+		return fmt.Errorf("request failed: %v", resp.Status)
+	}
+	if v == nil || len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, v)
+}
+
+// printJSON writes the body of the last response if -json was given and
+// reports whether it did so.
+func (c *client) printJSON() bool {
+	if !c.jsonOut {
+		return false
+	}
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, c.lastBody, "", "  "); err != nil {
+		c.out.Write(c.lastBody)
+	} else {
+		buf.WriteTo(c.out)
+	}
+	fmt.Fprintln(c.out)
+	return true
+}
+
+func (c *client) table() *tabwriter.Writer {
+	return tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+}
+
+type identity struct {
+	Label         string `json:"label"`
+	Address       string `json:"address"`
+	Stream        int    `json:"stream"`
+	Enabled       bool   `json:"enabled"`
+	SignKey       string `json:"signKey"`
+	EncryptKey    string `json:"encryptKey"`
+	SignKeyWIF    string `json:"signKeyWIF"`
+	EncryptKeyWIF string `json:"encryptKeyWIF"`
+}
+
+type message struct {
+	ID        string    `json:"id"`
+	To        string    `json:"to"`
+	From      string    `json:"from"`
+	Subject   string    `json:"subject"`
+	Body      string    `json:"body"`
+	Time      time.Time `json:"time"`
+	Read      bool      `json:"read"`
+	Broadcast bool      `json:"broadcast"`
+	Status    string    `json:"status"`
+}
+
+type peer struct {
+	Address   string `json:"address"`
+	UserAgent string `json:"userAgent"`
+	Streams   []int  `json:"streams"`
+	Traffic   struct {
+		In  struct{ Bytes uint64 } `json:"in"`
+		Out struct{ Bytes uint64 } `json:"out"`
+	} `json:"traffic"`
+}
+
+type powJob struct {
+	ID       string    `json:"id"`
+	Kind     string    `json:"kind"`
+	Priority int       `json:"priority"`
+	Created  time.Time `json:"created"`
+	State    string    `json:"state"`
+	Error    string    `json:"error"`
+}
+
+func subcommand(args []string, name string) (string, []string, error) {
+	if len(args) == 0 {
+		return "", nil, fmt.Errorf("%v: missing subcommand", name)
+	}
+	return args[0], args[1:], nil
+}
+
+func oneArg(args []string, what string) (string, error) {
+	if len(args) != 1 {
+		return "", fmt.Errorf("expected a single %v argument", what)
+	}
+	return args[0], nil
+}
+
+func (c *client) identity(args []string, stdin io.Reader) error {
+	sub, args, err := subcommand(args, "identity")
+	if err != nil {
+		return err
+	}
+
+	switch sub {
+	case "new":
+		fs := flag.NewFlagSet("identity new", flag.ContinueOnError)
+		label := fs.String("label", "", "label for the identity")
+		short := fs.Bool("short", false, "spend extra work to make a shorter address")
+		stream := fs.Int("stream", 0, "stream for the identity (0 for the node's first stream)")
+		trials := fs.Int("trials", 0, "proof of work trials per byte to ask senders for (0 for the network minimum)")
+		extra := fs.Int("extra", 0, "proof of work extra bytes to ask senders for (0 for the network minimum)")
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		var id identity
+		req := map[string]interface{}{"label": *label, "short": *short, "stream": *stream, "trialsPerByte": *trials, "extraBytes": *extra}
+		if err := c.do("POST", "identities", req, &id); err != nil {
+			return err
+		} else if !c.printJSON() {
+			fmt.Fprintln(c.out, id.Address)
+		}
+	case "list":
+		var ids []identity
+		if err := c.do("GET", "identities", nil, &ids); err != nil {
+			return err
+		} else if c.printJSON() {
+			return nil
+		}
+		tw := c.table()
+		fmt.Fprintln(tw, "ADDRESS\tSTREAM\tENABLED\tLABEL")
+		for _, id := range ids {
+			fmt.Fprintf(tw, "%v\t%v\t%v\t%v\n", id.Address, id.Stream, id.Enabled, id.Label)
+		}
+		return tw.Flush()
+	case "export":
+		addr, err := oneArg(args, "address")
+		if err != nil {
+			return err
+		}
+		var id identity
+		if err := c.do("GET", "identities/"+url.PathEscape(addr)+"/export", nil, &id); err != nil {
+			return err
+		} else if !c.printJSON() {
+			fmt.Fprintf(c.out, "[%v]\nlabel = %v\nenabled = %v\nprivsigningkey = %v\nprivencryptionkey = %v\n",
+				id.Address, id.Label, id.Enabled, id.SignKeyWIF, id.EncryptKeyWIF)
+		}
+	case "import":
+		fs := flag.NewFlagSet("identity import", flag.ContinueOnError)
+		label := fs.String("label", "", "label for identities without one")
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		r := stdin
+		if fs.NArg() > 1 {
+			return errors.New("identity import: expected at most one file")
+		} else if fs.NArg() == 1 {
+			f, err := os.Open(fs.Arg(0))
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			r = f
+		}
+		sections, err := parseKeys(r)
+		if err != nil {
+			return err
+		}
+		for _, sec := range sections {
+			if sec.Label == "" {
+				sec.Label = *label
+			}
+			req := map[string]string{"label": sec.Label, "address": sec.Address,
+				"signKey": sec.SignKey, "encryptKey": sec.EncryptKey}
+			var id identity
+			if err := c.do("POST", "identities", req, &id); err != nil {
+				return fmt.Errorf("importing %v: %v", sec.Address, err)
+			} else if !c.printJSON() {
+				fmt.Fprintln(c.out, id.Address)
+			}
+		}
+	default:
+		return fmt.Errorf("identity: unknown subcommand %q", sub)
+	}
+	return nil
+}
+
+// parseKeys reads the identity sections of a keys.dat file.  Sections
+// without private keys, like the settings section, are skipped.
+func parseKeys(r io.Reader) ([]*identity, error) {
+	var ids []*identity
+	var cur *identity
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		} else if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			cur = &identity{Address: strings.TrimSpace(line[1 : len(line)-1])}
+			ids = append(ids, cur)
+			continue
+		}
+		key, val, ok := strings.Cut(line, "=")
+		if !ok || cur == nil {
+			return nil, fmt.Errorf("malformed keys.dat line %q", line)
+		}
+		switch val = strings.TrimSpace(val); strings.TrimSpace(key) {
+		case "label":
+			cur.Label = val
+		case "privsigningkey":
+			cur.SignKey = val
+		case "privencryptionkey":
+			cur.EncryptKey = val
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	var found []*identity
+	for _, id := range ids {
+		if id.SignKey != "" && id.EncryptKey != "" {
+			found = append(found, id)
+		}
+	}
+	if len(found) == 0 {
+		return nil, errors.New("no identities with private keys found")
+	}
+	return found, nil
+}
+
+func (c *client) send(args []string, stdin io.Reader) error {
+	fs := flag.NewFlagSet("send", flag.ContinueOnError)
+	from := fs.String("from", "", "identity address to send from")
+	to := fs.String("to", "", "recipient address (omit to broadcast)")
+	subject := fs.String("subject", "", "message subject")
+	body := fs.String("body", "", "message body (read from stdin if not given)")
+	ttl := fs.Duration("ttl", 0, "how long the message should live on the network")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *from == "" {
+		return errors.New("send: -from is required")
+	}
+
+	text := *body
+	if text == "" {
+		data, err := io.ReadAll(stdin)
+		if err != nil {
+			return err
+		}
+		text = string(data)
+	}
+
+	req := map[string]interface{}{
+		"from":    *from,
+		"to":      *to,
+		"subject": *subject,
+		"body":    text,
+		"ttl":     int(ttl.Seconds()),
+	}
+	var m message
+	if err := c.do("POST", "outbox", req, &m); err != nil {
+		return err
+	} else if !c.printJSON() {
+		fmt.Fprintf(c.out, "%v %v\n", m.ID, m.Status)
+	}
+	return nil
+}
+
+func (c *client) confirm(args []string) error {
+	id, err := oneArg(args, "message id")
+	if err != nil {
+		return err
+	}
+	var m message
+	if err := c.do("POST", "outbox/"+url.PathEscape(id)+"/confirm", nil, &m); err != nil {
+		return err
+	} else if !c.printJSON() {
+		fmt.Fprintf(c.out, "%v %v\n", m.ID, m.Status)
+	}
+	return nil
+}
+
+func (c *client) inbox(args []string) error {
+	sub, args, err := subcommand(args, "inbox")
+	if err != nil {
+		return err
+	}
+
+	switch sub {
+	case "list":
+		var msgs []message
+		if err := c.do("GET", "inbox", nil, &msgs); err != nil {
+			return err
+		} else if c.printJSON() {
+			return nil
+		}
+		tw := c.table()
+		fmt.Fprintln(tw, "ID\tTIME\tFROM\tSUBJECT")
+		for _, m := range msgs {
+			mark := ""
+			if !m.Read {
+				mark = "*"
+			}
+			fmt.Fprintf(tw, "%v%v\t%v\t%v\t%v\n", mark, m.ID, m.Time.Local().Format(time.DateTime), m.From, m.Subject)
+		}
+		return tw.Flush()
+	case "read":
+		id, err := oneArg(args, "message id")
+		if err != nil {
+			return err
+		}
+		var m message
+		if err := c.do("GET", "inbox/"+url.PathEscape(id), nil, &m); err != nil {
+			return err
+		} else if !c.printJSON() {
+			fmt.Fprintf(c.out, "From: %v\nTo: %v\nDate: %v\nSubject: %v\n\n%v\n",
+				m.From, m.To, m.Time.Local().Format(time.RFC1123Z), m.Subject, m.Body)
+		}
+	case "delete":
+		id, err := oneArg(args, "message id")
+		if err != nil {
+			return err
+		}
+		return c.do("DELETE", "inbox/"+url.PathEscape(id), nil, nil)
+	default:
+		return fmt.Errorf("inbox: unknown subcommand %q", sub)
+	}
+	return nil
+}
+
+func (c *client) subscribe(args []string) error {
+	fs := flag.NewFlagSet("subscribe", flag.ContinueOnError)
+	label := fs.String("label", "", "label for the subscription")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	addr, err := oneArg(fs.Args(), "address")
+	if err != nil {
+		return err
+	}
+
+	req := map[string]string{"label": *label, "address": addr}
+	if err := c.do("POST", "subscriptions", req, nil); err != nil {
+		return err
+	}
+	c.printJSON()
+	return nil
+}
+
+func (c *client) peers(args []string) error {
+	var ps []peer
+	if err := c.do("GET", "peers", nil, &ps); err != nil {
+		return err
+	} else if c.printJSON() {
+		return nil
+	}
+	tw := c.table()
+	fmt.Fprintln(tw, "ADDRESS\tSTREAMS\tIN\tOUT\tUSER AGENT")
+	for _, p := range ps {
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\n", p.Address, strings.Trim(fmt.Sprint(p.Streams), "[]"),
+			p.Traffic.In.Bytes, p.Traffic.Out.Bytes, p.UserAgent)
+	}
+	return tw.Flush()
+}
+
+func (c *client) inv(args []string) error {
+	if len(args) != 1 || args[0] != "stats" {
+		return errors.New("inv: expected 'inv stats'")
+	}
+	type counts struct {
+		Objects int `json:"objects"`
+		Peers   int `json:"peers"`
+	}
+	var stats counts
+	if err := c.do("GET", "inventory", nil, &stats); err != nil {
+		return err
+	} else if c.printJSON() {
+		return nil
+	}
+	var byStream map[int]counts
+	if err := c.do("GET", "inventory/streams", nil, &byStream); err != nil {
+		return err
+	}
+	var sync struct {
+		Wanted   int `json:"wanted"`
+		InFlight int `json:"inFlight"`
+		Fetched  int `json:"fetched"`
+	}
+	if err := c.do("GET", "inventory/sync", nil, &sync); err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "objects: %v\npeers:   %v\n", stats.Objects, stats.Peers)
+	if sync.Wanted > 0 {
+		fmt.Fprintf(c.out, "syncing: %v objects wanted, %v in flight, %v fetched\n", sync.Wanted, sync.InFlight, sync.Fetched)
+	}
+	if len(byStream) == 0 {
+		return nil
+	}
+
+	var streams []int
+	for s := range byStream {
+		streams = append(streams, s)
+	}
+	sort.Ints(streams)
+	fmt.Fprintln(c.out)
+	tw := c.table()
+	fmt.Fprintln(tw, "STREAM\tOBJECTS\tPEERS")
+	for _, s := range streams {
+		fmt.Fprintf(tw, "%v\t%v\t%v\n", s, byStream[s].Objects, byStream[s].Peers)
+	}
+	return tw.Flush()
+}
+
+func (c *client) pow(args []string) error {
+	sub, args, err := subcommand(args, "pow")
+	if err != nil {
+		return err
+	}
+
+	var jobs []powJob
+	switch sub {
+	case "list":
+		if err := c.do("GET", "pow", nil, &jobs); err != nil {
+			return err
+		}
+	case "priority":
+		if len(args) != 2 {
+			return errors.New("pow: expected a job id and priority")
+		}
+		priority, err := strconv.Atoi(args[1])
+		if err != nil {
+			return fmt.Errorf("pow: invalid priority %q", args[1])
+		}
+		req := map[string]int{"priority": priority}
+		if err := c.do("PUT", "pow/"+url.PathEscape(args[0]), req, &jobs); err != nil {
+			return err
+		}
+	case "cancel":
+		id, err := oneArg(args, "job id")
+		if err != nil {
+			return err
+		}
+		return c.do("DELETE", "pow/"+url.PathEscape(id), nil, nil)
+	default:
+		return fmt.Errorf("pow: unknown subcommand %q", sub)
+	}
+	if c.printJSON() {
+		return nil
+	}
+
+	tw := c.table()
+	fmt.Fprintln(tw, "ID\tKIND\tPRIORITY\tSTATE\tQUEUED")
+	for _, j := range jobs {
+		state := j.State
+		if j.Error != "" {
+			state += ": " + j.Error
+		}
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\n", j.ID, j.Kind, j.Priority, state, j.Created.Local().Format(time.DateTime))
+	}
+	return tw.Flush()
+}
+
+func (c *client) logLevels(args []string) error {
+	var levels map[string]string
+	switch len(args) {
+	case 0:
+		if err := c.do("GET", "loglevels", nil, &levels); err != nil {
+			return err
+		}
+	case 2:
+		req := map[string]string{"level": args[1]}
+		if err := c.do("PUT", "loglevels/"+url.PathEscape(args[0]), req, &levels); err != nil {
+			return err
+		}
+	default:
+		return errors.New("log: expected no arguments or a subsystem and level")
+	}
+	if c.printJSON() {
+		return nil
+	}
+
+	names := make([]string, 0, len(levels))
+	for sys := range levels {
+		names = append(names, sys)
+	}
+	sort.Strings(names)
+	tw := c.table()
+	fmt.Fprintln(tw, "SUBSYSTEM\tLEVEL")
+	for _, sys := range names {
+		fmt.Fprintf(tw, "%v\t%v\n", sys, levels[sys])
+	}
+	return tw.Flush()
+}
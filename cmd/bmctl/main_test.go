@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rwcarlsen/gobitmsg/api"
+	"github.com/rwcarlsen/gobitmsg/logging"
+	"github.com/rwcarlsen/gobitmsg/msg"
+	"github.com/rwcarlsen/gobitmsg/payload"
+	"github.com/rwcarlsen/gobitmsg/pow"
+	"github.com/rwcarlsen/gobitmsg/store"
+)
+
+func TestCommands(t *testing.T) {
+	st, err := store.Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := api.NewServer(st, nil, "user", "pass", logging.Discard())
+	srv.Levels = logging.NewText(io.Discard, slog.LevelInfo)
+	if srv.POW, err = pow.OpenQueue("", pow.Local{}, payload.DecodePOWObject); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	bmctl := func(stdin string, args ...string) string {
+		var out bytes.Buffer
+		args = append([]string{"-api", ts.URL, "-user", "user", "-pass", "pass"}, args...)
+		if err := run(args, strings.NewReader(stdin), &out); err != nil {
+			t.Fatalf("bmctl %v: %v", strings.Join(args[6:], " "), err)
+		}
+		return out.String()
+	}
+
+	addr := strings.TrimSpace(bmctl("", "identity", "new", "-label", "me"))
+	if !strings.HasPrefix(addr, "BM-") {
+		t.Fatalf("expected a new address, got %q", addr)
+	}
+	if out := bmctl("", "identity", "list"); !strings.Contains(out, addr) {
+		t.Errorf("identity list is missing %v:\n%v", addr, out)
+	}
+
+	var exp struct {
+		Address string `json:"address"`
+		SignKey string `json:"signKey"`
+	}
+	if err := json.Unmarshal([]byte(bmctl("", "-json", "identity", "export", addr)), &exp); err != nil {
+		t.Fatal(err)
+	} else if exp.Address != addr || len(exp.SignKey) != 64 {
+		t.Errorf("bad export: %+v", exp)
+	}
+
+	keys := bmctl("", "identity", "export", addr)
+	if !strings.Contains(keys, "privsigningkey = 5") {
+		t.Errorf("export isn't a keys.dat section with WIF keys:\n%v", keys)
+	}
+	if err := st.DeleteIdentity(addr); err != nil {
+		t.Fatal(err)
+	}
+	keys = "[bitmessagesettings]\nport = 8444\n\n" + keys
+	if out := bmctl(keys, "identity", "import"); strings.TrimSpace(out) != addr {
+		t.Errorf("expected %v to be imported, got %q", addr, out)
+	} else if id, err := st.Identity(addr); err != nil || id.Label != "me" {
+		t.Errorf("identity not restored (%v)", err)
+	}
+
+	bmctl("hello there", "send", "-from", addr, "-to", addr, "-subject", "hi")
+	if msgs := st.Messages(store.Sent); len(msgs) != 1 || msgs[0].Body != "hello there" {
+		t.Errorf("expected one sent message with the stdin body, got %+v", msgs)
+	}
+
+	bmctl("", "subscribe", "-label", "news", addr)
+	if subs := st.Subscriptions(); len(subs) != 1 || subs[0].Label != "news" {
+		t.Errorf("subscription not added: %+v", subs)
+	}
+
+	if out := bmctl("", "inv", "stats"); !strings.Contains(out, "objects: 0") {
+		t.Errorf("unexpected inv stats output:\n%v", out)
+	}
+
+	obj := &payload.Message{Time: time.Now(), Stream: 1, Data: []byte("hi")}
+	job := &pow.Job{Kind: pow.KindMsg, Cmd: string(msg.Cmsg), Object: obj, TrialsPerByte: 1}
+	if err := srv.POW.Add(job); err != nil {
+		t.Fatal(err)
+	}
+	if out := bmctl("", "pow", "priority", job.ID, "5"); !strings.Contains(out, job.ID) {
+		t.Errorf("pow priority output is missing %v:\n%v", job.ID, out)
+	}
+	bmctl("", "pow", "cancel", job.ID)
+	for _, j := range srv.POW.Jobs() {
+		if j.ID == job.ID {
+			t.Errorf("job not cancelled: %+v", j)
+		}
+	}
+
+	bmctl("", "log", "p2p", "debug")
+	if out := bmctl("", "log"); !strings.Contains(out, "p2p        debug") {
+		t.Errorf("unexpected log levels output:\n%v", out)
+	}
+
+	var out bytes.Buffer
+	err = run([]string{"-api", ts.URL, "-user", "user", "-pass", "wrong", "peers"}, nil, &out)
+	if err == nil {
+		t.Error("expected an error with bad credentials")
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// loadConfig reads an INI style config file of "key = value" lines and
+// applies each value to the flag of the same name unless that flag was
+// given on the command line.  Blank lines, lines starting with '#' or ';'
+// and [section] headers are ignored.
+func loadConfig(fs *flag.FlagSet, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+
+	scan := bufio.NewScanner(f)
+	for lineno := 1; scan.Scan(); lineno++ {
+		line := strings.TrimSpace(scan.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' || line[0] == '[' {
+			continue
+		}
+
+		key, val, ok := strings.Cut(line, "=")
+		if !ok {
+			return fmt.Errorf("%v:%v: expected 'key = value'", path, lineno)
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		val = strings.Trim(strings.TrimSpace(val), `"`)
+
+		if fs.Lookup(key) == nil {
+			return fmt.Errorf("%v:%v: unknown option %q", path, lineno, key)
+		} else if set[key] {
+			continue
+		} else if err := fs.Set(key, val); err != nil {
+			return fmt.Errorf("%v:%v: bad value for %v (%v)", path, lineno, key, err)
+		}
+	}
+	return scan.Err()
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gobitmsgd.conf")
+	conf := `
+# comment
+[node]
+listen = 0.0.0.0:9000
+peers = "1.2.3.4:8444, 5.6.7.8:8444"
+proxydns = false
+apiuser = alice
+`
+	if err := os.WriteFile(path, []byte(conf), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	listen := fs.String("listen", "", "")
+	peers := fs.String("peers", "", "")
+	proxyDNS := fs.Bool("proxydns", true, "")
+	apiUser := fs.String("apiuser", "", "")
+	fs.Parse([]string{"-apiuser", "bob"})
+
+	if err := loadConfig(fs, path); err != nil {
+		t.Fatal(err)
+	}
+	if *listen != "0.0.0.0:9000" {
+		t.Errorf("listen: expected 0.0.0.0:9000, got %v", *listen)
+	}
+	if got := splitList(*peers); len(got) != 2 || got[1] != "5.6.7.8:8444" {
+		t.Errorf("peers: unexpected value %q", *peers)
+	}
+	if *proxyDNS {
+		t.Error("proxydns: expected false")
+	}
+	if *apiUser != "bob" {
+		t.Errorf("apiuser: command line flag should win over config, got %v", *apiUser)
+	}
+
+	if err := os.WriteFile(path, []byte("bogus = 1\n"), 0600); err != nil {
+		t.Fatal(err)
+	} else if err := loadConfig(fs, path); err == nil {
+		t.Error("expected error for unknown option")
+	}
+}
@@ -0,0 +1,332 @@
+// gobitmsgd runs a bitmessage node along with its HTTP API.
+//
+// Options may be given as flags or in a config file of "key = value" lines
+// using the flag names as keys.  Flags override the config file.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rwcarlsen/gobitmsg/api"
+	"github.com/rwcarlsen/gobitmsg/logging"
+	"github.com/rwcarlsen/gobitmsg/metrics"
+	"github.com/rwcarlsen/gobitmsg/msg"
+	"github.com/rwcarlsen/gobitmsg/p2p"
+	"github.com/rwcarlsen/gobitmsg/payload"
+	"github.com/rwcarlsen/gobitmsg/pow"
+	"github.com/rwcarlsen/gobitmsg/store"
+)
+
+const shutdownTimeout = 10 * time.Second
+
+var (
+	fs         = flag.NewFlagSet("gobitmsgd", flag.ExitOnError)
+	config     = fs.String("config", "", "config file (default <datadir>/gobitmsgd.conf if it exists)")
+	listen     = fs.String("listen", "127.0.0.1:8444", "ip:port to listen for peers on")
+	datadir    = fs.String("datadir", defaultDataDir(), "directory to keep node data in")
+	peers      = fs.String("peers", "", "comma separated host:port list of peers to bootstrap from")
+	seeds      = fs.Bool("seeds", true, "fall back to the built-in seed list and DNS seeds when bootstrapping")
+	minPeers   = fs.Int("minpeers", 8, "number of outbound peers to keep, bootstrapping again when short")
+	streams    = fs.String("streams", "1", "comma separated list of streams to join")
+	proxy      = fs.String("proxy", "", "host:port of a SOCKS5 proxy (e.g. Tor) for outbound connections")
+	proxyUser  = fs.String("proxyuser", "", "SOCKS5 proxy username")
+	proxyPass  = fs.String("proxypass", "", "SOCKS5 proxy password")
+	proxyDNS   = fs.Bool("proxydns", true, "resolve host names through the proxy")
+	noClearnet = fs.Bool("noclearnet", false, "refuse outbound connections that don't go through the proxy")
+	hsTimeout  = fs.Duration("handshaketimeout", 10*time.Second, "time allowed for a peer version handshake")
+	rdTimeout  = fs.Duration("readtimeout", time.Minute, "time allowed to receive or send a single message")
+	idle       = fs.Duration("idletimeout", 10*time.Minute, "drop peers that send nothing for this long (pinged after half of it)")
+	banScore   = fs.Int("banthreshold", 100, "misbehavior score at which a peer is banned")
+	banTime    = fs.Duration("banduration", 24*time.Hour, "how long misbehaving peers are banned for")
+	upLimit    = fs.Int("uplimit", 0, "total object upload limit in KB/s (0 for none)")
+	downLimit  = fs.Int("downlimit", 0, "total object download limit in KB/s (0 for none)")
+	peerUp     = fs.Int("peeruplimit", 0, "per peer object upload limit in KB/s (0 for none)")
+	peerDown   = fs.Int("peerdownlimit", 0, "per peer object download limit in KB/s (0 for none)")
+	grace      = fs.Duration("expirygrace", 3*time.Hour, "how long to keep objects past the end of their lifetime")
+	apiListen  = fs.String("api", "127.0.0.1:8442", "ip:port to serve the API on (empty to disable)")
+	apiUser    = fs.String("apiuser", "", "API username")
+	apiPass    = fs.String("apipass", "", "API password")
+	powWorker  = fs.String("powworker", "", "ip:port of a powworker to do proof of work on (empty to do it in process)")
+	powCmd     = fs.String("powcmd", "", "command to run as a proof of work worker, speaking the worker protocol on its stdin and stdout")
+	powJobs    = fs.Int("powjobs", 1, "number of proof of work jobs to run at once")
+	maxTrials  = fs.Int("maxtrialsperbyte", 0, "most proof of work trials per byte to do for a recipient without confirmation (0 for no limit)")
+	maxExtra   = fs.Int("maxextrabytes", 0, "most proof of work extra bytes to do for a recipient without confirmation (0 for no limit)")
+	metricsAt  = fs.String("metrics", "", "ip:port to serve Prometheus metrics on at /metrics (empty to disable)")
+	logLevel   = fs.String("loglevel", "info", "log level (debug, info, warn or error), with optional per subsystem levels like \"info,p2p=debug\"")
+)
+
+func defaultDataDir() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ".gobitmsg"
+	}
+	return filepath.Join(home, ".gobitmsg")
+}
+
+func main() {
+	fs.Parse(os.Args[1:])
+
+	path := *config
+	if path == "" {
+		path = filepath.Join(*datadir, "gobitmsgd.conf")
+		if _, err := os.Stat(path); err != nil {
+			path = ""
+		}
+	}
+	if path != "" {
+		if err := loadConfig(fs, path); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	levels := logging.NewText(os.Stderr, slog.LevelInfo)
+	if err := levels.Parse(*logLevel); err != nil {
+		log.Fatal(err)
+	}
+	lg := levels.Logger("main")
+
+	if err := run(levels, lg); err != nil {
+		lg.Error(err.Error())
+		os.Exit(1)
+	}
+}
+
+func run(levels *logging.Levels, lg *slog.Logger) error {
+	if err := os.MkdirAll(*datadir, 0700); err != nil {
+		return err
+	}
+	st, err := store.Open(filepath.Join(*datadir, "store.json"))
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case *powWorker != "":
+		payload.Solver = &pow.Fallback{Primary: pow.NewTCPWorker(*powWorker), Log: lg}
+	case *powCmd != "":
+		args := strings.Fields(*powCmd)
+		if len(args) == 0 {
+			return errors.New("powcmd must name a command to run")
+		}
+		payload.Solver = &pow.Fallback{Primary: pow.NewCmdWorker(args[0], args[1:]...), Log: lg}
+	}
+
+	node, err := newNode(levels.Logger("p2p"))
+	if err != nil {
+		return err
+	}
+	powQueue, err := pow.OpenQueue(filepath.Join(*datadir, "powjobs.json"), payload.Solver, payload.DecodePOWObject)
+	if err != nil {
+		return err
+	}
+	powQueue.Workers = *powJobs
+	if node.Bans, err = p2p.LoadBanList(filepath.Join(*datadir, "bans.json")); err != nil {
+		return err
+	} else if err := node.OpenInventory(filepath.Join(*datadir, "objects.dat")); err != nil {
+		return err
+	}
+
+	// the server sends messages whether or not its API is served
+	srv := api.NewServer(st, node, *apiUser, *apiPass, levels.Logger("api"))
+	srv.Levels = levels
+	srv.MaxTrialsPerByte, srv.MaxExtraBytes = *maxTrials, *maxExtra
+	srv.POW = powQueue
+	powQueue.Done = srv.POWDone
+
+	var httpSrv *http.Server
+	if *apiListen != "" {
+		if *apiUser == "" {
+			lg.Warn("no apiuser configured - all API requests will be refused")
+		}
+		httpSrv = &http.Server{Addr: *apiListen, Handler: srv}
+		// event streams only end when their clients leave
+		httpSrv.RegisterOnShutdown(srv.Events.Close)
+		ln, err := net.Listen("tcp", *apiListen)
+		if err != nil {
+			return err
+		}
+		go func() {
+			if err := httpSrv.Serve(ln); err != nil && err != http.ErrServerClosed {
+				lg.Error("api server failed", "err", err)
+			}
+		}()
+		lg.Info("serving api", "addr", *apiListen)
+	}
+
+	var metricsSrv *http.Server
+	if *metricsAt != "" {
+		node.RegisterMetrics(metrics.Default)
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics.Default)
+		metricsSrv = &http.Server{Addr: *metricsAt, Handler: mux}
+		ln, err := net.Listen("tcp", *metricsAt)
+		if err != nil {
+			return err
+		}
+		go func() {
+			if err := metricsSrv.Serve(ln); err != nil && err != http.ErrServerClosed {
+				lg.Error("metrics server failed", "err", err)
+			}
+		}()
+		lg.Info("serving metrics", "addr", *metricsAt)
+	}
+
+	addObject := func(m *msg.Msg) {
+		if err := node.AddObject(m); err != nil {
+			lg.Debug("object not added", "cmd", m.Cmd(), "err", err)
+			return
+		}
+		srv.ObjectReceived(m)
+	}
+	syncer := p2p.NewSyncer(node, addObject)
+	node.OnInv = syncer.Advertised
+	srv.Sync = syncer
+
+	node.OnPeer = func(p *p2p.Peer) {
+		lg.Info("connected", "peer", p.Addr, "agent", p.Ver.UserAgent)
+		srv.PeerConnected(p)
+	}
+	if err := node.Start(); err != nil {
+		return err
+	}
+	lg.Info("listening for peers", "addr", node.Addr)
+
+	go func() {
+		for m := range node.ObjectsIn {
+			addObject(m)
+		}
+	}()
+
+	peersFile := filepath.Join(*datadir, "peers.txt")
+	known, err := p2p.LoadPeers(peersFile)
+	if err != nil {
+		lg.Error("failed to load saved peers", "err", err)
+	}
+	boot := &p2p.Bootstrap{
+		Known: append(splitList(*peers), known...),
+		Want:  *minPeers,
+	}
+	if *seeds {
+		boot.Seeds = p2p.DefaultSeeds
+		boot.DNSSeeds = p2p.DefaultDNSSeeds
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	var wg sync.WaitGroup
+	for _, f := range []func(){
+		func() { syncer.Run(ctx) },
+		func() { powQueue.Run(ctx) },
+		func() { node.KeepPeers(ctx, boot) },
+	} {
+		f := f
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f()
+		}()
+	}
+	<-ctx.Done()
+	lg.Info("shutting down")
+
+	if httpSrv != nil {
+		httpCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		err := httpSrv.Shutdown(httpCtx)
+		cancel()
+		if err != nil {
+			lg.Error("api server shutdown failed", "err", err)
+		}
+	}
+	if metricsSrv != nil {
+		metricsSrv.Close()
+	}
+	// finished jobs are published, so the queue stops before the node
+	wg.Wait()
+	if err := p2p.SavePeers(peersFile, node.KnownAddrs()); err != nil {
+		lg.Error("failed to save peers", "err", err)
+	}
+	nodeCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := node.Stop(nodeCtx); err != nil {
+		lg.Error("node shutdown failed", "err", err)
+	}
+	return st.Save()
+}
+
+func newNode(lg *slog.Logger) (*p2p.Node, error) {
+	host, portStr, err := net.SplitHostPort(*listen)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid listen port %q", portStr)
+	}
+
+	var strms []int
+	for _, s := range splitList(*streams) {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid stream %q", s)
+		}
+		strms = append(strms, n)
+	}
+	if len(strms) == 0 {
+		return nil, errors.New("at least one stream is required")
+	}
+
+	node := p2p.NewNode(host, port, lg)
+	node.MyVer.Streams = strms
+	node.MyVer.FromAddr.Stream = strms[0]
+	node.NoClearnet = *noClearnet
+	node.HandshakeTimeout = *hsTimeout
+	node.ReadTimeout = *rdTimeout
+	node.WriteTimeout = *rdTimeout
+	node.IdleTimeout = *idle
+	node.BanThreshold = *banScore
+	node.BanDuration = *banTime
+	node.UploadLimit = *upLimit * 1024
+	node.DownloadLimit = *downLimit * 1024
+	node.PeerUploadLimit = *peerUp * 1024
+	node.PeerDownloadLimit = *peerDown * 1024
+	node.ExpiryGrace = *grace
+	if *proxy != "" {
+		node.Dialer = &p2p.SOCKS5{
+			Addr:      *proxy,
+			Username:  *proxyUser,
+			Password:  *proxyPass,
+			RemoteDNS: *proxyDNS,
+		}
+	} else if *noClearnet {
+		return nil, errors.New("noclearnet requires a proxy")
+	}
+	if *noClearnet && !*proxyDNS {
+		return nil, errors.New("noclearnet requires proxydns")
+	}
+	return node, nil
+}
+
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
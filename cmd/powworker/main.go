@@ -0,0 +1,34 @@
+// powworker does proof of work for gobitmsgd nodes started with -powworker
+// or -powcmd.
+//
+// With -listen it serves nodes connecting over TCP, otherwise it serves a
+// single node on its standard input and output.
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+	"os"
+
+	"github.com/rwcarlsen/gobitmsg/pow"
+)
+
+var listen = flag.String("listen", "", "ip:port to serve nodes on (empty to serve standard input and output)")
+
+func main() {
+	flag.Parse()
+	if *listen == "" {
+		if err := pow.Serve(os.Stdin, os.Stdout, pow.Local{}); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	ln, err := net.Listen("tcp", *listen)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("serving proof of work on %v", ln.Addr())
+	log.Fatal(pow.ServeListener(ln, pow.Local{}))
+}
@@ -0,0 +1,174 @@
+// Package logging provides slog loggers for the node's subsystems whose
+// levels can be changed while the node runs.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Levels hands out a logger per subsystem, each filtered by its own level.
+// Subsystems without a level of their own use the default level.
+type Levels struct {
+	h   slog.Handler
+	def slog.LevelVar
+
+	mu     sync.Mutex
+	levels map[string]*slog.LevelVar
+	set    map[string]bool
+}
+
+// New returns Levels writing records to h, which should accept every level,
+// with def as the default level.
+func New(h slog.Handler, def slog.Level) *Levels {
+	l := &Levels{h: h, levels: map[string]*slog.LevelVar{}, set: map[string]bool{}}
+	l.def.Set(def)
+	return l
+}
+
+// NewText returns Levels writing text records to w.
+func NewText(w io.Writer, def slog.Level) *Levels {
+	return New(slog.NewTextHandler(w, &slog.HandlerOptions{Level: slog.LevelDebug}), def)
+}
+
+// Discard returns a logger that drops everything.
+func Discard() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{Level: slog.LevelError + 1}))
+}
+
+func (l *Levels) levelVar(subsystem string) *slog.LevelVar {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	lv, ok := l.levels[subsystem]
+	if !ok {
+		lv = new(slog.LevelVar)
+		lv.Set(l.def.Level())
+		l.levels[subsystem] = lv
+	}
+	return lv
+}
+
+// Logger returns the logger for subsystem.  Its records carry the subsystem
+// in a "sys" attribute.
+func (l *Levels) Logger(subsystem string) *slog.Logger {
+	h := &handler{h: l.h.WithAttrs([]slog.Attr{slog.String("sys", subsystem)}), lv: l.levelVar(subsystem)}
+	return slog.New(h)
+}
+
+// SetLevel sets the level of subsystem, or the default level and that of
+// every subsystem without its own level if subsystem is empty.
+func (l *Levels) SetLevel(subsystem string, level slog.Level) {
+	if subsystem != "" {
+		l.levelVar(subsystem).Set(level)
+		l.mu.Lock()
+		l.set[subsystem] = true
+		l.mu.Unlock()
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.def.Set(level)
+	for sys, lv := range l.levels {
+		if !l.set[sys] {
+			lv.Set(level)
+		}
+	}
+}
+
+// Levels returns the level of each subsystem, with the default level under
+// the empty name.
+func (l *Levels) Levels() map[string]slog.Level {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	levels := map[string]slog.Level{"": l.def.Level()}
+	for sys, lv := range l.levels {
+		levels[sys] = lv.Level()
+	}
+	return levels
+}
+
+// Parse applies a level spec like "info,p2p=debug,api=error": a bare level
+// sets the default and sys=level pairs set single subsystems.
+func (l *Levels) Parse(spec string) error {
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		sys, name, ok := strings.Cut(item, "=")
+		if !ok {
+			sys, name = "", item
+		}
+		level, err := ParseLevel(name)
+		if err != nil {
+			return err
+		}
+		l.SetLevel(strings.TrimSpace(sys), level)
+	}
+	return nil
+}
+
+// String formats the levels in the form accepted by Parse.
+func (l *Levels) String() string {
+	levels := l.Levels()
+	items := []string{LevelName(levels[""])}
+	var names []string
+	for sys := range levels {
+		if sys != "" {
+			names = append(names, sys)
+		}
+	}
+	sort.Strings(names)
+	for _, sys := range names {
+		items = append(items, sys+"="+LevelName(levels[sys]))
+	}
+	return strings.Join(items, ",")
+}
+
+// ParseLevel parses debug, info, warn or error.
+func ParseLevel(s string) (slog.Level, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info":
+		return slog.LevelInfo, nil
+	case "warn":
+		return slog.LevelWarn, nil
+	case "error", "err":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("logging: unknown log level %q", s)
+}
+
+// LevelName returns the lower case name of level.
+func LevelName(level slog.Level) string {
+	return strings.ToLower(level.String())
+}
+
+// handler filters records by a level that can change at any time.
+type handler struct {
+	h  slog.Handler
+	lv *slog.LevelVar
+}
+
+func (h *handler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.lv.Level() && h.h.Enabled(ctx, level)
+}
+
+func (h *handler) Handle(ctx context.Context, r slog.Record) error {
+	return h.h.Handle(ctx, r)
+}
+
+func (h *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &handler{h.h.WithAttrs(attrs), h.lv}
+}
+
+func (h *handler) WithGroup(name string) slog.Handler {
+	return &handler{h.h.WithGroup(name), h.lv}
+}
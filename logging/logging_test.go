@@ -0,0 +1,44 @@
+package logging
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestLevels(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewText(&buf, slog.LevelInfo)
+	p2p := l.Logger("p2p")
+	api := l.Logger("api")
+
+	p2p.Debug("hidden")
+	p2p.Info("shown", "peer", "1.2.3.4:8444")
+	if out := buf.String(); strings.Contains(out, "hidden") {
+		t.Errorf("debug record logged at info level: %v", out)
+	} else if !strings.Contains(out, `msg=shown sys=p2p peer=1.2.3.4:8444`) {
+		t.Errorf("unexpected output %q", out)
+	}
+
+	buf.Reset()
+	if err := l.Parse("error,p2p=debug"); err != nil {
+		t.Fatal(err)
+	}
+	p2p.Debug("p2p debug")
+	api.Info("api info")
+	api.Error("api error")
+	out := buf.String()
+	if !strings.Contains(out, "p2p debug") || !strings.Contains(out, "api error") || strings.Contains(out, "api info") {
+		t.Errorf("levels not applied at runtime: %v", out)
+	}
+
+	// changing the default leaves subsystems with their own level alone
+	l.SetLevel("", slog.LevelWarn)
+	if got := l.String(); got != "warn,api=warn,p2p=debug" {
+		t.Errorf("got levels %q", got)
+	}
+	if err := l.Parse("p2p=loud"); err == nil {
+		t.Error("expected an error for an unknown level")
+	}
+}
@@ -0,0 +1,303 @@
+// Package metrics implements counters, gauges and histograms that are
+// exposed over HTTP in the Prometheus text format.
+//
+// Metrics are registered with a Registry, usually Default, and are safe for
+// concurrent use.  Methods on nil metrics do nothing.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Default is the registry the node's packages register their metrics with.
+var Default = NewRegistry()
+
+const (
+	kindCounter   = "counter"
+	kindGauge     = "gauge"
+	kindHistogram = "histogram"
+)
+
+// collector is a named family of metrics that can write its samples.
+type collector interface {
+	desc() (name, help, kind string)
+	collect(emit func(suffix string, labels []string, lvs []string, v float64))
+}
+
+// Registry holds a set of metrics.
+type Registry struct {
+	mu         sync.Mutex
+	collectors map[string]collector
+}
+
+func NewRegistry() *Registry {
+	return &Registry{collectors: map[string]collector{}}
+}
+
+func (r *Registry) register(c collector) {
+	name, _, _ := c.desc()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.collectors[name]; ok {
+		panic("metrics: duplicate metric " + name)
+	}
+	r.collectors[name] = c
+}
+
+// NewCounter registers a counter.  Label values are passed to its methods
+// in the order of labels.
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{newVec(name, help, kindCounter, labels)}
+	r.register(c)
+	return c
+}
+
+// NewGauge registers a gauge.
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{newVec(name, help, kindGauge, labels)}
+	r.register(g)
+	return g
+}
+
+// NewHistogram registers a histogram with the given bucket upper bounds.
+func (r *Registry) NewHistogram(name, help string, buckets ...float64) *Histogram {
+	sort.Float64s(buckets)
+	h := &Histogram{name: name, help: help, buckets: buckets, counts: make([]uint64, len(buckets))}
+	r.register(h)
+	return h
+}
+
+// NewCounterFunc registers a counter whose values are read from f at
+// collection time.  f calls emit once per label set.
+func (r *Registry) NewCounterFunc(name, help string, labels []string, f func(emit func(v float64, lvs ...string))) {
+	r.register(&funcCollector{name, help, kindCounter, labels, f})
+}
+
+// NewGaugeFunc is like NewCounterFunc for gauges.
+func (r *Registry) NewGaugeFunc(name, help string, labels []string, f func(emit func(v float64, lvs ...string))) {
+	r.register(&funcCollector{name, help, kindGauge, labels, f})
+}
+
+// WriteTo writes every metric in r to w in the Prometheus text format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	cs := make([]collector, 0, len(r.collectors))
+	for _, c := range r.collectors {
+		cs = append(cs, c)
+	}
+	r.mu.Unlock()
+	sort.Slice(cs, func(i, j int) bool {
+		a, _, _ := cs[i].desc()
+		b, _, _ := cs[j].desc()
+		return a < b
+	})
+
+	cw := &countWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	for _, c := range cs {
+		name, help, kind := c.desc()
+		fmt.Fprintf(bw, "# HELP %v %v\n", name, escapeHelp(help))
+		fmt.Fprintf(bw, "# TYPE %v %v\n", name, kind)
+
+		var lines []string
+		c.collect(func(suffix string, labels, lvs []string, v float64) {
+			lines = append(lines, name+suffix+formatLabels(labels, lvs)+" "+formatValue(v))
+		})
+		if kind != kindHistogram {
+			sort.Strings(lines)
+		}
+		for _, l := range lines {
+			bw.WriteString(l)
+			bw.WriteByte('\n')
+		}
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// ServeHTTP serves the registry's metrics.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteTo(w)
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+func formatLabels(labels, lvs []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	parts := make([]string, len(labels))
+	for i, l := range labels {
+		parts[i] = l + `="` + escapeLabel(lvs[i]) + `"`
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
+func escapeHelp(s string) string  { return helpEscaper.Replace(s) }
+
+// vec holds the values of a metric for each set of label values.
+type vec struct {
+	name, help, kind string
+	labels           []string
+
+	mu     sync.Mutex
+	values map[string]float64
+	lvs    map[string][]string
+}
+
+func newVec(name, help, kind string, labels []string) vec {
+	return vec{name: name, help: help, kind: kind, labels: labels,
+		values: map[string]float64{}, lvs: map[string][]string{}}
+}
+
+func (v *vec) desc() (string, string, string) { return v.name, v.help, v.kind }
+
+func (v *vec) update(lvs []string, f func(old float64) float64) {
+	if len(lvs) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %v takes %v label values, got %v", v.name, len(v.labels), len(lvs)))
+	}
+	key := strings.Join(lvs, "\xff")
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if _, ok := v.lvs[key]; !ok {
+		v.lvs[key] = append([]string(nil), lvs...)
+	}
+	v.values[key] = f(v.values[key])
+}
+
+func (v *vec) collect(emit func(string, []string, []string, float64)) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for key, val := range v.values {
+		emit("", v.labels, v.lvs[key], val)
+	}
+}
+
+// Counter is a value that only goes up.
+type Counter struct{ vec }
+
+// Inc adds one to the counter with the given label values.
+func (c *Counter) Inc(lvs ...string) { c.Add(1, lvs...) }
+
+// Add adds d, which must not be negative, to the counter.
+func (c *Counter) Add(d float64, lvs ...string) {
+	if c == nil {
+		return
+	} else if d < 0 {
+		panic("metrics: counter " + c.name + " decreased")
+	}
+	c.update(lvs, func(old float64) float64 { return old + d })
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct{ vec }
+
+// Set sets the gauge with the given label values to v.
+func (g *Gauge) Set(v float64, lvs ...string) {
+	if g == nil {
+		return
+	}
+	g.update(lvs, func(float64) float64 { return v })
+}
+
+// Add adds d to the gauge.
+func (g *Gauge) Add(d float64, lvs ...string) {
+	if g == nil {
+		return
+	}
+	g.update(lvs, func(old float64) float64 { return old + d })
+}
+
+// Histogram counts observations in buckets.
+type Histogram struct {
+	name, help string
+	buckets    []float64
+
+	mu     sync.Mutex
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func (h *Histogram) desc() (string, string, string) { return h.name, h.help, kindHistogram }
+
+// Observe adds v to the histogram.
+func (h *Histogram) Observe(v float64) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, ub := range h.buckets {
+		if v <= ub {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *Histogram) collect(emit func(string, []string, []string, float64)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	le := []string{"le"}
+	for i, ub := range h.buckets {
+		emit("_bucket", le, []string{formatValue(ub)}, float64(h.counts[i]))
+	}
+	emit("_bucket", le, []string{"+Inf"}, float64(h.count))
+	emit("_sum", nil, nil, h.sum)
+	emit("_count", nil, nil, float64(h.count))
+}
+
+type funcCollector struct {
+	name, help, kind string
+	labels           []string
+	f                func(emit func(v float64, lvs ...string))
+}
+
+func (fc *funcCollector) desc() (string, string, string) { return fc.name, fc.help, fc.kind }
+
+func (fc *funcCollector) collect(emit func(string, []string, []string, float64)) {
+	fc.f(func(v float64, lvs ...string) {
+		if len(lvs) != len(fc.labels) {
+			panic(fmt.Sprintf("metrics: %v takes %v label values, got %v", fc.name, len(fc.labels), len(lvs)))
+		}
+		emit("", fc.labels, lvs, v)
+	})
+}
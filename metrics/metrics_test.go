@@ -0,0 +1,83 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWriteTo(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("test_requests_total", "Requests handled.", "code", "method")
+	c.Inc("200", "GET")
+	c.Add(2, "200", "GET")
+	c.Inc("404", `P"O\ST`)
+	g := r.NewGauge("test_temperature", "Current\ntemperature.")
+	g.Set(21.5)
+	g.Add(-1)
+	h := r.NewHistogram("test_latency_seconds", "Request latency.", 1, 0.1)
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(3)
+	r.NewGaugeFunc("test_queue", "Queued items.", []string{"queue"}, func(emit func(float64, ...string)) {
+		emit(3, "b")
+		emit(1, "a")
+	})
+
+	var nilCounter *Counter
+	nilCounter.Inc()
+
+	var buf strings.Builder
+	if _, err := r.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP test_latency_seconds Request latency.
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{le="0.1"} 1
+test_latency_seconds_bucket{le="1"} 2
+test_latency_seconds_bucket{le="+Inf"} 3
+test_latency_seconds_sum 3.55
+test_latency_seconds_count 3
+# HELP test_queue Queued items.
+# TYPE test_queue gauge
+test_queue{queue="a"} 1
+test_queue{queue="b"} 3
+# HELP test_requests_total Requests handled.
+# TYPE test_requests_total counter
+test_requests_total{code="200",method="GET"} 3
+test_requests_total{code="404",method="P\"O\\ST"} 1
+# HELP test_temperature Current\ntemperature.
+# TYPE test_temperature gauge
+test_temperature 20.5
+`
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%v\nwant:\n%v", got, want)
+	}
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("unexpected content type %q", ct)
+	} else if rec.Body.String() != want {
+		t.Errorf("served metrics differ from WriteTo")
+	}
+}
+
+func TestMisuse(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounter("test_total", "Test.", "a")
+	for name, f := range map[string]func(){
+		"duplicate":    func() { r.NewGauge("test_total", "Again.") },
+		"label count":  func() { c.Inc() },
+		"negative add": func() { c.Add(-1, "x") },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%v: expected a panic", name)
+				}
+			}()
+			f()
+		}()
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"crypto"
 	_ "crypto/sha512"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 )
@@ -21,21 +22,36 @@ const (
 	Cverack            = "verack"
 	Caddr              = "addr"
 	Cinv               = "inv"
+	Cdinv              = "dinv" // inv of objects in the Dandelion++ stem phase
 	Cgetdata           = "getdata"
 	CgetpubKey         = "getpubkey"
 	Cpubkey            = "pubkey"
 	Cmsg               = "msg"
 	Cbroadcast         = "broadcast"
+	Cobject            = "object" // protocol v3 objects of any type
+	Cping              = "ping"
+	Cpong              = "pong"
 )
 
+// MaxPayloadLength is the largest payload Decode accepts.
+const MaxPayloadLength = 1600100
+
 var Order = binary.BigEndian
 
+// Errors returned for messages that violate the protocol.
+var (
+	ErrMagic     = errors.New("msg: message decode failed - invalid magic")
+	ErrChecksum  = errors.New("msg: message decode failed - bad checksum")
+	ErrTooLarge  = errors.New("msg: message decode failed - payload too large")
+	ErrWrongKind = errors.New("msg: decoded msg of wrong type")
+)
+
 func ReadKind(r io.Reader, cmd Command) (*Msg, error) {
 	m, err := Decode(r)
 	if err != nil {
 		return nil, err
 	} else if m.Cmd() != cmd {
-		return nil, fmt.Errorf("msg: decoded msg of wrong type (expected %v, got %v)", cmd, m.Cmd())
+		return nil, fmt.Errorf("%w (expected %v, got %v)", ErrWrongKind, cmd, m.Cmd())
 	}
 	return m, nil
 }
@@ -86,6 +102,12 @@ func Decode(r io.Reader) (*Msg, error) {
 	length := Order.Uint32(buf[16:20])
 	checksum := Order.Uint32(buf[20:24])
 
+	if magic != Magic {
+		return nil, fmt.Errorf("%w '%x'", ErrMagic, magic)
+	} else if length > MaxPayloadLength {
+		return nil, fmt.Errorf("%w (%v bytes)", ErrTooLarge, length)
+	}
+
 	data := make([]byte, length)
 	if _, err := io.ReadFull(r, data); err != nil {
 		return nil, err
@@ -100,11 +122,8 @@ func Decode(r io.Reader) (*Msg, error) {
 	}
 
 	if !m.validChecksum() {
-		return nil, fmt.Errorf("msg: message decode failed - bad checksum")
-	} else if m.magic != Magic {
-		return nil, fmt.Errorf("msg: message decode failed - invalid magic '%x'", m.magic)
+		return nil, ErrChecksum
 	}
-
 	return m, nil
 }
 
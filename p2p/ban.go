@@ -0,0 +1,260 @@
+package p2p
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rwcarlsen/gobitmsg/msg"
+	"github.com/rwcarlsen/gobitmsg/payload"
+)
+
+const (
+	defaultBanThreshold = 100
+	defaultBanDuration  = 24 * time.Hour
+	// scoreDecay is how often one misbehavior point is forgiven.
+	scoreDecay = time.Minute
+)
+
+// Misbehavior penalties.  A peer is banned once its score reaches the
+// node's BanThreshold.
+const (
+	PenaltyChecksum  = 10
+	PenaltyMalformed = 25
+	PenaltyPOW       = 50
+	PenaltyFlood     = 50
+)
+
+// Limits on the number of entries in a single addr or inv message.
+const (
+	maxAddrEntries = 1000
+	maxInvEntries  = 50000
+)
+
+// ErrBanned is returned when connecting to or from a banned address.
+var ErrBanned = errors.New("p2p: address is banned")
+
+// Ban is an entry in a BanList.
+type Ban struct {
+	IP     string    `json:"ip"`
+	Until  time.Time `json:"until"`
+	Reason string    `json:"reason"`
+}
+
+// BanList is a set of temporarily banned IP addresses, saved to a file
+// whenever it changes.  It is safe for concurrent use.
+type BanList struct {
+	path string
+	mu   sync.Mutex
+	bans map[string]*Ban
+}
+
+// LoadBanList reads the ban list saved at path.  A missing file gives an
+// empty list, and an empty path gives a list that is never saved.
+func LoadBanList(path string) (*BanList, error) {
+	bl := &BanList{path: path, bans: map[string]*Ban{}}
+	if path == "" {
+		return bl, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return bl, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var bans []*Ban
+	if err := json.Unmarshal(data, &bans); err != nil {
+		return nil, fmt.Errorf("p2p: bad ban list %v (%v)", path, err)
+	}
+	for _, b := range bans {
+		bl.bans[b.IP] = b
+	}
+	return bl, nil
+}
+
+// Ban bans ip for d.
+func (bl *BanList) Ban(ip string, d time.Duration, reason string) error {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	bl.bans[ip] = &Ban{IP: ip, Until: time.Now().Add(d), Reason: reason}
+	return bl.save()
+}
+
+// Unban lifts the ban on ip.  It returns false if ip wasn't banned.
+func (bl *BanList) Unban(ip string) (bool, error) {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	if _, ok := bl.bans[ip]; !ok {
+		return false, nil
+	}
+	delete(bl.bans, ip)
+	return true, bl.save()
+}
+
+// Banned reports whether ip is currently banned.
+func (bl *BanList) Banned(ip string) bool {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	b, ok := bl.bans[ip]
+	return ok && time.Now().Before(b.Until)
+}
+
+// List returns the current bans, soonest to expire first.
+func (bl *BanList) List() []Ban {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	bl.prune()
+	bans := make([]Ban, 0, len(bl.bans))
+	for _, b := range bl.bans {
+		bans = append(bans, *b)
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Until.Before(bans[j].Until) })
+	return bans
+}
+
+func (bl *BanList) prune() {
+	now := time.Now()
+	for ip, b := range bl.bans {
+		if now.After(b.Until) {
+			delete(bl.bans, ip)
+		}
+	}
+}
+
+func (bl *BanList) save() error {
+	if bl.path == "" {
+		return nil
+	}
+	bl.prune()
+	bans := make([]*Ban, 0, len(bl.bans))
+	for _, b := range bl.bans {
+		bans = append(bans, b)
+	}
+	data, err := json.MarshalIndent(bans, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp := bl.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, bl.path)
+}
+
+type score struct {
+	points int
+	at     time.Time
+}
+
+// misbehaving adds points to the misbehavior score of host and bans it once
+// the score reaches the node's threshold.  It reports whether host is now
+// banned.
+func (n *Node) misbehaving(host string, points int, reason string) bool {
+	n.mu.Lock()
+	s := n.scores[host]
+	now := time.Now()
+	s.points -= int(now.Sub(s.at) / scoreDecay)
+	if s.points < 0 {
+		s.points = 0
+	}
+	s.points += points
+	s.at = now
+	n.scores[host] = s
+	banned := s.points >= orDefaultInt(n.BanThreshold, defaultBanThreshold)
+	if banned {
+		delete(n.scores, host)
+	}
+	n.mu.Unlock()
+
+	n.Log.Info("peer misbehaved", "peer", host, "reason", reason, "score", s.points)
+	if !banned {
+		return false
+	}
+	n.Log.Warn("banning peer", "peer", host)
+	if err := n.Bans.Ban(host, orDefault(n.BanDuration, defaultBanDuration), reason); err != nil {
+		n.Log.Error("failed to save ban list", "err", err)
+	}
+	return true
+}
+
+func (n *Node) banned(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	return n.Bans.Banned(host)
+}
+
+// verifyObject checks that an object carries at least the node's minimum
+// proof of work and, if it is signed in the clear, a valid signature.  It
+// returns payload.ErrInsufficientPOW or payload.ErrBadSignature if not, or
+// the error decoding it.  Objects signed inside their encryption are
+// checked once decrypted.
+func (n *Node) verifyObject(m *msg.Msg) error {
+	o, err := payload.DecodeObject(m.Cmd(), m.Payload())
+	if err != nil {
+		return err
+	}
+	return o.Verify(n.TrialsPerByte, n.ExtraBytes)
+}
+
+func orDefaultInt(v, def int) int {
+	if v <= 0 {
+		return def
+	}
+	return v
+}
+
+// Misbehaving adds points to the peer's misbehavior score, closing the
+// session and banning the peer if it crosses the node's threshold.  The
+// node calls this for protocol violations; applications can call it for
+// objects they find invalid.
+func (p *Peer) Misbehaving(points int, reason string) {
+	if p.node.misbehaving(p.node.hostOf(p), points, reason) {
+		p.close(fmt.Errorf("%w (%v)", ErrBanned, reason))
+	}
+}
+
+// malformedError marks errors caused by a peer sending undecodable data.
+type malformedError struct{ error }
+
+func (e malformedError) Unwrap() error { return e.error }
+
+// penalty returns the misbehavior points err deserves, or 0 if it isn't
+// the peer's fault.
+func penalty(err error) int {
+	var me malformedError
+	switch {
+	case errors.Is(err, msg.ErrChecksum):
+		return PenaltyChecksum
+	case errors.Is(err, msg.ErrTooLarge):
+		return PenaltyFlood
+	case errors.Is(err, msg.ErrMagic), errors.Is(err, msg.ErrWrongKind), errors.As(err, &me):
+		return PenaltyMalformed
+	}
+	return 0
+}
+
+// Ban bans ip for d and closes any sessions with it.
+func (n *Node) Ban(ip string, d time.Duration, reason string) error {
+	for _, p := range n.Peers() {
+		if n.hostOf(p) == ip {
+			p.close(fmt.Errorf("%w (%v)", ErrBanned, reason))
+		}
+	}
+	return n.Bans.Ban(ip, d, reason)
+}
+
+func (n *Node) hostOf(p *Peer) string {
+	host, _, err := net.SplitHostPort(p.Addr)
+	if err != nil {
+		return p.Addr
+	}
+	return host
+}
@@ -0,0 +1,182 @@
+package p2p
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rwcarlsen/gobitmsg/msg"
+	"github.com/rwcarlsen/gobitmsg/payload"
+)
+
+func TestMisbehaving(t *testing.T) {
+	lg := testLog("node")
+	path := filepath.Join(t.TempDir(), "bans.json")
+	bans, err := LoadBanList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	node1 := NewNode("127.0.0.1", 22345, lg)
+	node1.Bans = bans
+	if err := node1.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer stop(t, node1)
+	node2 := NewNode("127.0.0.1", 22346, lg)
+	defer stop(t, node2)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	peer, err := node2.Handshake(ctx, node1.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// objects without enough proof of work for node1's default difficulty
+	node2.Broadcast(object(msg.Cmsg, "cheap 1"))
+	node2.Broadcast(object(msg.Cmsg, "cheap 2"))
+	select {
+	case <-peer.Done():
+	case <-ctx.Done():
+		t.Fatal("misbehaving peer was not disconnected")
+	}
+	if !bans.Banned("127.0.0.1") {
+		t.Fatal("misbehaving peer was not banned")
+	}
+	if _, err := node2.Handshake(ctx, node1.Addr); err == nil {
+		t.Error("banned peer was able to reconnect")
+	}
+
+	loaded, err := LoadBanList(path)
+	if err != nil {
+		t.Fatal(err)
+	} else if list := loaded.List(); len(list) != 1 || list[0].IP != "127.0.0.1" {
+		t.Errorf("ban was not saved: %+v", list)
+	}
+
+	if ok, err := bans.Unban("127.0.0.1"); !ok || err != nil {
+		t.Fatalf("unban failed: %v, %v", ok, err)
+	}
+	peer, err = node2.Handshake(ctx, node1.Addr)
+	if err != nil {
+		t.Fatalf("reconnecting after unban failed: %v", err)
+	}
+
+	// banning by hand drops existing sessions
+	if err := node2.Ban("127.0.0.1", time.Hour, "testing"); err != nil {
+		t.Fatal(err)
+	}
+	if !errors.Is(peer.Err(), ErrBanned) {
+		t.Errorf("expected the session to end with ErrBanned, got %v", peer.Err())
+	}
+	if _, err := node2.Handshake(ctx, node1.Addr); !errors.Is(err, ErrBanned) {
+		t.Errorf("expected ErrBanned connecting to a banned address, got %v", err)
+	}
+}
+
+func TestBadSignature(t *testing.T) {
+	lg := testLog("node")
+	node1 := NewNode("127.0.0.1", 22366, lg)
+	node1.TrialsPerByte, node1.ExtraBytes = 1, 1
+	if err := node1.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer stop(t, node1)
+	node2 := NewNode("127.0.0.1", 22367, lg)
+	defer stop(t, node2)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	peer, err := node2.Handshake(ctx, node1.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// enough forged pubkeys to get a peer banned if each were penalized
+	for i := 0; i < 3; i++ {
+		signKey, _ := payload.NewKey()
+		encryptKey, _ := payload.NewKey()
+		k := &payload.PubKey{Time: time.Now(), AddrVersion: 3, Stream: 1, SignKey: signKey, EncryptKey: encryptKey}
+		if err := k.Sign(); err != nil {
+			t.Fatal(err)
+		}
+		data := k.Bytes()
+		data[len(data)-1] ^= 1
+		nonce := payload.DoPOW(1, 1, data[8:])
+		binary.BigEndian.PutUint64(data, nonce)
+		node2.Broadcast(msg.New(msg.Cpubkey, data))
+	}
+	good := object(msg.Cmsg, "good")
+	node2.Broadcast(good)
+	select {
+	case m := <-node1.ObjectsIn:
+		if m.Cmd() != msg.Cmsg {
+			t.Errorf("forged %v delivered", m.Cmd())
+		}
+	case <-ctx.Done():
+		t.Fatal("object after the forgeries never arrived")
+	}
+	if peer.Err() != nil || node1.Bans.Banned("127.0.0.1") {
+		t.Error("relaying peer was punished for forged signatures")
+	}
+}
+
+func TestVerifyObject(t *testing.T) {
+	node := NewNode("127.0.0.1", 22368, testLog("node"))
+	node.TrialsPerByte, node.ExtraBytes = 1, 1
+
+	signKey, _ := payload.NewKey()
+	encryptKey, _ := payload.NewKey()
+	k := &payload.PubKey{Time: time.Now(), AddrVersion: 3, Stream: 1, SignKey: signKey, EncryptKey: encryptKey}
+	if err := k.Sign(); err != nil {
+		t.Fatal(err)
+	}
+	k.SetNonce(payload.DoPOW(1, 1, k.PayloadForPOW()))
+	data := k.Bytes()
+	if err := node.verifyObject(msg.New(msg.Cpubkey, data)); err != nil {
+		t.Errorf("valid pubkey rejected (%v)", err)
+	}
+	data[len(data)-1] ^= 1
+	binary.BigEndian.PutUint64(data, payload.DoPOW(1, 1, data[8:]))
+	if err := node.verifyObject(msg.New(msg.Cpubkey, data)); err != payload.ErrBadSignature {
+		t.Errorf("pubkey with a bad signature: got %v", err)
+	}
+
+	tests := []struct {
+		m    *msg.Msg
+		want error
+	}{
+		{object(msg.Cmsg, "encrypted"), nil},
+		{object(msg.Cobject, "v3"), nil},
+	}
+	for i, test := range tests {
+		if err := node.verifyObject(test.m); err != test.want {
+			t.Errorf("test %v: got %v, want %v", i, err, test.want)
+		}
+	}
+	// nodes default to the network minimum difficulty
+	strict := NewNode("127.0.0.1", 22369, testLog("node"))
+	if err := strict.verifyObject(object(msg.Cmsg, "cheap")); err != payload.ErrInsufficientPOW {
+		t.Errorf("cheap object: got %v", err)
+	}
+	if err := node.verifyObject(msg.New(msg.Cpubkey, []byte("short"))); !errors.Is(err, payload.ErrMalformed) {
+		t.Errorf("malformed pubkey: got %v", err)
+	}
+
+	// version 2 pubkeys are unsigned and end with the keys
+	v2 := &payload.PubKey{Time: time.Now(), AddrVersion: 2, Stream: 1, SignKey: signKey, EncryptKey: encryptKey}
+	v2.SetNonce(payload.DoPOW(1, 1, v2.PayloadForPOW()))
+	if err := node.verifyObject(msg.New(msg.Cpubkey, v2.Bytes())); err != nil {
+		t.Errorf("version 2 pubkey rejected (%v)", err)
+	}
+	// later versions are refused, but aren't malformed
+	v4 := &payload.PubKey{Time: time.Now(), AddrVersion: 4, Stream: 1, SignKey: signKey, EncryptKey: encryptKey}
+	v4.SetNonce(payload.DoPOW(1, 1, v4.PayloadForPOW()))
+	if err := node.verifyObject(msg.New(msg.Cpubkey, v4.Bytes())); err == nil || errors.Is(err, payload.ErrMalformed) {
+		t.Errorf("version 4 pubkey: got %v", err)
+	}
+}
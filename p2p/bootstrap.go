@@ -0,0 +1,284 @@
+package p2p
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rwcarlsen/gobitmsg/payload"
+)
+
+// DefaultSeeds are well known stream 1 nodes to bootstrap from.
+var DefaultSeeds = []string{
+	"5.45.99.75:8444",
+	"75.167.159.54:8444",
+	"95.165.168.168:8444",
+	"85.180.139.241:8444",
+	"158.222.217.190:8080",
+	"178.62.12.187:8448",
+	"24.188.198.204:8111",
+	"109.147.204.113:1195",
+	"178.11.46.221:8444",
+}
+
+// DefaultDNSSeeds are host:port pairs whose host names resolve to active
+// nodes listening on port.
+var DefaultDNSSeeds = []string{
+	"bootstrap8080.bitmessage.org:8080",
+	"bootstrap8444.bitmessage.org:8444",
+}
+
+// maxKnown limits how many learned addresses a node remembers.
+const maxKnown = 1000
+
+const (
+	defaultBootstrapRetry = 5 * time.Second
+	maxBootstrapRetry     = 5 * time.Minute
+)
+
+// Resolver looks up the addresses of DNS seeds.  *net.Resolver satisfies
+// this interface.
+type Resolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// Bootstrap describes where a node looks for its first peers.  Sources are
+// tried in order - Known, Seeds, DNSSeeds and finally any addresses learned
+// from peers along the way - until the node has Want outbound peers.
+type Bootstrap struct {
+	// Known holds host:port addresses of peers from a previous run.
+	Known []string
+	// Seeds holds host:port addresses of well known nodes.
+	Seeds []string
+	// DNSSeeds holds host:port pairs to resolve into more peers.
+	DNSSeeds []string
+	// Resolver resolves DNSSeeds.  If nil, net.DefaultResolver is used
+	// unless the node has NoClearnet set, in which case DNS seeds are
+	// skipped to avoid leaking lookups outside the proxy.
+	Resolver Resolver
+	// Want is the number of outbound peers to stop at.
+	Want int
+	// Retry is how long KeepPeers waits between checks on the node's
+	// peers.  It doubles, up to 5 minutes, while bootstrapping keeps
+	// falling short.  Zero means 5 seconds.
+	Retry time.Duration
+}
+
+// Bootstrap connects to peers from b's sources one at a time until the
+// node has at least b.Want outbound peers.  It returns an error if the
+// sources run out first or ctx is done.
+func (n *Node) Bootstrap(ctx context.Context, b *Bootstrap) error {
+	tried := map[string]bool{}
+	try := func(addrs []string) bool {
+		for _, addr := range addrs {
+			if n.outbound() >= b.Want || ctx.Err() != nil {
+				return true
+			} else if tried[addr] {
+				continue
+			}
+			tried[addr] = true
+
+			hctx, cancel := context.WithTimeout(ctx, orDefault(n.HandshakeTimeout, defaultHandshakeTimeout))
+			_, err := n.Handshake(hctx, addr)
+			cancel()
+			if err != nil {
+				n.Log.Info("bootstrap connection failed", "peer", addr, "err", err)
+			}
+		}
+		return n.outbound() >= b.Want || ctx.Err() != nil
+	}
+
+	done := try(b.Known) || try(b.Seeds) || try(n.resolveSeeds(ctx, b)) || try(n.streamAddrs())
+	if err := ctx.Err(); err != nil {
+		return err
+	} else if done {
+		return nil
+	}
+	return fmt.Errorf("p2p: bootstrap found %v of %v wanted peers", n.outbound(), b.Want)
+}
+
+// KeepPeers bootstraps whenever the node has fewer than b.Want outbound
+// peers, backing off while that keeps falling short, until ctx is done or
+// the node stops.
+func (n *Node) KeepPeers(ctx context.Context, b *Bootstrap) {
+	retry := orDefault(b.Retry, defaultBootstrapRetry)
+	delay := retry
+	for {
+		if n.outbound() < b.Want {
+			if err := n.Bootstrap(ctx, b); err != nil && ctx.Err() == nil {
+				n.Log.Warn("bootstrap fell short", "retry", delay, "err", err)
+				delay = min(2*delay, maxBootstrapRetry)
+			} else {
+				delay = retry
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-n.ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// outbound returns the number of sessions the node opened itself.
+func (n *Node) outbound() int {
+	count := 0
+	for _, p := range n.Peers() {
+		if !p.Inbound {
+			count++
+		}
+	}
+	return count
+}
+
+func (n *Node) resolveSeeds(ctx context.Context, b *Bootstrap) []string {
+	r := b.Resolver
+	if r == nil {
+		if n.NoClearnet {
+			return nil
+		}
+		r = net.DefaultResolver
+	}
+
+	var addrs []string
+	for _, seed := range b.DNSSeeds {
+		host, port, err := net.SplitHostPort(seed)
+		if err != nil {
+			n.Log.Error("bad dns seed", "seed", seed, "err", err)
+			continue
+		}
+		ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+		ips, err := r.LookupHost(ctx, host)
+		cancel()
+		if err != nil {
+			n.Log.Warn("dns seed lookup failed", "seed", host, "err", err)
+			continue
+		}
+		n.Log.Info("dns seed resolved", "seed", host, "count", len(ips))
+		for _, ip := range ips {
+			addrs = append(addrs, net.JoinHostPort(ip, port))
+		}
+	}
+	return addrs
+}
+
+// addrInfo converts a host:port string into an address in stream.  Only
+// IPv4 addresses are supported by the wire format.  If names is set, host
+// names such as .onion addresses are accepted too, and given as the loopback
+// address, since the peer can't be told the name.
+func addrInfo(addr string, stream int, names bool) (*payload.AddressInfo, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 65535 {
+		return nil, fmt.Errorf("invalid port %q", portStr)
+	}
+	if ip := net.ParseIP(host); ip == nil && names && host != "" {
+		host = "127.0.0.1"
+	} else if ip == nil || ip.To4() == nil {
+		return nil, fmt.Errorf("%v is not an IPv4 address", host)
+	}
+	return &payload.AddressInfo{
+		Time:     time.Now(),
+		Stream:   stream,
+		Services: 1,
+		Ip:       host,
+		Port:     port,
+	}, nil
+}
+
+// learn remembers addresses advertised by peers for later bootstrapping
+// and gossip.  Addresses from unrelated streams are ignored.
+func (n *Node) learn(addrs []*payload.AddressInfo) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, ai := range addrs {
+		if len(n.known) >= maxKnown {
+			return
+		} else if n.related(ai.Stream) {
+			n.known[ai.Addr()] = ai.Stream
+		}
+	}
+}
+
+// addrStream returns the stream addr was learned in, or the node's first
+// stream if it wasn't.
+func (n *Node) addrStream(addr string) int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if stream, ok := n.known[addr]; ok {
+		return stream
+	}
+	return n.Streams()[0]
+}
+
+// streamAddrs returns the learned addresses of nodes in the node's streams.
+func (n *Node) streamAddrs() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	var addrs []string
+	for addr, stream := range n.known {
+		if n.peers[addr] == nil && n.inStream(stream) {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// KnownAddrs returns the addresses of connected peers followed by addresses
+// learned from them.  Saving these with SavePeers lets the next run
+// bootstrap without the seeds.
+func (n *Node) KnownAddrs() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	var addrs []string
+	for addr := range n.peers {
+		addrs = append(addrs, addr)
+	}
+	for addr := range n.known {
+		if n.peers[addr] == nil {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// LoadPeers reads a file of host:port lines written by SavePeers.  A
+// missing file is not an error.
+func LoadPeers(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var addrs []string
+	scan := bufio.NewScanner(f)
+	for scan.Scan() {
+		if line := strings.TrimSpace(scan.Text()); line != "" {
+			addrs = append(addrs, line)
+		}
+	}
+	return addrs, scan.Err()
+}
+
+// SavePeers writes addrs to path, one per line.
+func SavePeers(path string, addrs []string) error {
+	data := strings.Join(addrs, "\n") + "\n"
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(data), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
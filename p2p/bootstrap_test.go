@@ -0,0 +1,109 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type fakeResolver map[string][]string
+
+func (r fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if ips, ok := r[host]; ok {
+		return ips, nil
+	}
+	return nil, errors.New("no such host")
+}
+
+func TestBootstrap(t *testing.T) {
+	seed := NewNode("127.0.0.1", 22340, nil)
+	if err := seed.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer stop(t, seed)
+
+	node := NewNode("127.0.0.1", 22341, nil)
+	defer stop(t, node)
+
+	// the saved and hard-coded peers are dead, so only the DNS seed can
+	// satisfy the bootstrap.
+	b := &Bootstrap{
+		Known:    []string{"127.0.0.1:1"},
+		Seeds:    []string{"seed.invalid:8444", "127.0.0.1:2"},
+		DNSSeeds: []string{"nothing.test:8444", "seed.test:22340"},
+		Resolver: fakeResolver{"seed.test": {"127.0.0.1"}},
+		Want:     1,
+	}
+	if err := node.Bootstrap(context.Background(), b); err != nil {
+		t.Fatal(err)
+	}
+	if peers := node.Peers(); len(peers) != 1 || peers[0].Addr != "127.0.0.1:22340" {
+		t.Errorf("expected the DNS seed as the only peer, got %v", peers)
+	}
+
+	b.Want = 2
+	if err := node.Bootstrap(context.Background(), b); err == nil {
+		t.Error("expected an error when the sources run out")
+	}
+
+	path := filepath.Join(t.TempDir(), "peers.txt")
+	if err := SavePeers(path, node.KnownAddrs()); err != nil {
+		t.Fatal(err)
+	}
+	known, err := LoadPeers(path)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(known) != 1 || known[0] != "127.0.0.1:22340" {
+		t.Errorf("expected the seed to be saved, got %v", known)
+	}
+	if known, err := LoadPeers(filepath.Join(os.TempDir(), "no-such-peers-file")); err != nil || known != nil {
+		t.Errorf("expected no peers and no error for a missing file, got %v, %v", known, err)
+	}
+}
+
+func TestKeepPeers(t *testing.T) {
+	node := NewNode("127.0.0.1", 22364, nil)
+	defer stop(t, node)
+	ctx, cancel := context.WithCancel(context.Background())
+	kept := make(chan struct{})
+	go func() {
+		node.KeepPeers(ctx, &Bootstrap{Known: []string{"127.0.0.1:22365"}, Want: 1, Retry: 50 * time.Millisecond})
+		close(kept)
+	}()
+
+	// waitPeer waits for a peer other than old
+	waitPeer := func(old *Peer) *Peer {
+		deadline := time.Now().Add(10 * time.Second)
+		for time.Now().Before(deadline) {
+			if peers := node.Peers(); len(peers) == 1 && peers[0] != old {
+				return peers[0]
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatal("no new peer connected")
+		return nil
+	}
+
+	// the peer isn't up at first, so bootstrapping is retried
+	time.Sleep(200 * time.Millisecond)
+	seed := NewNode("127.0.0.1", 22365, nil)
+	if err := seed.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer stop(t, seed)
+	p := waitPeer(nil)
+
+	// a lost peer is replaced
+	p.Close()
+	waitPeer(p)
+
+	cancel()
+	select {
+	case <-kept:
+	case <-time.After(5 * time.Second):
+		t.Fatal("KeepPeers didn't return when ctx was done")
+	}
+}
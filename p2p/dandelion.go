@@ -0,0 +1,249 @@
+package p2p
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/rwcarlsen/gobitmsg/msg"
+	"github.com/rwcarlsen/gobitmsg/payload"
+)
+
+const (
+	defaultFluffProbability = 0.1
+	defaultEmbargo          = 30 * time.Second
+	// stem peers are chosen afresh every stemEpochLength, up to
+	// stemPeersPerEpoch of them
+	stemEpochLength   = 10 * time.Minute
+	stemPeersPerEpoch = 2
+)
+
+// stemObject is an object in the Dandelion++ stem phase.  Only the stem
+// peer it was passed to may fetch it.
+type stemObject struct {
+	data    []byte
+	stream  int
+	expires time.Time
+	to      *Peer
+	embargo *time.Timer
+}
+
+// Publish sends a new object of our own to the network.  It is first passed
+// to a single stem peer, and only added to the inventory and advertised to
+// every peer once it is fluffed, by a later stem peer or when the embargo
+// ends.  Without a stem peer it is fluffed at once.
+func (n *Node) Publish(m *msg.Msg) error {
+	return n.stemRelay(m, nil)
+}
+
+// stemRelay passes the object m, received from the stem peer from or ours
+// if from is nil, on to a stem peer, or fluffs it.
+func (n *Node) stemRelay(m *msg.Msg, from *Peer) error {
+	stream, expires, err := n.checkObject(m)
+	if err != nil {
+		return err
+	}
+	hash := fmt.Sprintf("%x", invHash(m.Payload()))
+	obj := &stemObject{data: m.Encode(), stream: stream, expires: expires}
+
+	n.mu.Lock()
+	if n.expired(hash, expires) {
+		n.mu.Unlock()
+		return ErrExpired
+	} else if _, ok := n.inv[stream][hash]; ok || n.stem[hash] != nil {
+		n.mu.Unlock()
+		return nil
+	}
+	fluffProb := n.FluffProbability
+	if fluffProb <= 0 {
+		fluffProb = defaultFluffProbability
+	}
+	if from == nil || rand.Float64() >= fluffProb {
+		obj.to = n.stemPeer(stream, from)
+	}
+	if obj.to == nil {
+		err := n.addObject(hash, stream, invObject{obj.data, expires})
+		n.mu.Unlock()
+		n.Log.Debug("fluffing object", "hash", hash)
+		n.announce(stream, hash)
+		return err
+	}
+	embargo := orDefault(n.Embargo, defaultEmbargo)
+	embargo += time.Duration(rand.Int63n(int64(embargo)))
+	obj.embargo = time.AfterFunc(embargo, func() {
+		n.spawn(func() { n.fluff(hash) })
+	})
+	n.stem[hash] = obj
+	n.mu.Unlock()
+
+	n.Log.Debug("stemming object", "peer", obj.to.Addr, "hash", hash)
+	sum, _ := hex.DecodeString(hash)
+	pay, err := payload.InventoryEncode(obj.to.Ver.Protocol(), [][]byte{sum})
+	if err != nil {
+		return err
+	} else if err := obj.to.Send(msg.New(msg.Cdinv, pay)); err != nil {
+		// the embargo will fluff it
+		n.Log.Warn("send failed", "peer", obj.to.Addr, "cmd", msg.Cdinv, "err", err)
+	}
+	return nil
+}
+
+// stemPeer returns the peer to pass stem objects in stream from the peer
+// from on to, or nil if there is none.  Each source peer keeps the same stem
+// peer for an epoch, and outbound peers are preferred.  The caller must hold
+// n.mu.
+func (n *Node) stemPeer(stream int, from *Peer) *Peer {
+	if now := time.Now(); now.After(n.stemEpoch) {
+		n.stemRoutes = map[*Peer]*Peer{}
+		n.stemEpoch = now.Add(stemEpochLength)
+	}
+	usable := func(p *Peer) bool {
+		return p != from && p.Err() == nil && p.InStream(stream) &&
+			p.Ver.Services&payload.ServiceDandelion != 0
+	}
+	if p := n.stemRoutes[from]; p != nil && usable(p) {
+		return p
+	}
+
+	var relays []*Peer
+	chosen := map[*Peer]bool{}
+	for _, p := range n.stemRoutes {
+		if !chosen[p] && usable(p) {
+			chosen[p] = true
+			relays = append(relays, p)
+		}
+	}
+	if len(relays) < stemPeersPerEpoch {
+		var in, out []*Peer
+		for _, p := range n.peers {
+			if chosen[p] || !usable(p) {
+				continue
+			} else if p.Inbound {
+				in = append(in, p)
+			} else {
+				out = append(out, p)
+			}
+		}
+		if len(out) == 0 {
+			out = in
+		}
+		if len(out) > 0 {
+			relays = append(relays, out[rand.Intn(len(out))])
+		}
+	}
+	if len(relays) == 0 {
+		return nil
+	}
+	p := relays[rand.Intn(len(relays))]
+	n.stemRoutes[from] = p
+	return p
+}
+
+// stemData returns the encoded stem object with the hex inventory hash if
+// it was passed to p.
+func (n *Node) stemData(hash string, p *Peer) ([]byte, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if obj := n.stem[hash]; obj != nil && obj.to == p {
+		return obj.data, true
+	}
+	return nil, false
+}
+
+// stemming reports whether the object with the hex inventory hash is in
+// the stem phase.
+func (n *Node) stemming(hash string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.stem[hash] != nil
+}
+
+// stemAdvertised fetches the stem objects p advertised in a dinv and relays
+// them.  They are also delivered on ObjectsIn.
+func (n *Node) stemAdvertised(p *Peer, hashes [][]byte) {
+	var want [][]byte
+	for _, h := range hashes {
+		key := hex.EncodeToString(h)
+		if _, ok := n.object(key, n.Streams()); ok || n.Expired(h) || n.stemming(key) {
+			continue
+		}
+		want = append(want, h)
+	}
+	if len(want) == 0 {
+		return
+	}
+
+	n.spawn(func() {
+		ctx, cancel := context.WithTimeout(n.ctx, orDefault(n.Embargo, defaultEmbargo))
+		defer cancel()
+		objs, err := n.GetData(ctx, p, want)
+		if err != nil {
+			n.Log.Debug("stem objects not fetched", "peer", p.Addr, "err", err)
+		}
+		for _, m := range objs {
+			if err := n.stemRelay(m, p); err != nil {
+				n.Log.Debug("stem object not relayed", "peer", p.Addr, "cmd", m.Cmd(), "err", err)
+			}
+			select {
+			case n.ObjectsIn <- m:
+			case <-n.ctx.Done():
+				return
+			}
+		}
+	})
+}
+
+// fluff ends the stem phase of the object with the hex inventory hash once
+// its embargo is over, adding it to the inventory and advertising it.
+func (n *Node) fluff(hash string) {
+	n.mu.Lock()
+	obj := n.stem[hash]
+	if obj == nil {
+		n.mu.Unlock()
+		return
+	}
+	delete(n.stem, hash)
+	err := n.addObject(hash, obj.stream, invObject{obj.data, obj.expires})
+	n.mu.Unlock()
+
+	if err != nil {
+		n.Log.Error("failed to record object", "hash", hash, "err", err)
+	}
+	n.Log.Debug("embargo over, fluffing object", "hash", hash)
+	n.announce(obj.stream, hash)
+}
+
+// fluffed ends the stem phase of any of the objects with the given
+// inventory hashes, since a peer has advertised them.
+func (n *Node) fluffed(hashes [][]byte) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if len(n.stem) == 0 {
+		return
+	}
+	for _, h := range hashes {
+		key := hex.EncodeToString(h)
+		obj := n.stem[key]
+		if obj == nil {
+			continue
+		}
+		obj.embargo.Stop()
+		delete(n.stem, key)
+		if err := n.addObject(key, obj.stream, invObject{obj.data, obj.expires}); err != nil {
+			n.Log.Error("failed to record object", "hash", key, "err", err)
+		}
+	}
+}
+
+// announce advertises the object with the hex inventory hash to the peers
+// in stream.
+func (n *Node) announce(stream int, hash string) {
+	sum, _ := hex.DecodeString(hash)
+	for _, p := range n.StreamPeers(stream) {
+		if err := sendInv(p, p.Ver.Protocol(), [][]byte{sum}); err != nil {
+			n.Log.Warn("send failed", "peer", p.Addr, "cmd", msg.Cinv, "err", err)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/rwcarlsen/gobitmsg/msg"
+	"github.com/rwcarlsen/gobitmsg/payload"
+)
+
+func TestDandelion(t *testing.T) {
+	nodeA := NewNode("127.0.0.1", 22358, testLog("nodeA"))
+	nodeA.TrialsPerByte, nodeA.ExtraBytes = 1, 1
+	nodeA.Embargo = 500 * time.Millisecond
+	nodeA.FluffProbability = 1
+	if err := nodeA.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer stop(t, nodeA)
+
+	// nodeC doesn't relay stem objects, so nodeA's only stem peer is a
+	// silent connection that never fetches them
+	nodeC := NewNode("127.0.0.1", 22359, testLog("nodeC"))
+	nodeC.TrialsPerByte, nodeC.ExtraBytes = 1, 1
+	nodeC.MyVer.Services = payload.ServiceNetwork
+	advertised := make(chan []byte, 10)
+	nodeC.OnInv = func(p *Peer, hashes [][]byte) {
+		for _, h := range hashes {
+			advertised <- h
+		}
+	}
+	defer stop(t, nodeC)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	peerC, err := nodeC.Handshake(ctx, nodeA.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("tcp", nodeA.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	silent := NewNode("127.0.0.1", 22360, testLog("silent"))
+	if _, err := silent.handshake(ctx, conn, nodeA.Addr); err != nil {
+		t.Fatal(err)
+	}
+
+	obj := object(msg.Cmsg, "stem")
+	hash := invHash(obj.Payload())
+	if err := nodeA.Publish(obj); err != nil {
+		t.Fatal(err)
+	}
+	if n := nodeA.InvSize(); n != 0 {
+		t.Errorf("stem object added to the inventory")
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		m, err := msg.Decode(conn)
+		if err != nil {
+			t.Fatalf("no dinv sent to the stem peer (%v)", err)
+		} else if m.Cmd() != msg.Cdinv {
+			continue
+		}
+		if hashes, _ := payload.InventoryDecode(2, m.Payload()); len(hashes) != 1 || !bytes.Equal(hashes[0], hash) {
+			t.Errorf("dinv for %x, expected %x", hashes, hash)
+		}
+		break
+	}
+
+	// only the stem peer may fetch it
+	getCtx, getCancel := context.WithTimeout(ctx, 300*time.Millisecond)
+	objs, _ := nodeC.GetData(getCtx, peerC, [][]byte{hash})
+	getCancel()
+	if len(objs) != 0 {
+		t.Error("stem object sent to a non-stem peer")
+	}
+
+	// the embargo ends and nodeA fluffs it
+	select {
+	case h := <-advertised:
+		if !bytes.Equal(h, hash) {
+			t.Errorf("advertised %x, expected %x", h, hash)
+		}
+	case <-ctx.Done():
+		t.Fatal("object not fluffed after the embargo")
+	}
+	if n := nodeA.InvSize(); n != 1 {
+		t.Errorf("fluffed object not in the inventory")
+	}
+
+	// nodeB's object is stemmed to nodeA, which fluffs it
+	nodeB := NewNode("127.0.0.1", 22361, testLog("nodeB"))
+	nodeB.TrialsPerByte, nodeB.ExtraBytes = 1, 1
+	nodeB.Embargo = time.Minute
+	defer stop(t, nodeB)
+	if _, err := nodeB.Handshake(ctx, nodeA.Addr); err != nil {
+		t.Fatal(err)
+	}
+	obj2 := object(msg.Cmsg, "stem two")
+	if err := nodeB.Publish(obj2); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case m := <-nodeA.ObjectsIn:
+		if !bytes.Equal(m.Payload(), obj2.Payload()) {
+			t.Error("nodeA received the wrong object")
+		}
+	case <-ctx.Done():
+		t.Fatal("stem object never reached nodeA")
+	}
+	select {
+	case h := <-advertised:
+		if !bytes.Equal(h, invHash(obj2.Payload())) {
+			t.Errorf("advertised %x, expected nodeB's object", h)
+		}
+	case <-ctx.Done():
+		t.Fatal("nodeA didn't fluff nodeB's object")
+	}
+	// nodeB sees it fluffed well before its embargo ends
+	for nodeB.InvSize() != 1 {
+		select {
+		case <-ctx.Done():
+			t.Fatal("nodeB never saw its object fluffed")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// ErrClearnet is returned when a node configured with NoClearnet is asked
+// to make a connection that would not go through a proxy.
+var ErrClearnet = errors.New("p2p: clearnet connections are disabled")
+
+// Dialer establishes outbound connections on behalf of a Node.  A
+// *net.Dialer and *SOCKS5 both satisfy this interface.
+type Dialer interface {
+	Dial(network, addr string) (net.Conn, error)
+}
+
+// Proxy is implemented by Dialers that route connections through a proxy,
+// such as *SOCKS5.  A node with NoClearnet only dials through a Proxy.
+type Proxy interface {
+	Dialer
+	// ResolvesRemotely reports whether host names are passed to the proxy
+	// instead of being looked up locally.
+	ResolvesRemotely() bool
+}
+
+// ContextDialer is implemented by Dialers that can abandon a connection
+// attempt when a context is done.
+type ContextDialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// dial opens an outbound connection to addr using the node's Dialer.  If no
+// Dialer is set, a direct connection is made unless NoClearnet is set.  With
+// NoClearnet, host names are only dialed through a proxy resolving them, so
+// the lookup doesn't leak either.
+func (n *Node) dial(ctx context.Context, addr string) (net.Conn, error) {
+	d := n.Dialer
+	if n.NoClearnet {
+		p, ok := d.(Proxy)
+		if !ok {
+			return nil, ErrClearnet
+		}
+		host, _, _ := net.SplitHostPort(addr)
+		if !p.ResolvesRemotely() && net.ParseIP(host) == nil {
+			return nil, ErrClearnet
+		}
+	}
+	if d == nil {
+		d = &net.Dialer{Timeout: defaultTimeout}
+	}
+	return dialContext(ctx, d, "tcp", addr)
+}
+
+// remoteNames reports whether the node dials through a Proxy that looks up
+// host names, so names such as .onion addresses can be connected to.
+func (n *Node) remoteNames() bool {
+	p, ok := n.Dialer.(Proxy)
+	return ok && p.ResolvesRemotely()
+}
+
+func dialContext(ctx context.Context, d Dialer, network, addr string) (net.Conn, error) {
+	if cd, ok := d.(ContextDialer); ok {
+		return cd.DialContext(ctx, network, addr)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return d.Dial(network, addr)
+}
@@ -0,0 +1,141 @@
+package p2p
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rwcarlsen/gobitmsg/msg"
+)
+
+// Object lifetimes under the protocol v2 rules.  Protocol v3 objects carry
+// their own expiry time.
+const (
+	ObjectLifetime = 2 * 24 * time.Hour
+	PubkeyLifetime = 28 * 24 * time.Hour
+)
+
+const (
+	defaultExpiryGrace   = 3 * time.Hour
+	defaultCleanInterval = 5 * time.Minute
+	// expired hashes are remembered this long so peers still advertising
+	// them don't get them fetched again
+	rememberExpired = 6 * time.Hour
+)
+
+// ErrExpired is returned when adding an object past its lifetime.
+var ErrExpired = errors.New("p2p: object expired")
+
+// ObjectExpiry returns the time an object payload's lifetime ends: its
+// expiresTime for protocol v3 objects, or its time plus the v2 lifetime for
+// its type.
+func ObjectExpiry(cmd msg.Command, data []byte) (time.Time, error) {
+	if len(data) < 16 {
+		return time.Time{}, fmt.Errorf("p2p: %v object too short", cmd)
+	}
+	t := time.Unix(int64(binary.BigEndian.Uint64(data[8:16])), 0)
+	switch cmd {
+	case msg.Cobject:
+		return t, nil
+	case msg.Cpubkey:
+		return t.Add(PubkeyLifetime), nil
+	case msg.CgetpubKey, msg.Cmsg, msg.Cbroadcast:
+		return t.Add(ObjectLifetime), nil
+	}
+	return time.Time{}, fmt.Errorf("p2p: %v is not an object", cmd)
+}
+
+// expired reports whether an object with the given expiry, or the hex
+// inventory hash, is past its lifetime plus the node's grace period.  The
+// caller must hold n.mu.
+func (n *Node) expired(hash string, expires time.Time) bool {
+	if _, ok := n.recentlyExpired[hash]; ok {
+		return true
+	}
+	return time.Now().After(expires.Add(orDefault(n.ExpiryGrace, defaultExpiryGrace)))
+}
+
+// stale reports whether the object m is expired or was recently dropped
+// for expiring.
+func (n *Node) stale(m *msg.Msg) bool {
+	expires, err := ObjectExpiry(m.Cmd(), m.Payload())
+	if err != nil {
+		return true
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.expired(fmt.Sprintf("%x", invHash(m.Payload())), expires)
+}
+
+// Expired reports whether the object with inventory hash was recently
+// dropped from the inventory for being too old.
+func (n *Node) Expired(hash []byte) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	_, ok := n.recentlyExpired[fmt.Sprintf("%x", hash)]
+	return ok
+}
+
+// cleaner drops expired objects from the inventory every CleanInterval
+// until the node stops.
+func (n *Node) cleaner() {
+	t := time.NewTicker(orDefault(n.CleanInterval, defaultCleanInterval))
+	defer t.Stop()
+	for {
+		select {
+		case <-n.ctx.Done():
+			return
+		case <-t.C:
+			n.clean()
+		}
+	}
+}
+
+// clean drops expired objects, forgets hashes that expired long enough
+// ago and compacts the inventory file once it is mostly dead records.
+func (n *Node) clean() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	now := time.Now()
+	for h, at := range n.recentlyExpired {
+		if now.Sub(at) > rememberExpired {
+			delete(n.recentlyExpired, h)
+		}
+	}
+
+	dropped := 0
+	for stream, objs := range n.inv {
+		for h, obj := range objs {
+			if !n.expired(h, obj.expires) {
+				continue
+			}
+			delete(objs, h)
+			n.recentlyExpired[h] = now
+			dropped++
+			if err := n.invFile.remove(h); err != nil {
+				n.Log.Error("failed to record expired object", "hash", h, "err", err)
+			}
+		}
+		if len(objs) == 0 {
+			delete(n.inv, stream)
+		}
+	}
+	if dropped > 0 {
+		n.Log.Info("dropped expired objects", "count", dropped)
+		objectCount.Add(float64(dropped), "expired")
+	}
+
+	if n.invFile.needsCompaction() {
+		var objs [][]byte
+		for _, stream := range n.inv {
+			for _, obj := range stream {
+				objs = append(objs, obj.data)
+			}
+		}
+		if err := n.invFile.compact(objs); err != nil {
+			n.Log.Error("failed to compact inventory file", "err", err)
+		}
+	}
+}
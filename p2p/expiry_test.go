@@ -0,0 +1,85 @@
+package p2p
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rwcarlsen/gobitmsg/msg"
+)
+
+func TestObjectExpiry(t *testing.T) {
+	now := time.Unix(time.Now().Unix(), 0)
+	tests := []struct {
+		cmd  msg.Command
+		want time.Time
+	}{
+		{msg.Cmsg, now.Add(ObjectLifetime)},
+		{msg.Cbroadcast, now.Add(ObjectLifetime)},
+		{msg.CgetpubKey, now.Add(ObjectLifetime)},
+		{msg.Cpubkey, now.Add(PubkeyLifetime)},
+		{msg.Cobject, now},
+	}
+	for _, test := range tests {
+		m := timedObject(test.cmd, 1, now, "x")
+		if got, err := ObjectExpiry(test.cmd, m.Payload()); err != nil || !got.Equal(test.want) {
+			t.Errorf("%v: got expiry %v (%v), want %v", test.cmd, got, err, test.want)
+		}
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "objects.dat")
+	node := NewNode("127.0.0.1", 22354, testLog("node"))
+	if err := node.OpenInventory(path); err != nil {
+		t.Fatal(err)
+	}
+
+	fresh := object(msg.Cmsg, "fresh")
+	old := timedObject(msg.Cmsg, 1, time.Now().Add(-ObjectLifetime-time.Hour), "old")
+	ancient := timedObject(msg.Cmsg, 1, time.Now().Add(-ObjectLifetime-24*time.Hour), "ancient")
+	if err := node.AddObject(fresh); err != nil {
+		t.Fatal(err)
+	} else if err := node.AddObject(fresh); err != ErrDuplicate {
+		t.Errorf("expected ErrDuplicate adding an object twice, got %v", err)
+	} else if err := node.AddObject(old); err != nil {
+		t.Fatalf("object within the grace period refused: %v", err)
+	} else if err := node.AddObject(ancient); err != ErrExpired {
+		t.Errorf("expected ErrExpired adding an ancient object, got %v", err)
+	}
+
+	node.ExpiryGrace = time.Minute
+	node.clean()
+	if size := node.InvSize(); size != 1 {
+		t.Errorf("expected 1 object after cleaning, got %v", size)
+	}
+	oldHash := invHash(old.Payload())
+	if !node.Expired(oldHash) {
+		t.Error("dropped object not remembered as expired")
+	}
+	node.ExpiryGrace = 0
+	if err := node.AddObject(old); err != ErrExpired {
+		t.Errorf("expected ErrExpired re-adding a dropped object, got %v", err)
+	}
+	stop(t, node)
+
+	// reopening only loads the live object and compacts the file
+	node = NewNode("127.0.0.1", 22354, testLog("node"))
+	if err := node.OpenInventory(path); err != nil {
+		t.Fatal(err)
+	}
+	defer stop(t, node)
+	if size := node.InvSize(); size != 1 {
+		t.Errorf("expected 1 object after reopening, got %v", size)
+	} else if _, ok := node.object(fmt.Sprintf("%x", invHash(fresh.Payload())), []int{1}); !ok {
+		t.Error("live object not loaded")
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	} else if want := int64(5 + len(fresh.Encode())); info.Size() != want {
+		t.Errorf("compacted file is %v bytes, want %v", info.Size(), want)
+	}
+}
@@ -0,0 +1,185 @@
+package p2p
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/rwcarlsen/gobitmsg/msg"
+)
+
+// Inventory file record kinds.  Each record is a kind byte, a 4 byte length
+// and the data: an encoded object message or a removed inventory hash.
+const (
+	recAdd    = 'A'
+	recRemove = 'R'
+)
+
+// invFile keeps the inventory on disk as an append-only log of added and
+// removed objects.  Methods on a nil invFile do nothing.
+type invFile struct {
+	path       string
+	f          *os.File
+	live, dead int
+}
+
+// OpenInventory loads the objects saved in the inventory file at path,
+// creating it if needed, and keeps it up to date from then on.  Expired
+// objects aren't loaded.  It must be called before the node starts.
+func (n *Node) OpenInventory(path string) error {
+	objs, err := readInvFile(path)
+	if err != nil {
+		return err
+	}
+	loaded := 0
+	for _, m := range objs {
+		if n.AddObject(m) == nil {
+			loaded++
+		}
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.Log.Info("loaded inventory", "path", path, "objects", loaded)
+	var live [][]byte
+	for _, stream := range n.inv {
+		for _, obj := range stream {
+			live = append(live, obj.data)
+		}
+	}
+	// start from a compacted file, which also drops any partly written
+	// record left by a crash
+	f := &invFile{path: path}
+	if err := f.compact(live); err != nil {
+		return err
+	}
+	n.invFile = f
+	return nil
+}
+
+// readInvFile returns the live objects in the file at path.
+func readInvFile(path string) ([]*msg.Msg, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var order []string
+	objs := map[string]*msg.Msg{}
+	r := bufio.NewReader(f)
+	for {
+		var head [5]byte
+		if _, err := io.ReadFull(r, head[:]); err != nil {
+			break
+		}
+		data := make([]byte, binary.BigEndian.Uint32(head[1:]))
+		if _, err := io.ReadFull(r, data); err != nil {
+			break
+		}
+
+		switch head[0] {
+		case recAdd:
+			m, err := msg.Decode(bytes.NewReader(data))
+			if err != nil {
+				return nil, fmt.Errorf("p2p: corrupt inventory file %v (%v)", path, err)
+			}
+			h := fmt.Sprintf("%x", invHash(m.Payload()))
+			if objs[h] == nil {
+				order = append(order, h)
+			}
+			objs[h] = m
+		case recRemove:
+			delete(objs, hex.EncodeToString(data))
+		default:
+			return nil, fmt.Errorf("p2p: corrupt inventory file %v (record kind %q)", path, head[0])
+		}
+	}
+
+	var live []*msg.Msg
+	for _, h := range order {
+		if m := objs[h]; m != nil {
+			live = append(live, m)
+		}
+	}
+	return live, nil
+}
+
+func (f *invFile) write(kind byte, data []byte) error {
+	rec := make([]byte, 5, 5+len(data))
+	rec[0] = kind
+	binary.BigEndian.PutUint32(rec[1:], uint32(len(data)))
+	_, err := f.f.Write(append(rec, data...))
+	return err
+}
+
+// add records an encoded object message.
+func (f *invFile) add(data []byte) error {
+	if f == nil {
+		return nil
+	}
+	f.live++
+	return f.write(recAdd, data)
+}
+
+// remove records that the object with the hex inventory hash was dropped.
+func (f *invFile) remove(hash string) error {
+	if f == nil {
+		return nil
+	}
+	sum, err := hex.DecodeString(hash)
+	if err != nil {
+		return err
+	}
+	f.live--
+	f.dead += 2
+	return f.write(recRemove, sum)
+}
+
+// needsCompaction reports whether most of the file's records are dead.
+func (f *invFile) needsCompaction() bool {
+	return f != nil && f.dead > 100 && f.dead > f.live
+}
+
+// compact rewrites the file with only the live objects.
+func (f *invFile) compact(objs [][]byte) error {
+	if f == nil {
+		return nil
+	}
+	tmp, err := os.OpenFile(f.path+".tmp", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	nf := &invFile{path: f.path, f: tmp}
+	for _, data := range objs {
+		if err := nf.add(data); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	} else if err := os.Rename(tmp.Name(), f.path); err != nil {
+		tmp.Close()
+		return err
+	}
+	if f.f != nil {
+		f.f.Close()
+	}
+	*f = *nf
+	return nil
+}
+
+func (f *invFile) close() error {
+	if f == nil {
+		return nil
+	}
+	return f.f.Close()
+}
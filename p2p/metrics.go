@@ -0,0 +1,81 @@
+package p2p
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/rwcarlsen/gobitmsg/metrics"
+	"github.com/rwcarlsen/gobitmsg/msg"
+)
+
+var (
+	decodeErrors = metrics.Default.NewCounter("bitmsg_decode_errors_total",
+		"Messages from peers that failed to decode, by type of error.", "type")
+	objectCount = metrics.Default.NewCounter("bitmsg_objects_total",
+		"Objects received from, relayed to and rejected from peers.", "result")
+	handshakeSeconds = metrics.Default.NewHistogram("bitmsg_handshake_seconds",
+		"Time taken by successful version handshakes.",
+		0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10)
+)
+
+// countDecodeError records err if it was caused by bad data from a peer.
+func countDecodeError(err error) {
+	var me malformedError
+	switch {
+	case errors.Is(err, msg.ErrChecksum):
+		decodeErrors.Inc("checksum")
+	case errors.Is(err, msg.ErrMagic):
+		decodeErrors.Inc("magic")
+	case errors.Is(err, msg.ErrTooLarge):
+		decodeErrors.Inc("too_large")
+	case errors.Is(err, msg.ErrWrongKind):
+		decodeErrors.Inc("wrong_kind")
+	case errors.As(err, &me):
+		decodeErrors.Inc("payload")
+	}
+}
+
+// RegisterMetrics adds gauges and counters describing the node's peers,
+// traffic and inventory to r.  It panics if called twice with the same
+// registry.
+func (n *Node) RegisterMetrics(r *metrics.Registry) {
+	r.NewGaugeFunc("bitmsg_peers", "Connected peers by stream and direction.",
+		[]string{"stream", "direction"}, func(emit func(float64, ...string)) {
+			count := map[[2]string]int{}
+			for _, p := range n.Peers() {
+				dir := "outbound"
+				if p.Inbound {
+					dir = "inbound"
+				}
+				for _, s := range p.Streams() {
+					count[[2]string{strconv.Itoa(s), dir}]++
+				}
+			}
+			for k, c := range count {
+				emit(float64(c), k[0], k[1])
+			}
+		})
+	r.NewGaugeFunc("bitmsg_inventory_objects", "Objects in the node's inventory.",
+		nil, func(emit func(float64, ...string)) {
+			emit(float64(n.InvSize()))
+		})
+
+	traffic := func(bytes bool) func(emit func(float64, ...string)) {
+		return func(emit func(float64, ...string)) {
+			t := n.Traffic()
+			for dir, byCmd := range map[string]map[msg.Command]Counter{"in": t.InByCmd, "out": t.OutByCmd} {
+				for cmd, c := range byCmd {
+					v := c.Msgs
+					if bytes {
+						v = c.Bytes
+					}
+					emit(float64(v), string(cmd), dir)
+				}
+			}
+		}
+	}
+	r.NewCounterFunc("bitmsg_messages_total", "Messages sent and received by command.",
+		[]string{"command", "direction"}, traffic(false))
+	r.NewCounterFunc("bitmsg_message_bytes_total", "Bytes of messages sent and received by command.",
+		[]string{"command", "direction"}, traffic(true))
+}
@@ -1,49 +1,150 @@
 package p2p
 
 import (
+	"context"
 	"encoding/hex"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
+	"strconv"
+	"sync"
 	"time"
 
+	"github.com/rwcarlsen/gobitmsg/logging"
 	"github.com/rwcarlsen/gobitmsg/msg"
 	"github.com/rwcarlsen/gobitmsg/payload"
 )
 
 const (
-	defaultTimeout = 4 * time.Second
+	defaultTimeout          = 4 * time.Second
+	defaultHandshakeTimeout = 10 * time.Second
+	defaultReadTimeout      = time.Minute
+	defaultWriteTimeout     = time.Minute
+	defaultIdleTimeout      = 10 * time.Minute
 )
 
-type VerDat struct {
-	Ver   *payload.Version
-	Peers []*payload.AddressInfo
-	Inv   [][]byte
-	Err   error
-}
-
+// Node is a bitmessage network node.  Once started it accepts sessions from
+// other nodes, and Handshake opens sessions to them.
 type Node struct {
-	Addr       string
-	Log        *log.Logger
-	ObjectsIn  chan *msg.Msg
-	objectsOut chan broadcastReq
-	VerIn      chan *VerDat
-	verOut     chan *payload.AddressInfo
-	MyVer      *payload.Version
-	MyPeers    []*payload.AddressInfo
-	MyInv      map[string][]byte
+	Addr string
+	Log  *slog.Logger
+	// ObjectsIn receives objects pushed to us by peers.  Objects fetched
+	// with GetData are returned to its caller instead.
+	ObjectsIn chan *msg.Msg
+	MyVer     *payload.Version
+	// MyPeers are advertised to every peer along with the addresses the
+	// node has learned.
+	MyPeers []*payload.AddressInfo
+	// Dialer is used for all outbound connections.  If nil, connections
+	// are made directly.
+	Dialer Dialer
+	// NoClearnet causes the node to refuse any outbound connection that
+	// would not go through a Proxy Dialer.
+	NoClearnet bool
+	// OnPeer, if set, is called with every new peer session, inbound or
+	// outbound, before any of its messages are handled.  It must not block.
+	OnPeer func(p *Peer)
+	// OnInv, if set, is called with the inventory hashes a peer
+	// advertises, during the handshake and after.  It must not block.
+	OnInv func(p *Peer, hashes [][]byte)
+
+	// HandshakeTimeout bounds the version handshake of inbound sessions
+	// and of outbound ones made while bootstrapping.
+	HandshakeTimeout time.Duration
+	// ReadTimeout bounds reading the rest of a message once its first byte
+	// has arrived, and WriteTimeout bounds writing a message.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	// IdleTimeout is how long a session may go without receiving anything
+	// before it is dropped.  Idle sessions are pinged after half of it.
+	IdleTimeout time.Duration
+
+	// Bans holds banned peer addresses.  NewNode sets it to an empty list
+	// that isn't saved.
+	Bans *BanList
+	// BanThreshold is the misbehavior score at which a peer is banned, for
+	// BanDuration.
+	BanThreshold int
+	BanDuration  time.Duration
+	// TrialsPerByte and ExtraBytes set the minimum proof of work accepted
+	// on objects.  Zero values mean the network defaults.
+	TrialsPerByte int
+	ExtraBytes    int
+
+	// UploadLimit and DownloadLimit cap the node's total object traffic in
+	// bytes per second, and the Peer limits cap each session.  Zero means
+	// unlimited.  Handshakes and keepalives are never throttled.
+	UploadLimit       int
+	DownloadLimit     int
+	PeerUploadLimit   int
+	PeerDownloadLimit int
+
+	// ExpiryGrace is how long objects are kept past the end of their
+	// lifetime, and CleanInterval how often expired objects are dropped.
+	ExpiryGrace   time.Duration
+	CleanInterval time.Duration
+
+	// FluffProbability is the chance that an object relayed in the
+	// Dandelion++ stem phase is fluffed, i.e. advertised to every peer,
+	// rather than passed on to a stem peer.  Embargo is how long the node
+	// waits to see a stem object fluffed before fluffing it itself, plus a
+	// random delay of up to as long again.
+	FluffProbability float64
+	Embargo          time.Duration
+
+	mu       sync.Mutex
+	peers    map[string]*Peer
+	byStream map[int]map[string]*Peer
+	inv      map[int]map[string]invObject
+	known    map[string]int // address to stream
+	scores   map[string]score
+	invFile  *invFile
+	ln       net.Listener
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+	stopping bool
+
+	// hashes of objects dropped from the inventory, and when
+	recentlyExpired map[string]time.Time
+
+	// Dandelion++ state: objects in the stem phase by hex inventory hash,
+	// and the stem peers chosen for this epoch by the peer objects come from
+	stem       map[string]*stemObject
+	stemRoutes map[*Peer]*Peer
+	stemEpoch  time.Time
+
+	traffic traffic
+	// global rate limits, set up on first use
+	limitOnce sync.Once
+	upLimit   *bucket
+	downLimit *bucket
 }
 
-func (n *Node) invList() [][]byte {
-	hashes := make([][]byte, 0, len(n.MyInv))
-	for s, _ := range n.MyInv {
-		sum, _ := hex.DecodeString(s)
-		hashes = append(hashes, sum)
+// ErrStopped is returned by operations on a node that has been stopped.
+var ErrStopped = errors.New("p2p: node stopped")
+
+// invList returns the hashes of the objects in streams.
+func (n *Node) invList(streams []int) [][]byte {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	var hashes [][]byte
+	for _, stream := range streams {
+		for s := range n.inv[stream] {
+			sum, _ := hex.DecodeString(s)
+			hashes = append(hashes, sum)
+		}
 	}
 	return hashes
 }
 
-func NewNode(ip string, port int, lg *log.Logger) *Node {
+// NewNode returns a node listening on ip:port once started.  A nil lg
+// discards the node's logs.
+func NewNode(ip string, port int, lg *slog.Logger) *Node {
+	if lg == nil {
+		lg = logging.Discard()
+	}
 	addr := &payload.AddressInfo{
 		Time:     time.Now(),
 		Stream:   1,
@@ -52,282 +153,601 @@ func NewNode(ip string, port int, lg *log.Logger) *Node {
 		Port:     port,
 	}
 	ver := &payload.Version{
-		Services:  1,
+		Services:  payload.ServiceNetwork | payload.ServiceDandelion,
 		Timestamp: time.Now(),
 		ToAddr:    addr,
 		FromAddr:  addr,
 		UserAgent: "/gobitmsg-0.1/",
 		Streams:   []int{1},
 	}
+	ctx, cancel := context.WithCancel(context.Background())
 	return &Node{
-		Addr:       addr.Addr(),
-		Log:        lg,
-		ObjectsIn:  make(chan *msg.Msg),
-		objectsOut: make(chan broadcastReq),
-		VerIn:      make(chan *VerDat),
-		verOut:     make(chan *payload.AddressInfo),
-		MyVer:      ver,
-		MyPeers:    []*payload.AddressInfo{},
-		MyInv:      map[string][]byte{},
+		Addr:      addr.Addr(),
+		Log:       lg,
+		ObjectsIn: make(chan *msg.Msg),
+		MyVer:     ver,
+		MyPeers:   []*payload.AddressInfo{},
+		peers:     map[string]*Peer{},
+		byStream:  map[int]map[string]*Peer{},
+		inv:       map[int]map[string]invObject{},
+		known:     map[string]int{},
+		scores:    map[string]score{},
+
+		recentlyExpired: map[string]time.Time{},
+		stem:            map[string]*stemObject{},
+		Bans:            &BanList{bans: map[string]*Ban{}},
+		ctx:             ctx,
+		cancel:          cancel,
 	}
 }
 
-// Start sets the node to begin listening for and serving messages
-// to/from other nodes in daemon mode.  This method does not block and
-// returns immediately.
-func (n *Node) Start() error {
-	ln, err := net.Listen("tcp", n.Addr)
+// Peers returns the node's current peer sessions.
+func (n *Node) Peers() []*Peer {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	peers := make([]*Peer, 0, len(n.peers))
+	for _, p := range n.peers {
+		peers = append(peers, p)
+	}
+	return peers
+}
+
+// InvSize returns the number of objects in the node's inventory.
+func (n *Node) InvSize() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	size := 0
+	for _, objs := range n.inv {
+		size += len(objs)
+	}
+	return size
+}
+
+// invObject is an encoded object message in the inventory.
+type invObject struct {
+	data    []byte
+	expires time.Time
+}
+
+// ErrDuplicate is returned when adding an object the node already has.
+var ErrDuplicate = errors.New("p2p: object already known")
+
+// AddObject adds the object message m to the node's inventory so that it
+// is advertised to and can be fetched by peers in its stream until it
+// expires.  Objects for streams the node isn't in and expired objects are
+// refused, and ErrDuplicate is returned for objects already in the
+// inventory or the stem phase.
+func (n *Node) AddObject(m *msg.Msg) error {
+	stream, expires, err := n.checkObject(m)
 	if err != nil {
 		return err
 	}
+	hash := fmt.Sprintf("%x", invHash(m.Payload()))
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.expired(hash, expires) {
+		return ErrExpired
+	} else if _, ok := n.inv[stream][hash]; ok {
+		return ErrDuplicate
+	} else if _, ok := n.stem[hash]; ok {
+		// added once it is fluffed
+		return ErrDuplicate
+	}
+	return n.addObject(hash, stream, invObject{m.Encode(), expires})
+}
 
-	go func() {
-		for {
-			conn, err := ln.Accept()
-			if err != nil {
-				continue
-			}
-			go n.handleConn(conn)
-		}
-	}()
+// checkObject returns the stream and expiry of the object m, or an error if
+// the node isn't in its stream.
+func (n *Node) checkObject(m *msg.Msg) (int, time.Time, error) {
+	stream, err := ObjectStream(m.Cmd(), m.Payload())
+	if err != nil {
+		return 0, time.Time{}, err
+	} else if !n.inStream(stream) {
+		return 0, time.Time{}, fmt.Errorf("p2p: not in stream %v", stream)
+	}
+	expires, err := ObjectExpiry(m.Cmd(), m.Payload())
+	return stream, expires, err
+}
 
-	go func() {
-		for {
-			addr := <-n.verOut
-			n.versionExchange(addr)
-		}
-	}()
+// addObject adds obj to the inventory unless it is already there.  The
+// caller must hold n.mu.
+func (n *Node) addObject(hash string, stream int, obj invObject) error {
+	if _, ok := n.inv[stream][hash]; ok {
+		return nil
+	}
+	if n.inv[stream] == nil {
+		n.inv[stream] = map[string]invObject{}
+	}
+	n.inv[stream][hash] = obj
+	return n.invFile.add(obj.data)
+}
 
-	go func() {
-		for {
-			req := <-n.objectsOut
-			n.broadcastObj(req)
+// object returns the encoded object with the hex inventory hash from any
+// of streams.
+func (n *Node) object(hash string, streams []int) ([]byte, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, s := range streams {
+		if obj, ok := n.inv[s][hash]; ok {
+			return obj.data, true
 		}
-	}()
+	}
+	return nil, false
+}
 
-	return nil
+// invHash returns the inventory vector identifying an object payload.
+func invHash(data []byte) []byte {
+	h := msg.Hash.New()
+	h.Write(data)
+	sum := h.Sum(nil)
+	h.Reset()
+	h.Write(sum)
+	return h.Sum(nil)[:32]
 }
 
-func (n *Node) handleConn(conn net.Conn) {
-	defer func() {
-		if r := recover(); r != nil {
-			n.Log.Print(r)
+func orDefault(d, def time.Duration) time.Duration {
+	if d <= 0 {
+		return def
+	}
+	return d
+}
+
+func (n *Node) peer(addr string) *Peer {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.peers[addr]
+}
+
+// addPeer registers p unless there is already a session with its address,
+// in which case the existing peer is returned.
+func (n *Node) addPeer(p *Peer) (existing *Peer, err error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.stopping {
+		return nil, ErrStopped
+	} else if other := n.peers[p.Addr]; other != nil {
+		return other, nil
+	}
+	n.peers[p.Addr] = p
+	for _, s := range p.streams {
+		if n.byStream[s] == nil {
+			n.byStream[s] = map[string]*Peer{}
 		}
+		n.byStream[s][p.Addr] = p
+	}
+	return nil, nil
+}
+
+// spawn runs f in a goroutine that Stop waits for.  It returns false
+// without running f if the node is stopping.
+func (n *Node) spawn(f func()) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.stopping {
+		return false
+	}
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		f()
 	}()
+	return true
+}
 
-	defer conn.Close()
+func (n *Node) removePeer(p *Peer) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.peers[p.Addr] == p {
+		delete(n.peers, p.Addr)
+		for _, s := range p.streams {
+			delete(n.byStream[s], p.Addr)
+		}
+	}
+}
 
-	m := msg.Must(msg.Decode(conn))
-	n.Log.Printf("Received msg type %v", m.Cmd())
+// Start sets the node to begin listening for and serving messages
+// to/from other nodes in daemon mode.  This method does not block and
+// returns immediately.
+func (n *Node) Start() error {
+	n.mu.Lock()
+	stopping, started := n.stopping, n.ln != nil
+	n.mu.Unlock()
+	if stopping {
+		return ErrStopped
+	} else if started {
+		return errors.New("p2p: node already started")
+	}
 
-	switch m.Cmd() {
-	case msg.Cversion:
-		n.versionSequence(m, conn)
-	case msg.Cgetdata:
-		n.respondGetData(m, conn)
-	case msg.CgetpubKey, msg.Cpubkey, msg.Cmsg, msg.Cbroadcast:
-		n.ObjectsIn <- m
-	default:
-		n.Log.Printf("Received unsupported communication %v", m.Cmd())
+	ln, err := net.Listen("tcp", n.Addr)
+	if err != nil {
+		return err
 	}
+	n.mu.Lock()
+	n.ln = ln
+	n.mu.Unlock()
+	if !n.spawn(func() { n.accept(ln) }) || !n.spawn(n.cleaner) {
+		ln.Close()
+		return ErrStopped
+	}
+	return nil
 }
 
-// VersionExchanges initiates and performs a version exchange sequence with
-// the node at addr.
-func (n *Node) VersionExchange(addr *payload.AddressInfo) {
-	n.verOut <- addr
+// accept serves incoming connections until the listener is closed.
+func (n *Node) accept(ln net.Listener) {
+	delay := time.Duration(0)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if n.ctx.Err() != nil {
+				return
+			}
+			// back off on errors such as running out of file descriptors
+			if delay = 2*delay + 5*time.Millisecond; delay > time.Second {
+				delay = time.Second
+			}
+			n.Log.Error("accept failed", "retry", delay, "err", err)
+			select {
+			case <-time.After(delay):
+			case <-n.ctx.Done():
+				return
+			}
+			continue
+		}
+		delay = 0
+		if n.banned(conn.RemoteAddr().String()) {
+			conn.Close()
+			continue
+		}
+		if !n.spawn(func() { n.handleConn(conn) }) {
+			conn.Close()
+		}
+	}
 }
 
-func (n *Node) versionExchange(addr *payload.AddressInfo) {
-	resp := &VerDat{}
-	defer func() { n.VerIn <- resp }()
-	defer func() {
-		if r := recover(); r != nil {
-			resp.Err = fmt.Errorf("[ERR] version exchange did not complete (%v)", r)
-			n.Log.Print(resp.Err)
-		}
-	}()
+// Stop shuts the node down: it stops accepting connections, closes every
+// peer session and waits for all of the node's goroutines to exit, or for
+// ctx to be done.  Once they have exited, ObjectsIn is closed.  The
+// inventory file is closed either way.  A stopped node can't be restarted.
+func (n *Node) Stop(ctx context.Context) error {
+	n.mu.Lock()
+	if n.stopping {
+		n.mu.Unlock()
+		return ErrStopped
+	}
+	n.stopping = true
+	ln := n.ln
+	peers := make([]*Peer, 0, len(n.peers))
+	for _, p := range n.peers {
+		peers = append(peers, p)
+	}
+	n.mu.Unlock()
 
-	n.Log.Printf("[INFO] version exchange with %v", addr.Addr())
-	conn, err := net.DialTimeout("tcp", addr.Addr(), defaultTimeout)
-	if err != nil {
-		panic(err)
+	n.cancel()
+	if ln != nil {
+		ln.Close()
+	}
+	for _, p := range peers {
+		p.Close()
 	}
-	defer conn.Close()
 
-	n.verOutVerackIn(conn, addr, payload.ProtocolVersion)
+	done := make(chan struct{})
+	go func() {
+		n.wg.Wait()
+		close(done)
+	}()
+	var err error
+	select {
+	case <-done:
+		close(n.ObjectsIn)
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	// goroutines still running find no file and stop recording objects
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if cerr := n.invFile.close(); err == nil {
+		err = cerr
+	}
+	n.invFile = nil
+	return err
+}
 
-	// wait for version message and send verack
-	m := msg.Must(msg.ReadKind(conn, msg.Cversion))
-	resp.Ver, err = payload.VersionDecode(m.Payload())
+func (n *Node) handleConn(conn net.Conn) {
+	ctx, cancel := context.WithTimeout(n.ctx, orDefault(n.HandshakeTimeout, defaultHandshakeTimeout))
+	p, err := n.handshake(ctx, conn, "")
+	cancel()
 	if err != nil {
-		panic(err)
+		n.Log.Info("inbound handshake failed", "peer", conn.RemoteAddr().String(), "err", err)
+		conn.Close()
+		countDecodeError(err)
+		if pts := penalty(err); pts > 0 {
+			host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+			n.misbehaving(host, pts, err.Error())
+		}
+		return
 	}
-	if _, err := conn.Write(msg.New(msg.Cverack, []byte{}).Encode()); err != nil {
-		panic(err)
+	if q, err := n.start(p); err == nil && q == p {
+		p.run()
 	}
+}
 
-	n.sendInvAndAddr(conn, resp.Ver.Protocol())
+// Handshake connects to the node at addr (an IPv4 host:port, or a host name
+// if the Dialer is a Proxy resolving names) and performs a version
+// handshake, returning the resulting peer session.  If a session with addr
+// already exists, it is returned instead.
+func (n *Node) Handshake(ctx context.Context, addr string) (*Peer, error) {
+	if p := n.peer(addr); p != nil {
+		return p, nil
+	}
 
-	// wait for addr and inv messages
-	m = msg.Must(msg.ReadKind(conn, msg.Caddr))
-	resp.Peers, err = payload.AddrDecode(resp.Ver.Protocol(), m.Payload())
-	if err != nil {
-		panic(err)
+	if _, err := addrInfo(addr, n.addrStream(addr), n.remoteNames()); err != nil {
+		return nil, fmt.Errorf("p2p: handshake with %v failed (%w)", addr, err)
+	} else if n.banned(addr) {
+		return nil, fmt.Errorf("p2p: handshake with %v failed (%w)", addr, ErrBanned)
 	}
 
-	m = msg.Must(msg.ReadKind(conn, msg.Cinv))
-	resp.Inv, err = payload.InventoryDecode(resp.Ver.Protocol(), m.Payload())
+	// abandon the handshake if the node stops
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer context.AfterFunc(n.ctx, cancel)()
+
+	n.Log.Debug("starting handshake", "peer", addr)
+	conn, err := n.dial(ctx, addr)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("p2p: handshake with %v failed (%w)", addr, err)
 	}
+	p, err := n.handshake(ctx, conn, addr)
+	if err != nil {
+		conn.Close()
+		countDecodeError(err)
+		if pts := penalty(err); pts > 0 {
+			host, _, _ := net.SplitHostPort(addr)
+			n.misbehaving(host, pts, err.Error())
+		}
+		return nil, fmt.Errorf("p2p: handshake with %v failed (%w)", addr, err)
+	}
+	if q, err := n.start(p); err != nil {
+		return nil, err
+	} else if q != p {
+		return q, nil
+	} else if !n.spawn(p.run) {
+		p.Close()
+		return nil, ErrStopped
+	}
+	n.Log.Info("handshake successful", "peer", addr)
+	return p, nil
+}
 
-	n.Log.Printf("[INFO] version exchange with %v successful", addr.Addr())
+// start registers the new session p and returns it, or closes it and
+// returns the existing session with the same address.
+func (n *Node) start(p *Peer) (*Peer, error) {
+	q, err := n.addPeer(p)
+	if err != nil || q != nil {
+		p.conn.Close()
+		return q, err
+	}
+	n.learn(p.Addrs)
+	if n.OnPeer != nil {
+		n.OnPeer(p)
+	}
+	if n.OnInv != nil && len(p.Inv) > 0 {
+		n.OnInv(p, p.Inv)
+	}
+	return p, nil
 }
 
-func (n *Node) versionSequence(m *msg.Msg, conn net.Conn) {
-	resp := &VerDat{}
+// handshake performs the version handshake on conn, giving up when ctx is
+// done.  An empty addr means the connection is inbound and the remote side
+// speaks first.
+func (n *Node) handshake(ctx context.Context, conn net.Conn, addr string) (p *Peer, err error) {
+	start := time.Now()
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
 	defer func() {
-		if r := recover(); r != nil {
-			resp.Err = fmt.Errorf("[ERR] version sequence did not complete (%v)", r)
-			n.Log.Print(resp.Err)
+		stop()
+		conn.SetDeadline(time.Time{})
+		if err != nil && ctx.Err() != nil {
+			err = ctx.Err()
+		} else if err == nil {
+			handshakeSeconds.Observe(time.Since(start).Seconds())
 		}
 	}()
 
-	var err error
-	n.Log.Printf("[INFO] version sequence with %v", conn.RemoteAddr())
-
-	resp.Ver, err = payload.VersionDecode(m.Payload())
-	if err != nil {
-		panic(err)
+	p = newPeer(n, conn, addr)
+	verack := msg.New(msg.Cverack, []byte{})
+	if p.Inbound {
+		// send our version even without a common stream so the remote
+		// node can tell why it's dropped
+		if p.Ver, err = readVersion(p); err != nil {
+			return nil, err
+		} else if err := p.write(verack.Encode()); err != nil {
+			return nil, err
+		} else if err := n.sendVersion(p, p.Ver.FromAddr, p.Ver.Protocol()); err != nil {
+			return nil, err
+		} else if err := n.joinStreams(p); err != nil {
+			return nil, err
+		} else if _, err := p.readKind(msg.Cverack); err != nil {
+			return nil, err
+		}
+		host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		p.Addr = net.JoinHostPort(host, strconv.Itoa(p.Ver.FromAddr.Port))
+	} else {
+		to, err := addrInfo(addr, n.addrStream(addr), n.remoteNames())
+		if err != nil {
+			return nil, err
+		} else if err := n.sendVersion(p, to, payload.ProtocolVersion); err != nil {
+			return nil, err
+		} else if _, err := p.readKind(msg.Cverack); err != nil {
+			return nil, err
+		} else if p.Ver, err = readVersion(p); err != nil {
+			return nil, err
+		} else if err := n.joinStreams(p); err != nil {
+			return nil, err
+		} else if err := p.write(verack.Encode()); err != nil {
+			return nil, err
+		}
 	}
-	defer func() { n.VerIn <- resp }()
 
-	if _, err := conn.Write(msg.New(msg.Cverack, []byte{}).Encode()); err != nil {
-		panic(err)
+	proto := p.Ver.Protocol()
+	if err := n.sendInvAndAddr(p, proto); err != nil {
+		return nil, err
 	}
 
-	n.verOutVerackIn(conn, resp.Ver.FromAddr, resp.Ver.Protocol())
-	n.sendInvAndAddr(conn, resp.Ver.Protocol())
-
-	// wait for addr and inv messages
-	m = msg.Must(msg.ReadKind(conn, msg.Caddr))
-	resp.Peers, err = payload.AddrDecode(resp.Ver.Protocol(), m.Payload())
+	m, err := p.readKind(msg.Caddr)
 	if err != nil {
-		panic(err)
+		return nil, err
+	} else if p.Addrs, err = payload.AddrDecode(proto, m.Payload()); err != nil {
+		return nil, malformedError{err}
+	} else if len(p.Addrs) > maxAddrEntries {
+		return nil, malformedError{fmt.Errorf("p2p: %v addr entries", len(p.Addrs))}
 	}
 
-	m = msg.Must(msg.ReadKind(conn, msg.Cinv))
-	resp.Inv, err = payload.InventoryDecode(resp.Ver.Protocol(), m.Payload())
+	m, err = p.readKind(msg.Cinv)
 	if err != nil {
-		panic(err)
+		return nil, err
+	} else if p.Inv, err = payload.InventoryDecode(proto, m.Payload()); err != nil {
+		return nil, malformedError{err}
 	}
-	n.Log.Printf("[INFO] version sequence with %v successful", conn.RemoteAddr())
+	return p, nil
 }
 
-func (n *Node) sendInvAndAddr(conn net.Conn, proto uint32) {
-	pay, err := payload.AddrEncode(proto, n.MyPeers...)
+func readVersion(p *Peer) (*payload.Version, error) {
+	m, err := p.readKind(msg.Cversion)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	am := msg.New(msg.Caddr, pay)
-	if _, err := conn.Write(am.Encode()); err != nil {
-		panic(err)
-	}
-
-	pay, err = payload.InventoryEncode(proto, n.invList())
+	ver, err := payload.VersionDecode(m.Payload())
 	if err != nil {
-		panic(err)
+		return nil, malformedError{err}
 	}
-	im := msg.New(msg.Cinv, pay)
-	if _, err := conn.Write(im.Encode()); err != nil {
-		panic(err)
+	return ver, nil
+}
+
+// joinStreams sets the streams p shares with n, failing if there are none.
+func (n *Node) joinStreams(p *Peer) error {
+	if p.streams = n.commonStreams(p.Ver.Streams); len(p.streams) == 0 {
+		return fmt.Errorf("%w (peer streams %v)", ErrNoCommonStream, p.Ver.Streams)
 	}
+	return nil
 }
 
-func (n *Node) verOutVerackIn(conn net.Conn, to *payload.AddressInfo, proto uint32) {
+func (n *Node) sendVersion(p *Peer, to *payload.AddressInfo, proto uint32) error {
 	vcopy := *n.MyVer
 	vcopy.Timestamp = time.Now()
 	vcopy.ToAddr = to
 	pay, err := vcopy.Encode(proto)
 	if err != nil {
-		panic(err)
-	}
-	m := msg.New(msg.Cversion, pay)
-	if _, err := conn.Write(m.Encode()); err != nil {
-		panic(err)
+		return err
 	}
-	msg.Must(msg.ReadKind(conn, msg.Cverack))
+	return p.write(msg.New(msg.Cversion, pay).Encode())
 }
 
-type broadcastReq struct {
-	m *msg.Msg
-	peers []*payload.Version
-}
+func (n *Node) sendInvAndAddr(p *Peer, proto uint32) error {
+	pay, err := payload.AddrEncode(proto, n.gossip(p.streams)...)
+	if err != nil {
+		return err
+	} else if err := p.write(msg.New(msg.Caddr, pay).Encode()); err != nil {
+		return err
+	}
 
-func (n *Node) Broadcast(m *msg.Msg, peers ...*payload.Version) {
-	n.objectsOut <- broadcastReq{m, peers}
+	return sendInv(p, proto, n.invList(p.streams))
 }
 
-func (n *Node) broadcastObj(req broadcastReq) {
-	for _, p := range req.peers {
-		conn, err := net.DialTimeout("tcp", p.FromAddr.Addr(), defaultTimeout)
-		if err != nil {
+// Broadcast sends the object message m to peers, or to every peer if none
+// are given, skipping peers that aren't in its stream.  It returns the
+// number of peers m was sent to.
+func (n *Node) Broadcast(m *msg.Msg, peers ...*Peer) int {
+	stream, err := ObjectStream(m.Cmd(), m.Payload())
+	if err != nil {
+		n.Log.Error("not broadcasting object", "cmd", m.Cmd(), "err", err)
+		return 0
+	}
+	if len(peers) == 0 {
+		peers = n.StreamPeers(stream)
+	}
+	sent := 0
+	for _, p := range peers {
+		if !p.InStream(stream) {
+			continue
+		} else if err := p.Send(m); err != nil {
+			n.Log.Warn("send failed", "peer", p.Addr, "cmd", m.Cmd(), "err", err)
 			continue
 		}
-		conn.Write(req.m.Encode())
-		conn.Close()
+		objectCount.Inc("relayed")
+		sent++
 	}
+	return sent
 }
 
-func (n *Node) respondGetData(m *msg.Msg, conn net.Conn) {
-	hashes, err := payload.GetDataDecode(payload.ProtocolVersion, m.Payload())
+func (n *Node) respondGetData(p *Peer, m *msg.Msg) {
+	hashes, err := payload.GetDataDecode(p.Ver.Protocol(), m.Payload())
 	if err != nil {
-		n.Log.Printf("[ERR] failed to decode getdata payload from %v (%v)", conn.RemoteAddr(), err)
+		n.Log.Warn("failed to decode payload", "peer", p.Addr, "cmd", m.Cmd(), "err", err)
+		decodeErrors.Inc("payload")
+		p.Misbehaving(PenaltyMalformed, "malformed getdata")
+		return
+	} else if len(hashes) > maxInvEntries {
+		p.Misbehaving(PenaltyFlood, fmt.Sprintf("getdata for %v objects", len(hashes)))
 		return
 	}
 
+	sent := 0
 	for _, sum := range hashes {
-		s := fmt.Sprint("%x", sum)
-		if data, ok := n.MyInv[s]; ok {
-			if _, err := conn.Write(data); err != nil {
-				n.Log.Printf("[ERR] failed to send all requested objects to %v (%v)", conn.RemoteAddr(), err)
-				break
-			}
-		} else {
-			n.Log.Printf("[ERR] %v requested object we don't have", conn.RemoteAddr())
+		s := fmt.Sprintf("%x", sum)
+		data, ok := n.object(s, p.streams)
+		if !ok {
+			data, ok = n.stemData(s, p)
 		}
+		if !ok {
+			n.Log.Debug("requested object not in inventory", "peer", p.Addr, "hash", s)
+			continue
+		} else if err := p.writeLimited(data); err != nil {
+			n.Log.Warn("failed to send requested objects", "peer", p.Addr, "err", err)
+			return
+		}
+		objectCount.Inc("relayed")
+		sent++
 	}
-	n.Log.Printf("[INFO] sent %v requested objects to %v", len(hashes), conn.RemoteAddr())
+	n.Log.Debug("sent requested objects", "peer", p.Addr, "count", sent)
 }
 
-// GetData retrieves requests objects with the specified hashes from the
-// peer node that sent us ver.  It returns the number of objects
-// successfully received and an error if n < len(hashes).
-func (nd *Node) GetData(ver *payload.Version, hashes [][]byte) (n int, err error) {
-	conn, err := net.DialTimeout("tcp", ver.FromAddr.Addr(), defaultTimeout)
-	if err != nil {
-		return n, err
+// GetData requests the objects with the specified inventory hashes from p
+// and waits for them to arrive.  Hashes of recently expired objects are
+// skipped.  It returns the objects received, along with an error if ctx is
+// done or the session ends before all of them do.
+func (n *Node) GetData(ctx context.Context, p *Peer, hashes [][]byte) ([]*msg.Msg, error) {
+	want := map[string]bool{}
+	var fetch [][]byte
+	for _, h := range hashes {
+		if !n.Expired(h) {
+			want[fmt.Sprintf("%x", h)] = true
+			fetch = append(fetch, h)
+		}
 	}
-	defer conn.Close()
-	pay, err := payload.GetDataEncode(ver.Protocol(), hashes)
+	if len(fetch) == 0 {
+		return nil, nil
+	}
+	objs := make(chan *msg.Msg, len(want))
+	p.await(want, objs)
+	defer p.unawait(want, objs)
+
+	pay, err := payload.GetDataEncode(p.Ver.Protocol(), fetch)
 	if err != nil {
-		panic(err)
+		return nil, err
+	} else if err := p.Send(msg.New(msg.Cgetdata, pay)); err != nil {
+		return nil, err
 	}
-	m := msg.New(msg.Cgetdata, pay)
-	conn.Write(m.Encode())
 
-	for i := 0; i < len(hashes); i++ {
-		m, err := msg.Decode(conn)
-		if err != nil {
-			return n, err
-		}
-		switch m.Cmd() {
-		case msg.Cversion, msg.Cverack, msg.Caddr, msg.Cinv, msg.Cgetdata:
-			return n, fmt.Errorf("getdata resp contains invalid msg type %v", m.Cmd())
+	var got []*msg.Msg
+	for len(got) < len(want) {
+		select {
+		case m := <-objs:
+			got = append(got, m)
+		case <-ctx.Done():
+			return got, ctx.Err()
+		case <-p.Done():
+			return got, fmt.Errorf("p2p: getdata from %v failed (%v)", p.Addr, p.Err())
 		}
-		nd.ObjectsIn <- m
-		n++
 	}
-	return n, nil
+	return got, nil
 }
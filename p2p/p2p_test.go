@@ -1,12 +1,20 @@
 package p2p
 
 import (
-	"log"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
 	"net"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/rwcarlsen/gobitmsg/msg"
+	"github.com/rwcarlsen/gobitmsg/payload"
 )
 
 type RecvHandler struct{}
@@ -19,24 +27,238 @@ func (h *RecvHandler) Handle(conn net.Conn) {
 	conn.Write(m.Encode())
 }
 
-func TestVersionExchange(t *testing.T) {
-	lg1 := log.New(os.Stdout, "node1: ", log.LstdFlags)
+func stop(t *testing.T, n *Node) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := n.Stop(ctx); err != nil {
+		t.Errorf("stopping %v failed: %v", n.Addr, err)
+	}
+}
+
+// object returns a stream 1 object message with a payload carrying minimal
+// proof of work.
+func object(cmd msg.Command, data string) *msg.Msg {
+	return streamObject(cmd, 1, data)
+}
+
+// streamObject is like object for any stream.
+func streamObject(cmd msg.Command, stream int, data string) *msg.Msg {
+	return timedObject(cmd, stream, time.Now(), data)
+}
+
+// timedObject is like streamObject with the given object time.
+func timedObject(cmd msg.Command, stream int, t time.Time, data string) *msg.Msg {
+	body := binary.BigEndian.AppendUint64(nil, uint64(t.Unix()))
+	if cmd != msg.Cmsg {
+		body = append(body, 4) // address or broadcast version
+	}
+	body = append(append(body, byte(stream)), data...)
+	nonce := payload.DoPOW(1, 1, body)
+	return msg.New(cmd, append(binary.BigEndian.AppendUint64(nil, nonce), body...))
+}
+
+func TestHandshake(t *testing.T) {
+	lg1 := testLog("node1")
 	node1 := NewNode("127.0.0.1", 22334, lg1)
 	if err := node1.Start(); err != nil {
 		t.Fatalf("node1 failed to start: %v", err)
 	}
+	defer stop(t, node1)
+	node1.TrialsPerByte, node1.ExtraBytes = 1, 1
+	obj := object(msg.Cmsg, "an object")
+	node1.AddObject(obj)
 
-	lg2 := log.New(os.Stdout, "node2: ", log.LstdFlags)
+	lg2 := testLog("node2")
 	node2 := NewNode("127.0.0.1", 22335, lg2)
+	node2.TrialsPerByte, node2.ExtraBytes = 1, 1
 	if err := node2.Start(); err != nil {
 		t.Fatalf("node2 failed to start: %v", err)
 	}
+	defer stop(t, node2)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	peer, err := node2.Handshake(ctx, node1.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("response version: %+v", peer.Ver)
+	if peer.Ver.UserAgent != node1.MyVer.UserAgent || len(peer.Inv) != 1 {
+		t.Fatalf("unexpected handshake result: %+v", peer)
+	}
+	if again, err := node2.Handshake(ctx, node1.Addr); err != nil || again != peer {
+		t.Errorf("expected the existing session, got %v, %v", again, err)
+	}
+
+	objs, err := node2.GetData(ctx, peer, peer.Inv)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(objs) != 1 || !bytes.Equal(objs[0].Encode(), obj.Encode()) {
+		t.Errorf("getdata returned wrong objects: %v", objs)
+	}
+
+	// objects pushed outside of a getdata go to ObjectsIn
+	pushed := object(msg.Cbroadcast, "pushed")
+	if n := node2.Broadcast(pushed); n != 1 {
+		t.Fatalf("expected broadcast to reach 1 peer, got %v", n)
+	}
+	select {
+	case m := <-node1.ObjectsIn:
+		if !bytes.Equal(m.Payload(), pushed.Payload()) {
+			t.Errorf("received wrong object %q", m.Payload())
+		}
+	case <-ctx.Done():
+		t.Fatal("broadcast object never arrived")
+	}
+
+	if peers := node1.Peers(); len(peers) != 1 || !peers[0].Inbound || peers[0].Addr != node2.Addr {
+		t.Errorf("expected node1 to have node2 as an inbound peer, got %v", peers)
+	}
+
+	peer.Close()
+	if !errors.Is(peer.Err(), ErrPeerClosed) || len(node2.Peers()) != 0 {
+		t.Errorf("peer not removed after close (err %v)", peer.Err())
+	}
+	if _, err := node2.GetData(ctx, peer, peer.Inv); err == nil {
+		t.Error("expected getdata on a closed session to fail")
+	}
+}
+
+func TestHandshakeCancel(t *testing.T) {
+	// a listener that accepts connections but never speaks
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
 
-	ver := *node1.MyVer
-	ver.ToAddr = node2.MyVer.FromAddr
+	node := NewNode("127.0.0.1", 22337, testLog("node"))
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := node.Handshake(ctx, ln.Addr().String()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the handshake to time out, got %v", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("handshake took %v to give up", d)
+	}
+}
+
+func TestStop(t *testing.T) {
+	lg := testLog("node")
+	for i := 0; i < 3; i++ {
+		srv := NewNode("127.0.0.1", 22338, lg)
+		if err := srv.Start(); err != nil {
+			t.Fatalf("start %v failed: %v", i, err)
+		}
+		client := NewNode("127.0.0.1", 22339, lg)
+		peer, err := client.Handshake(context.Background(), srv.Addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		stop(t, srv)
+		select {
+		case <-peer.Done():
+		case <-time.After(5 * time.Second):
+			t.Fatal("client session not ended by server shutdown")
+		}
+		if _, ok := <-srv.ObjectsIn; ok {
+			t.Error("expected ObjectsIn to be closed")
+		}
+		if err := srv.Start(); err != ErrStopped {
+			t.Errorf("expected ErrStopped restarting a stopped node, got %v", err)
+		}
+		stop(t, client)
+	}
+}
+
+func TestStopTimeout(t *testing.T) {
+	node := NewNode("127.0.0.1", 22362, testLog("node"))
+	if err := node.OpenInventory(filepath.Join(t.TempDir(), "objects.dat")); err != nil {
+		t.Fatal(err)
+	} else if err := node.Start(); err != nil {
+		t.Fatal(err)
+	}
+	stuck := make(chan struct{})
+	defer close(stuck)
+	node.spawn(func() { <-stuck })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := node.Stop(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected the stop to time out, got %v", err)
+	}
+	node.mu.Lock()
+	defer node.mu.Unlock()
+	if node.invFile != nil {
+		t.Error("inventory file left open")
+	}
+}
+
+func TestTimeouts(t *testing.T) {
+	lg := testLog("node")
+	node1 := NewNode("127.0.0.1", 22342, lg)
+	node1.HandshakeTimeout = 100 * time.Millisecond
+	node1.IdleTimeout = 300 * time.Millisecond
+	if err := node1.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer stop(t, node1)
+
+	// a connection that never starts a handshake is dropped
+	conn, err := net.Dial("tcp", node1.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected the silent connection to be closed, got %v", err)
+	}
+	conn.Close()
 
-	node1.VersionExchange(node2.MyVer.FromAddr)
-	resp := <-node1.VerIn
+	// pings keep a quiet but responsive session alive
+	node2 := NewNode("127.0.0.1", 22343, lg)
+	node2.IdleTimeout = 300 * time.Millisecond
+	defer stop(t, node2)
+	peer, err := node2.Handshake(context.Background(), node1.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Second)
+	if err := peer.Err(); err != nil || len(node1.Peers()) != 1 {
+		t.Fatalf("idle session was dropped (%v)", err)
+	}
+
+	// a peer that completes the handshake and then goes silent is dropped
+	node3 := NewNode("127.0.0.1", 22344, lg)
+	conn, err = net.Dial("tcp", node1.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := node3.handshake(context.Background(), conn, node1.Addr); err != nil {
+		t.Fatal(err)
+	}
+	if len(node1.Peers()) != 2 {
+		t.Fatalf("expected 2 peers after the silent handshake, got %v", len(node1.Peers()))
+	}
+	time.Sleep(time.Second)
+	if peers := node1.Peers(); len(peers) != 1 || peers[0].Addr != node2.Addr {
+		t.Errorf("expected only node2 to remain, got %v", peers)
+	}
+}
 
-	t.Logf("response version: %+v", resp.Ver)
+func testLog(name string) *slog.Logger {
+	h := slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug})
+	return slog.New(h).With("node", name)
 }
@@ -0,0 +1,340 @@
+package p2p
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rwcarlsen/gobitmsg/msg"
+	"github.com/rwcarlsen/gobitmsg/payload"
+)
+
+// ErrPeerClosed is the Err of a peer session closed with Close.
+var ErrPeerClosed = errors.New("p2p: peer session closed")
+
+// Peer is a session with a remote node that has completed a version
+// handshake.  Objects the peer pushes to us are delivered on the node's
+// ObjectsIn channel.
+type Peer struct {
+	// Addr is the host:port the peer listens on.
+	Addr string
+	// Ver is the version message the peer sent.
+	Ver *payload.Version
+	// Addrs and Inv are the addresses and inventory the peer advertised
+	// during the handshake.
+	Addrs []*payload.AddressInfo
+	Inv   [][]byte
+	// Inbound is true if the peer connected to us.
+	Inbound bool
+
+	node     *Node
+	streams  []int // shared with node
+	conn     net.Conn
+	r        *bufio.Reader
+	wmu      sync.Mutex
+	lastRecv atomic.Int64
+	traffic  traffic
+	up, down *bucket
+
+	mu      sync.Mutex
+	waiting map[string]chan<- *msg.Msg
+
+	once sync.Once
+	done chan struct{}
+	err  error
+}
+
+func newPeer(n *Node, conn net.Conn, addr string) *Peer {
+	p := &Peer{
+		Addr:    addr,
+		Inbound: addr == "",
+		node:    n,
+		conn:    conn,
+		r:       bufio.NewReader(conn),
+		waiting: map[string]chan<- *msg.Msg{},
+		done:    make(chan struct{}),
+		up:      newBucket(n.PeerUploadLimit),
+		down:    newBucket(n.PeerDownloadLimit),
+	}
+	p.lastRecv.Store(time.Now().UnixNano())
+	return p
+}
+
+// Send writes m to the peer.  A failed write ends the session.  Objects
+// are subject to the node's upload limits.
+func (p *Peer) Send(m *msg.Msg) error {
+	if isObject(m.Cmd()) {
+		return p.writeLimited(m.Encode())
+	}
+	return p.write(m.Encode())
+}
+
+// writeLimited writes an encoded message once the upload limits allow it.
+func (p *Peer) writeLimited(data []byte) error {
+	up, _ := p.node.limits()
+	if !up.wait(p.done, len(data)) || !p.up.wait(p.done, len(data)) {
+		return p.Err()
+	}
+	return p.write(data)
+}
+
+func (p *Peer) write(data []byte) error {
+	p.wmu.Lock()
+	defer p.wmu.Unlock()
+	p.conn.SetWriteDeadline(time.Now().Add(orDefault(p.node.WriteTimeout, defaultWriteTimeout)))
+	_, err := p.conn.Write(data)
+	if err != nil {
+		p.close(err)
+		return err
+	}
+	cmd := headerCmd(data)
+	p.traffic.add(false, cmd, len(data))
+	p.node.traffic.add(false, cmd, len(data))
+	return nil
+}
+
+// readKind reads the next message, which must be of kind cmd.
+func (p *Peer) readKind(cmd msg.Command) (*msg.Msg, error) {
+	m, err := msg.ReadKind(p.r, cmd)
+	if err == nil {
+		p.count(m)
+	}
+	return m, err
+}
+
+func (p *Peer) count(m *msg.Msg) {
+	n := len(m.Payload()) + 24
+	p.traffic.add(true, m.Cmd(), n)
+	p.node.traffic.add(true, m.Cmd(), n)
+}
+
+// Close ends the session.
+func (p *Peer) Close() error {
+	p.close(ErrPeerClosed)
+	return nil
+}
+
+func (p *Peer) close(err error) {
+	p.once.Do(func() {
+		p.err = err
+		close(p.done)
+		p.conn.Close()
+		p.node.removePeer(p)
+	})
+}
+
+// Done returns a channel that is closed when the session ends.
+func (p *Peer) Done() <-chan struct{} {
+	return p.done
+}
+
+// Err returns the reason the session ended, or nil if it hasn't.
+func (p *Peer) Err() error {
+	select {
+	case <-p.done:
+		return p.err
+	default:
+		return nil
+	}
+}
+
+// run reads and handles messages from the peer until the session ends.
+func (p *Peer) run() {
+	idle := orDefault(p.node.IdleTimeout, defaultIdleTimeout)
+	p.node.spawn(func() { p.keepalive(idle) })
+	for {
+		m, err := p.read(idle)
+		if errors.Is(err, msg.ErrChecksum) {
+			// the whole message was read so the stream is still usable
+			countDecodeError(err)
+			p.Misbehaving(PenaltyChecksum, err.Error())
+			continue
+		} else if err != nil {
+			countDecodeError(err)
+			if pts := penalty(err); pts > 0 {
+				p.Misbehaving(pts, err.Error())
+			}
+			p.close(err)
+			p.node.Log.Info("session ended", "peer", p.Addr, "err", p.Err())
+			return
+		}
+		p.handle(m)
+	}
+}
+
+// read waits up to idle for the next message to start arriving and then up
+// to the node's read timeout for the rest of it.
+func (p *Peer) read(idle time.Duration) (*msg.Msg, error) {
+	p.conn.SetReadDeadline(time.Now().Add(idle))
+	if _, err := p.r.Peek(1); err != nil {
+		return nil, err
+	}
+	p.conn.SetReadDeadline(time.Now().Add(orDefault(p.node.ReadTimeout, defaultReadTimeout)))
+	m, err := msg.Decode(p.r)
+	if err != nil {
+		return nil, err
+	}
+	p.lastRecv.Store(time.Now().UnixNano())
+	p.count(m)
+
+	// hold off reading more until the download limits allow it
+	_, down := p.node.limits()
+	n := len(m.Payload()) + 24
+	if !down.wait(p.done, n) || !p.down.wait(p.done, n) {
+		return nil, p.Err()
+	}
+	return m, nil
+}
+
+// keepalive pings the peer once nothing has been received from it for half
+// of idle, giving it time to answer before the session times out.
+func (p *Peer) keepalive(idle time.Duration) {
+	t := time.NewTicker(idle / 4)
+	defer t.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-t.C:
+			last := time.Unix(0, p.lastRecv.Load())
+			if time.Since(last) >= idle/2 {
+				p.Send(msg.New(msg.Cping, []byte{}))
+			}
+		}
+	}
+}
+
+func (p *Peer) handle(m *msg.Msg) {
+	n := p.node
+	n.Log.Debug("received message", "peer", p.Addr, "cmd", m.Cmd())
+
+	switch m.Cmd() {
+	case msg.Cgetdata:
+		n.respondGetData(p, m)
+	case msg.Caddr:
+		addrs, err := payload.AddrDecode(p.Ver.Protocol(), m.Payload())
+		if err != nil {
+			n.Log.Warn("failed to decode payload", "peer", p.Addr, "cmd", m.Cmd(), "err", err)
+			decodeErrors.Inc("payload")
+			p.Misbehaving(PenaltyMalformed, "malformed addr")
+			return
+		} else if len(addrs) > maxAddrEntries {
+			p.Misbehaving(PenaltyFlood, fmt.Sprintf("addr with %v entries", len(addrs)))
+			return
+		}
+		n.learn(addrs)
+	case msg.Cinv:
+		hashes, err := payload.InventoryDecode(p.Ver.Protocol(), m.Payload())
+		if err != nil {
+			n.Log.Warn("failed to decode payload", "peer", p.Addr, "cmd", m.Cmd(), "err", err)
+			decodeErrors.Inc("payload")
+			p.Misbehaving(PenaltyMalformed, "malformed inv")
+			return
+		} else if len(hashes) > maxInvEntries {
+			p.Misbehaving(PenaltyFlood, fmt.Sprintf("inv with %v entries", len(hashes)))
+			return
+		}
+		n.Log.Debug("objects advertised", "peer", p.Addr, "count", len(hashes))
+		n.fluffed(hashes)
+		if n.OnInv != nil {
+			n.OnInv(p, hashes)
+		}
+	case msg.Cdinv:
+		hashes, err := payload.InventoryDecode(p.Ver.Protocol(), m.Payload())
+		if err != nil {
+			n.Log.Warn("failed to decode payload", "peer", p.Addr, "cmd", m.Cmd(), "err", err)
+			decodeErrors.Inc("payload")
+			p.Misbehaving(PenaltyMalformed, "malformed dinv")
+			return
+		} else if len(hashes) > maxInvEntries {
+			p.Misbehaving(PenaltyFlood, fmt.Sprintf("dinv with %v entries", len(hashes)))
+			return
+		}
+		n.stemAdvertised(p, hashes)
+	case msg.Cping:
+		p.Send(msg.New(msg.Cpong, []byte{}))
+	case msg.Cpong:
+		// only keeps the session alive
+	case msg.CgetpubKey, msg.Cpubkey, msg.Cmsg, msg.Cbroadcast, msg.Cobject:
+		if stream, err := ObjectStream(m.Cmd(), m.Payload()); err != nil {
+			decodeErrors.Inc("payload")
+			p.Misbehaving(PenaltyMalformed, err.Error())
+			return
+		} else if !p.InStream(stream) {
+			n.Log.Debug("dropping object from another stream", "peer", p.Addr, "cmd", m.Cmd(), "stream", stream)
+			return
+		} else if n.stale(m) {
+			n.Log.Debug("dropping expired object", "peer", p.Addr, "cmd", m.Cmd())
+			return
+		}
+		switch err := n.verifyObject(m); {
+		case errors.Is(err, payload.ErrInsufficientPOW):
+			objectCount.Inc("rejected")
+			p.Misbehaving(PenaltyPOW, fmt.Sprintf("%v with insufficient proof of work", m.Cmd()))
+			return
+		case errors.Is(err, payload.ErrBadSignature):
+			// peers relay objects before checking signatures, so an honest
+			// one may pass a forgery along
+			objectCount.Inc("rejected")
+			n.Log.Debug("dropping badly signed object", "peer", p.Addr, "cmd", m.Cmd())
+			return
+		case errors.Is(err, payload.ErrMalformed):
+			decodeErrors.Inc("payload")
+			p.Misbehaving(PenaltyMalformed, err.Error())
+			return
+		case err != nil:
+			// well formed but not something we handle, like newer pubkeys
+			objectCount.Inc("rejected")
+			n.Log.Debug("dropping unsupported object", "peer", p.Addr, "cmd", m.Cmd(), "err", err)
+			return
+		}
+		objectCount.Inc("received")
+		p.deliver(m)
+	default:
+		n.Log.Debug("unsupported message", "peer", p.Addr, "cmd", m.Cmd())
+	}
+}
+
+// deliver hands an object to the GetData call waiting for it, or to the
+// node's ObjectsIn channel if nothing is.
+func (p *Peer) deliver(m *msg.Msg) {
+	key := fmt.Sprintf("%x", invHash(m.Payload()))
+	p.node.Log.Debug("received object", "peer", p.Addr, "cmd", m.Cmd(), "hash", key)
+	p.mu.Lock()
+	ch, ok := p.waiting[key]
+	delete(p.waiting, key)
+	p.mu.Unlock()
+
+	if ok {
+		ch <- m
+		return
+	}
+	select {
+	case p.node.ObjectsIn <- m:
+	case <-p.done:
+	}
+}
+
+// await registers ch to receive the objects with the given hex encoded
+// inventory hashes.  ch must have room for all of them.
+func (p *Peer) await(hashes map[string]bool, ch chan<- *msg.Msg) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for h := range hashes {
+		p.waiting[h] = ch
+	}
+}
+
+func (p *Peer) unawait(hashes map[string]bool, ch chan<- *msg.Msg) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for h := range hashes {
+		if p.waiting[h] == ch {
+			delete(p.waiting, h)
+		}
+	}
+}
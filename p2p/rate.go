@@ -0,0 +1,156 @@
+package p2p
+
+import (
+	"bytes"
+	"sync"
+	"time"
+
+	"github.com/rwcarlsen/gobitmsg/msg"
+)
+
+// bucket is a token bucket limiting a byte rate.  Takes larger than the
+// bucket put it into debt, so messages of any size get through eventually.
+// A nil bucket doesn't limit anything.
+type bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// newBucket returns a bucket allowing rate bytes per second with bursts of
+// up to a second's worth, or nil if rate is not positive.
+func newBucket(rate int) *bucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &bucket{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// wait takes n bytes worth of tokens from b, blocking until the bucket is
+// out of debt or done is closed.  It reports whether the wait completed.
+func (b *bucket) wait(done <-chan struct{}, n int) bool {
+	if b == nil {
+		return true
+	}
+
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	delay := time.Duration(-b.tokens / b.rate * float64(time.Second))
+	b.mu.Unlock()
+
+	if delay <= 0 {
+		return true
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+// Counter counts messages and the bytes they took, headers included.
+type Counter struct {
+	Msgs  uint64 `json:"msgs"`
+	Bytes uint64 `json:"bytes"`
+}
+
+// Traffic holds the messages sent and received by a peer or node, in total
+// and by command.
+type Traffic struct {
+	In       Counter                 `json:"in"`
+	Out      Counter                 `json:"out"`
+	InByCmd  map[msg.Command]Counter `json:"inByCmd"`
+	OutByCmd map[msg.Command]Counter `json:"outByCmd"`
+}
+
+// traffic accumulates Traffic safely for concurrent use.
+type traffic struct {
+	mu sync.Mutex
+	t  Traffic
+}
+
+// cmdOther is the command unknown commands are counted under, so peers
+// can't add entries, or metric labels, of their choosing.
+const cmdOther msg.Command = "other"
+
+func (tr *traffic) add(in bool, cmd msg.Command, n int) {
+	switch cmd {
+	case msg.Cversion, msg.Cverack, msg.Caddr, msg.Cinv, msg.Cdinv, msg.Cgetdata,
+		msg.CgetpubKey, msg.Cpubkey, msg.Cmsg, msg.Cbroadcast, msg.Cobject, msg.Cping, msg.Cpong:
+	default:
+		cmd = cmdOther
+	}
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	total, byCmd := &tr.t.Out, &tr.t.OutByCmd
+	if in {
+		total, byCmd = &tr.t.In, &tr.t.InByCmd
+	}
+	if *byCmd == nil {
+		*byCmd = map[msg.Command]Counter{}
+	}
+	c := (*byCmd)[cmd]
+	c.Msgs++
+	c.Bytes += uint64(n)
+	(*byCmd)[cmd] = c
+	total.Msgs++
+	total.Bytes += uint64(n)
+}
+
+func (tr *traffic) snapshot() Traffic {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	t := Traffic{In: tr.t.In, Out: tr.t.Out, InByCmd: map[msg.Command]Counter{}, OutByCmd: map[msg.Command]Counter{}}
+	for cmd, c := range tr.t.InByCmd {
+		t.InByCmd[cmd] = c
+	}
+	for cmd, c := range tr.t.OutByCmd {
+		t.OutByCmd[cmd] = c
+	}
+	return t
+}
+
+// headerCmd returns the command of an encoded message.
+func headerCmd(data []byte) msg.Command {
+	if len(data) < 16 {
+		return ""
+	}
+	return msg.Command(bytes.TrimRight(data[4:16], "\x00"))
+}
+
+func isObject(cmd msg.Command) bool {
+	switch cmd {
+	case msg.CgetpubKey, msg.Cpubkey, msg.Cmsg, msg.Cbroadcast, msg.Cobject:
+		return true
+	}
+	return false
+}
+
+// Traffic returns the messages the node has sent and received.
+func (n *Node) Traffic() Traffic {
+	return n.traffic.snapshot()
+}
+
+// Traffic returns the messages sent to and received from the peer.
+func (p *Peer) Traffic() Traffic {
+	return p.traffic.snapshot()
+}
+
+// limits returns the node's global upload and download buckets.
+func (n *Node) limits() (up, down *bucket) {
+	n.limitOnce.Do(func() {
+		n.upLimit = newBucket(n.UploadLimit)
+		n.downLimit = newBucket(n.DownloadLimit)
+	})
+	return n.upLimit, n.downLimit
+}
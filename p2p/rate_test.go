@@ -0,0 +1,114 @@
+package p2p
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rwcarlsen/gobitmsg/metrics"
+	"github.com/rwcarlsen/gobitmsg/msg"
+)
+
+func TestBucket(t *testing.T) {
+	var b *bucket
+	if !b.wait(nil, 1e9) {
+		t.Fatal("nil bucket should never block")
+	}
+
+	b = newBucket(100000)
+	start := time.Now()
+	b.wait(nil, 100000) // the initial burst
+	if d := time.Since(start); d > 50*time.Millisecond {
+		t.Errorf("burst took %v", d)
+	}
+	b.wait(nil, 30000)
+	if d := time.Since(start); d < 250*time.Millisecond {
+		t.Errorf("expected the limit to delay 300ms, only took %v", d)
+	}
+
+	done := make(chan struct{})
+	close(done)
+	if b.wait(done, 1e6) {
+		t.Error("expected wait to give up when done is closed")
+	}
+}
+
+func TestRateLimits(t *testing.T) {
+	lg := testLog("node")
+	node1 := NewNode("127.0.0.1", 22347, lg)
+	node1.TrialsPerByte, node1.ExtraBytes = 1, 1
+	node1.PeerUploadLimit = 20000
+	if err := node1.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer stop(t, node1)
+
+	var hashes [][]byte
+	for i := 0; i < 3; i++ {
+		obj := object(msg.Cmsg, strings.Repeat("x", 10000)+string(rune('a'+i)))
+		node1.AddObject(obj)
+		hashes = append(hashes, invHash(obj.Payload()))
+	}
+
+	node2 := NewNode("127.0.0.1", 22348, lg)
+	node2.TrialsPerByte, node2.ExtraBytes = 1, 1
+	defer stop(t, node2)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	peer, err := node2.Handshake(ctx, node1.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// ~30KB of objects at 20KB/s with a 20KB burst takes about half a second
+	start := time.Now()
+	objs, err := node2.GetData(ctx, peer, hashes)
+	if err != nil || len(objs) != 3 {
+		t.Fatalf("getdata returned %v objects (%v)", len(objs), err)
+	}
+	if d := time.Since(start); d < 300*time.Millisecond {
+		t.Errorf("getdata replies were not throttled (took %v)", d)
+	}
+
+	tr := peer.Traffic()
+	if c := tr.InByCmd[msg.Cmsg]; c.Msgs != 3 || c.Bytes < 30000 {
+		t.Errorf("unexpected msg counter %+v", c)
+	}
+	if c := tr.OutByCmd[msg.Cgetdata]; c.Msgs != 1 {
+		t.Errorf("unexpected getdata counter %+v", c)
+	}
+	if c := tr.InByCmd[msg.Cversion]; c.Msgs != 1 {
+		t.Errorf("handshake messages not counted: %+v", tr.InByCmd)
+	}
+	if tr := node1.Traffic(); tr.OutByCmd[msg.Cmsg].Msgs != 3 {
+		t.Errorf("node totals not counted: %+v", tr.OutByCmd)
+	}
+
+	r := metrics.NewRegistry()
+	node2.RegisterMetrics(r)
+	var buf strings.Builder
+	r.WriteTo(&buf)
+	for _, line := range []string{
+		`bitmsg_messages_total{command="msg",direction="in"} 3`,
+		`bitmsg_peers{stream="1",direction="outbound"} 1`,
+		`bitmsg_inventory_objects 0`,
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("metrics missing %q:\n%v", line, buf.String())
+		}
+	}
+}
+
+func TestTrafficCommands(t *testing.T) {
+	var tr traffic
+	tr.add(true, msg.Cinv, 10)
+	tr.add(true, "\xffjunk", 20)
+	tr.add(true, "made-up", 30)
+	in := tr.snapshot().InByCmd
+	if len(in) != 2 || in[msg.Cinv].Msgs != 1 {
+		t.Errorf("unexpected counters %+v", in)
+	} else if c := in[cmdOther]; c.Msgs != 2 || c.Bytes != 50 {
+		t.Errorf("unknown commands counted as %+v", c)
+	}
+}
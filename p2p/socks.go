@@ -0,0 +1,220 @@
+package p2p
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	socksVersion = 0x05
+
+	socksAuthNone     = 0x00
+	socksAuthPassword = 0x02
+	socksAuthNoAccept = 0xFF
+
+	socksCmdConnect = 0x01
+
+	socksAtypIPv4   = 0x01
+	socksAtypDomain = 0x03
+	socksAtypIPv6   = 0x04
+)
+
+var socksReplies = map[byte]string{
+	0x01: "general SOCKS server failure",
+	0x02: "connection not allowed by ruleset",
+	0x03: "network unreachable",
+	0x04: "host unreachable",
+	0x05: "connection refused",
+	0x06: "TTL expired",
+	0x07: "command not supported",
+	0x08: "address type not supported",
+}
+
+// SOCKS5 is a Dialer that connects through a SOCKS5 proxy such as Tor
+// (RFC 1928), optionally authenticating with a username and password (RFC
+// 1929).
+type SOCKS5 struct {
+	// Addr is the host:port of the proxy server.
+	Addr     string
+	Username string
+	Password string
+	// RemoteDNS causes host names to be passed to the proxy for resolution
+	// instead of being resolved locally.  This should be set when using Tor
+	// so that lookups don't leak outside of the proxy.
+	RemoteDNS bool
+	// Timeout bounds connecting to the proxy and negotiating the
+	// connection.  Zero means defaultTimeout.
+	Timeout time.Duration
+	// Forward is used to reach the proxy server.  If nil, the proxy is
+	// dialed directly.
+	Forward Dialer
+}
+
+// ResolvesRemotely returns RemoteDNS.
+func (s *SOCKS5) ResolvesRemotely() bool {
+	return s.RemoteDNS
+}
+
+// Dial connects to addr through the proxy.  Only tcp networks are supported.
+func (s *SOCKS5) Dial(network, addr string) (net.Conn, error) {
+	return s.DialContext(context.Background(), network, addr)
+}
+
+// DialContext is like Dial but gives up when ctx is done.
+func (s *SOCKS5) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("p2p: socks5 proxy does not support network %v", network)
+	}
+
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 0xFFFF {
+		return nil, fmt.Errorf("p2p: invalid port in %v", addr)
+	}
+	if net.ParseIP(host) == nil && !s.RemoteDNS {
+		ips, err := net.DefaultResolver.LookupHost(ctx, host)
+		if err != nil {
+			return nil, err
+		} else if len(ips) == 0 {
+			return nil, fmt.Errorf("p2p: no addresses found for %v", host)
+		}
+		host = ips[0]
+	}
+
+	timeout := s.Timeout
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+	fwd := s.Forward
+	if fwd == nil {
+		fwd = &net.Dialer{Timeout: timeout}
+	}
+	conn, err := dialContext(ctx, fwd, "tcp", s.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	err = s.handshake(conn, host, port)
+	stop()
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return nil, fmt.Errorf("p2p: socks5 connect to %v via %v failed (%w)", addr, s.Addr, err)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+func (s *SOCKS5) handshake(conn net.Conn, host string, port int) error {
+	methods := []byte{socksAuthNone}
+	if s.Username != "" {
+		methods = []byte{socksAuthNone, socksAuthPassword}
+	}
+	req := append([]byte{socksVersion, byte(len(methods))}, methods...)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	resp := make([]byte, 2)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return err
+	} else if resp[0] != socksVersion {
+		return fmt.Errorf("unexpected server version %v", resp[0])
+	}
+
+	switch resp[1] {
+	case socksAuthNone:
+	case socksAuthPassword:
+		if err := s.authenticate(conn); err != nil {
+			return err
+		}
+	case socksAuthNoAccept:
+		return errors.New("no acceptable authentication methods")
+	default:
+		return fmt.Errorf("unsupported authentication method %v", resp[1])
+	}
+
+	req = []byte{socksVersion, socksCmdConnect, 0x00}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return fmt.Errorf("host name too long")
+		}
+		req = append(req, socksAtypDomain, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, socksAtypIPv4)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, socksAtypIPv6)
+		req = append(req, ip.To16()...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	// reply: ver, rep, rsv, atyp, bound addr, bound port
+	resp = make([]byte, 4)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return err
+	} else if resp[1] != 0x00 {
+		if why, ok := socksReplies[resp[1]]; ok {
+			return errors.New(why)
+		}
+		return fmt.Errorf("unknown reply code %v", resp[1])
+	}
+
+	var skip int
+	switch resp[3] {
+	case socksAtypIPv4:
+		skip = net.IPv4len
+	case socksAtypIPv6:
+		skip = net.IPv6len
+	case socksAtypDomain:
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(conn, l); err != nil {
+			return err
+		}
+		skip = int(l[0])
+	default:
+		return fmt.Errorf("unknown bound address type %v", resp[3])
+	}
+	_, err := io.ReadFull(conn, make([]byte, skip+2))
+	return err
+}
+
+func (s *SOCKS5) authenticate(conn net.Conn) error {
+	if s.Username == "" || len(s.Username) > 255 || len(s.Password) > 255 {
+		return errors.New("invalid username or password for proxy")
+	}
+	req := []byte{0x01, byte(len(s.Username))}
+	req = append(req, s.Username...)
+	req = append(req, byte(len(s.Password)))
+	req = append(req, s.Password...)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	resp := make([]byte, 2)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return err
+	} else if resp[1] != 0x00 {
+		return errors.New("proxy authentication failed")
+	}
+	return nil
+}
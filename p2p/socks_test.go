@@ -0,0 +1,261 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// fakeSocks is a minimal SOCKS5 server that records the requested
+// destination and connects every request to target.
+type fakeSocks struct {
+	ln     net.Listener
+	target string
+	user   string
+	pass   string
+	hosts  chan string
+}
+
+func newFakeSocks(t *testing.T, target, user, pass string) *fakeSocks {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeSocks{ln: ln, target: target, user: user, pass: pass, hosts: make(chan string, 1)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeSocks) serve(conn net.Conn) {
+	defer conn.Close()
+	buf := make([]byte, 512)
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return
+	}
+	io.ReadFull(conn, buf[:buf[1]])
+
+	if s.user == "" {
+		conn.Write([]byte{5, socksAuthNone})
+	} else {
+		conn.Write([]byte{5, socksAuthPassword})
+		io.ReadFull(conn, buf[:2])
+		user := make([]byte, buf[1])
+		io.ReadFull(conn, user)
+		io.ReadFull(conn, buf[:1])
+		pass := make([]byte, buf[0])
+		io.ReadFull(conn, pass)
+		if string(user) != s.user || string(pass) != s.pass {
+			conn.Write([]byte{1, 1})
+			return
+		}
+		conn.Write([]byte{1, 0})
+	}
+
+	io.ReadFull(conn, buf[:4])
+	switch buf[3] {
+	case socksAtypIPv4:
+		io.ReadFull(conn, buf[:4])
+		s.hosts <- net.IP(buf[:4]).String()
+	case socksAtypDomain:
+		io.ReadFull(conn, buf[:1])
+		host := make([]byte, buf[0])
+		io.ReadFull(conn, host)
+		s.hosts <- string(host)
+	}
+	io.ReadFull(conn, buf[:2])
+
+	dst, err := net.Dial("tcp", s.target)
+	if err != nil {
+		conn.Write([]byte{5, 5, 0, socksAtypIPv4, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer dst.Close()
+	conn.Write([]byte{5, 0, 0, socksAtypIPv4, 127, 0, 0, 1, 0, 0})
+	go io.Copy(dst, conn)
+	io.Copy(conn, dst)
+}
+
+func echoServer(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return ln
+}
+
+func TestSOCKS5(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+
+	tests := []struct {
+		proxyUser, user, pass string
+		remoteDNS             bool
+		dest, wantHost        string
+		fail                  bool
+	}{
+		{dest: "10.1.2.3:8444", wantHost: "10.1.2.3"},
+		{remoteDNS: true, dest: "abcdefghijklmnop.onion:8444", wantHost: "abcdefghijklmnop.onion"},
+		{proxyUser: "bob", user: "bob", pass: "secret", dest: "10.1.2.3:8444", wantHost: "10.1.2.3"},
+		{proxyUser: "bob", user: "bob", pass: "wrong", dest: "10.1.2.3:8444", fail: true},
+	}
+
+	for i, test := range tests {
+		srv := newFakeSocks(t, echo.Addr().String(), test.proxyUser, "secret")
+		d := &SOCKS5{
+			Addr:      srv.ln.Addr().String(),
+			Username:  test.user,
+			Password:  test.pass,
+			RemoteDNS: test.remoteDNS,
+		}
+
+		conn, err := d.Dial("tcp", test.dest)
+		srv.ln.Close()
+		if test.fail {
+			if err == nil {
+				conn.Close()
+				t.Errorf("test %v: expected dial failure", i)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("test %v: %v", i, err)
+			continue
+		}
+
+		conn.Write([]byte("hello"))
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Errorf("test %v: %v", i, err)
+		} else if string(buf) != "hello" {
+			t.Errorf("test %v: expected echo 'hello', got '%s'", i, buf)
+		}
+		conn.Close()
+
+		if host := <-srv.hosts; host != test.wantHost {
+			t.Errorf("test %v: expected proxy to get host %v, got %v", i, test.wantHost, host)
+		}
+	}
+}
+
+func TestNoClearnet(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+
+	lg := testLog("node")
+	node := NewNode("127.0.0.1", 22336, lg)
+	node.NoClearnet = true
+
+	if _, err := node.dial(context.Background(), echo.Addr().String()); err != ErrClearnet {
+		t.Errorf("expected ErrClearnet, got %v", err)
+	}
+
+	srv := newFakeSocks(t, echo.Addr().String(), "", "")
+	defer srv.ln.Close()
+	_, port, _ := net.SplitHostPort(echo.Addr().String())
+	node.Dialer = &SOCKS5{Addr: srv.ln.Addr().String()}
+
+	conn, err := node.dial(context.Background(), net.JoinHostPort("127.0.0.1", port))
+	if err != nil {
+		t.Fatalf("dial through proxy failed: %v", err)
+	}
+	conn.Close()
+	<-srv.hosts
+
+	// resolving a name locally would leak it
+	if _, err := node.dial(context.Background(), net.JoinHostPort("localhost", port)); err != ErrClearnet {
+		t.Errorf("expected ErrClearnet for a locally resolved name, got %v", err)
+	}
+	node.Dialer.(*SOCKS5).RemoteDNS = true
+	conn, err = node.dial(context.Background(), net.JoinHostPort("localhost", port))
+	if err != nil {
+		t.Fatalf("dial through resolving proxy failed: %v", err)
+	}
+	conn.Close()
+	if host := <-srv.hosts; host != "localhost" {
+		t.Errorf("expected the proxy to resolve localhost, got %v", host)
+	}
+}
+
+func TestSOCKS5Cancel(t *testing.T) {
+	// a proxy that accepts connections but never answers
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	node := NewNode("127.0.0.1", 22371, testLog("node"))
+	node.Dialer = &SOCKS5{Addr: ln.Addr().String(), Timeout: time.Minute}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := node.dial(ctx, "10.0.0.1:8444"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the dial to be abandoned, got %v", err)
+	} else if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("cancelled dial took %v", d)
+	}
+}
+
+func TestProxyHandshake(t *testing.T) {
+	node1 := NewNode("127.0.0.1", 22372, testLog("node1"))
+	if err := node1.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer stop(t, node1)
+
+	srv := newFakeSocks(t, node1.Addr, "", "")
+	defer srv.ln.Close()
+	node2 := NewNode("127.0.0.1", 22373, testLog("node2"))
+	defer stop(t, node2)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// names can't be put in a version message or looked up without leaking
+	const onion = "abcdefghijklmnopqrstuvwxyzabcdefghijklmnopqrstuvwxyz234567.onion:8444"
+	node2.Dialer = &SOCKS5{Addr: srv.ln.Addr().String()}
+	if _, err := node2.Handshake(ctx, onion); err == nil {
+		t.Fatal("handshake with a host name through a locally resolving proxy")
+	}
+
+	node2.Dialer.(*SOCKS5).RemoteDNS = true
+	node2.NoClearnet = true
+	p, err := node2.Handshake(ctx, onion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	if host := <-srv.hosts; host != onion[:len(onion)-5] {
+		t.Errorf("proxy asked for %v", host)
+	}
+}
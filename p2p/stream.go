@@ -0,0 +1,195 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/rwcarlsen/gobitmsg/msg"
+	"github.com/rwcarlsen/gobitmsg/payload"
+)
+
+// ErrNoCommonStream is returned by handshakes with nodes that aren't in any
+// of our streams.
+var ErrNoCommonStream = errors.New("p2p: no stream in common")
+
+// ObjectStream returns the stream number an object payload belongs to.
+func ObjectStream(cmd msg.Command, data []byte) (int, error) {
+	// nonce and time, then for v2 objects other than msg an address or
+	// broadcast version before the stream
+	offset := 16
+	if len(data) <= offset {
+		return 0, fmt.Errorf("p2p: %v object too short", cmd)
+	}
+	switch cmd {
+	case msg.Cmsg:
+	case msg.Cobject:
+		// v3 objects have an object type and version before the stream
+		if offset += 4; len(data) <= offset {
+			return 0, fmt.Errorf("p2p: %v object too short", cmd)
+		}
+		_, n := varInt(data[offset:])
+		if n == 0 {
+			return 0, fmt.Errorf("p2p: malformed %v object", cmd)
+		}
+		offset += n
+	case msg.CgetpubKey, msg.Cpubkey, msg.Cbroadcast:
+		_, n := varInt(data[offset:])
+		if n == 0 {
+			return 0, fmt.Errorf("p2p: malformed %v object", cmd)
+		}
+		offset += n
+	default:
+		return 0, fmt.Errorf("p2p: %v is not an object", cmd)
+	}
+	stream, n := varInt(data[offset:])
+	if n == 0 || stream < 1 {
+		return 0, fmt.Errorf("p2p: malformed %v object stream", cmd)
+	}
+	return stream, nil
+}
+
+// varInt decodes a protocol variable length integer from the start of data,
+// returning a length of 0 if data is too short.
+func varInt(data []byte) (val, n int) {
+	if len(data) == 0 {
+		return 0, 0
+	}
+	switch data[0] {
+	case 0xFF:
+		n = 9
+	case 0xFE:
+		n = 5
+	case 0xFD:
+		n = 3
+	default:
+		return int(data[0]), 1
+	}
+	if len(data) < n {
+		return 0, 0
+	}
+	var v uint64
+	for _, b := range data[1:n] {
+		v = v<<8 | uint64(b)
+	}
+	return int(v), n
+}
+
+// Streams returns the streams the node has joined, set in MyVer.
+func (n *Node) Streams() []int {
+	return n.MyVer.Streams
+}
+
+func (n *Node) inStream(stream int) bool {
+	for _, s := range n.Streams() {
+		if s == stream {
+			return true
+		}
+	}
+	return false
+}
+
+// commonStreams returns the node's streams that are also in streams.
+func (n *Node) commonStreams(streams []int) []int {
+	var common []int
+	for _, s := range streams {
+		if n.inStream(s) {
+			common = append(common, s)
+		}
+	}
+	return common
+}
+
+// Streams returns the streams the peer shares with the node.
+func (p *Peer) Streams() []int {
+	return p.streams
+}
+
+// InStream reports whether the peer shares stream with the node.
+func (p *Peer) InStream(stream int) bool {
+	for _, s := range p.streams {
+		if s == stream {
+			return true
+		}
+	}
+	return false
+}
+
+// StreamPeers returns the peer sessions in stream.
+func (n *Node) StreamPeers(stream int) []*Peer {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	peers := make([]*Peer, 0, len(n.byStream[stream]))
+	for _, p := range n.byStream[stream] {
+		peers = append(peers, p)
+	}
+	return peers
+}
+
+// StreamInvSize returns the number of objects in the node's inventory for
+// stream.
+func (n *Node) StreamInvSize(stream int) int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return len(n.inv[stream])
+}
+
+// related reports whether addresses in stream are worth keeping and passing
+// on to nodes in ours: the streams themselves and their parent and child
+// streams.
+func (n *Node) related(stream int) bool {
+	for _, s := range n.Streams() {
+		if stream == s || stream == s/2 || stream == 2*s || stream == 2*s+1 {
+			return true
+		}
+	}
+	return false
+}
+
+// gossip returns the addresses to advertise to a peer in streams: known
+// nodes in those streams and in their child streams, as the protocol asks
+// for, up to the addr message limit.
+func (n *Node) gossip(streams []int) []*payload.AddressInfo {
+	want := map[int]bool{}
+	for _, s := range streams {
+		want[s], want[2*s], want[2*s+1] = true, true, true
+	}
+
+	addrs := append([]*payload.AddressInfo{}, n.MyPeers...)
+	add := func(addr string, stream int) {
+		if len(addrs) >= maxAddrEntries || !want[stream] {
+			return
+		}
+		host, portStr, _ := net.SplitHostPort(addr)
+		port, _ := strconv.Atoi(portStr)
+		addrs = append(addrs, &payload.AddressInfo{
+			Time:     time.Now(),
+			Stream:   stream,
+			Services: 1,
+			Ip:       host,
+			Port:     port,
+		})
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	var peers []string
+	for addr := range n.peers {
+		peers = append(peers, addr)
+	}
+	sort.Strings(peers)
+	for _, addr := range peers {
+		for _, s := range n.peers[addr].Ver.Streams {
+			add(addr, s)
+		}
+	}
+	for addr, stream := range n.known {
+		if n.peers[addr] == nil {
+			add(addr, stream)
+		}
+	}
+	return addrs
+}
@@ -0,0 +1,112 @@
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/rwcarlsen/gobitmsg/msg"
+	"github.com/rwcarlsen/gobitmsg/payload"
+)
+
+func TestObjectStream(t *testing.T) {
+	for _, cmd := range []msg.Command{msg.Cmsg, msg.CgetpubKey, msg.Cpubkey, msg.Cbroadcast} {
+		m := streamObject(cmd, 7, "data")
+		if s, err := ObjectStream(cmd, m.Payload()); err != nil || s != 7 {
+			t.Errorf("%v: got stream %v (%v)", cmd, s, err)
+		}
+	}
+	if _, err := ObjectStream(msg.Cmsg, make([]byte, 16)); err == nil {
+		t.Error("expected an error for a truncated object")
+	}
+}
+
+func TestAddrStream(t *testing.T) {
+	n := NewNode("127.0.0.1", 22370, testLog("node"))
+	n.MyVer.Streams = []int{3, 4}
+	n.learn([]*payload.AddressInfo{{Stream: 4, Ip: "10.0.0.1", Port: 8444}})
+	for addr, want := range map[string]int{"10.0.0.1:8444": 4, "10.0.0.2:8444": 3} {
+		a, err := addrInfo(addr, n.addrStream(addr), false)
+		if err != nil {
+			t.Fatal(err)
+		} else if a.Stream != want {
+			t.Errorf("%v: got stream %v, want %v", addr, a.Stream, want)
+		}
+	}
+}
+
+func TestStreams(t *testing.T) {
+	node1 := NewNode("127.0.0.1", 22351, testLog("node1"))
+	node1.TrialsPerByte, node1.ExtraBytes = 1, 1
+	node1.MyVer.Streams = []int{1, 2}
+	if err := node1.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer stop(t, node1)
+
+	obj1 := streamObject(msg.Cmsg, 1, "stream one")
+	obj2 := streamObject(msg.Cmsg, 2, "stream two")
+	node1.AddObject(obj1)
+	node1.AddObject(obj2)
+	if err := node1.AddObject(streamObject(msg.Cmsg, 3, "stream three")); err == nil {
+		t.Error("added an object from a stream the node isn't in")
+	}
+
+	child := &payload.AddressInfo{Stream: 4, Ip: "10.0.0.4", Port: 8444}
+	node1.learn([]*payload.AddressInfo{
+		child,
+		{Stream: 1, Ip: "10.0.0.1", Port: 8444},
+		{Stream: 9, Ip: "10.0.0.9", Port: 8444},
+	})
+	if _, ok := node1.known["10.0.0.9:8444"]; ok {
+		t.Error("learned an address from an unrelated stream")
+	}
+
+	node2 := NewNode("127.0.0.1", 22352, testLog("node2"))
+	node2.TrialsPerByte, node2.ExtraBytes = 1, 1
+	node2.MyVer.Streams = []int{2}
+	defer stop(t, node2)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	peer, err := node2.Handshake(ctx, node1.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// only stream 2 objects and stream 2, 4 and 5 addresses are advertised
+	if len(peer.Inv) != 1 || !bytes.Equal(peer.Inv[0], invHash(obj2.Payload())) {
+		t.Errorf("expected only the stream 2 object advertised, got %x", peer.Inv)
+	}
+	if len(peer.Addrs) != 1 || peer.Addrs[0].Addr() != child.Addr() || peer.Addrs[0].Stream != 4 {
+		t.Errorf("expected only the child stream address, got %v", peer.Addrs)
+	}
+
+	if peers := node1.StreamPeers(1); len(peers) != 0 {
+		t.Errorf("stream 1 has %v peers", len(peers))
+	} else if peers := node1.StreamPeers(2); len(peers) != 1 {
+		t.Errorf("stream 2 has %v peers", len(peers))
+	}
+	if n := node1.Broadcast(obj1); n != 0 {
+		t.Errorf("stream 1 object relayed to %v peers", n)
+	}
+	if n := node1.Broadcast(obj2); n != 1 {
+		t.Errorf("stream 2 object relayed to %v peers", n)
+	}
+	select {
+	case m := <-node2.ObjectsIn:
+		if !bytes.Equal(m.Payload(), obj2.Payload()) {
+			t.Error("received the wrong object")
+		}
+	case <-ctx.Done():
+		t.Fatal("stream 2 object never arrived")
+	}
+
+	node3 := NewNode("127.0.0.1", 22353, testLog("node3"))
+	node3.MyVer.Streams = []int{3}
+	defer stop(t, node3)
+	if _, err := node3.Handshake(ctx, node1.Addr); !errors.Is(err, ErrNoCommonStream) {
+		t.Errorf("expected ErrNoCommonStream, got %v", err)
+	}
+}
@@ -0,0 +1,327 @@
+package p2p
+
+import (
+	"context"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/rwcarlsen/gobitmsg/msg"
+	"github.com/rwcarlsen/gobitmsg/payload"
+)
+
+const (
+	defaultMaxInFlight    = 1000
+	defaultMaxWanted      = 2 * maxInvEntries
+	defaultRequestTimeout = 2 * time.Minute
+	syncLogInterval       = 30 * time.Second
+)
+
+// invChunkSize is the most hashes sent in one inv message.
+var invChunkSize = maxInvEntries
+
+// sendInv advertises hashes to p in as many inv messages as needed.  At
+// least one is sent, since the handshake expects it.
+func sendInv(p *Peer, proto uint32, hashes [][]byte) error {
+	for first := true; first || len(hashes) > 0; first = false {
+		chunk := hashes[:min(len(hashes), invChunkSize)]
+		hashes = hashes[len(chunk):]
+		pay, err := payload.InventoryEncode(proto, chunk)
+		if err != nil {
+			return err
+		} else if err := p.write(msg.New(msg.Cinv, pay).Encode()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SyncProgress describes the state of a Syncer.
+type SyncProgress struct {
+	// Wanted is the number of advertised objects not yet fetched,
+	// including those InFlight.
+	Wanted   int `json:"wanted"`
+	InFlight int `json:"inFlight"`
+	Fetched  int `json:"fetched"`
+	// Retried counts objects re-requested after a peer failed to send
+	// them, and Failed those no advertising peer sent.
+	Retried int `json:"retried"`
+	Failed  int `json:"failed"`
+}
+
+// Syncer fetches the objects peers advertise that the node doesn't have.
+// Requests are spread over the peers advertising each object, limited to
+// MaxInFlight outstanding objects per peer, and objects a peer doesn't send
+// within RequestTimeout are requested from another.  Set the node's OnInv
+// to the Syncer's Advertised method and call Run.
+type Syncer struct {
+	Node           *Node
+	MaxInFlight    int
+	RequestTimeout time.Duration
+	// MaxWanted bounds how many wanted objects a single peer's
+	// advertisements are remembered for.  Zero means defaultMaxWanted.
+	MaxWanted int
+	// Handle is called with each fetched object.
+	Handle func(m *msg.Msg)
+
+	mu       sync.Mutex
+	wanted   map[string]*wantedObject
+	inFlight map[*Peer]int
+	// advertised counts the wanted objects each peer is listed for.
+	advertised map[*Peer]int
+	progress   SyncProgress
+	wake       chan struct{}
+}
+
+type wantedObject struct {
+	hash      []byte
+	from      []*Peer
+	tried     map[*Peer]bool
+	requested bool
+}
+
+// NewSyncer returns a Syncer for n that passes fetched objects to handle.
+func NewSyncer(n *Node, handle func(m *msg.Msg)) *Syncer {
+	return &Syncer{
+		Node:       n,
+		Handle:     handle,
+		wanted:     map[string]*wantedObject{},
+		inFlight:   map[*Peer]int{},
+		advertised: map[*Peer]int{},
+		wake:       make(chan struct{}, 1),
+	}
+}
+
+// Advertised records that p has the objects with the given inventory
+// hashes.  Once p is listed for MaxWanted wanted objects, the rest of its
+// advertisements are ignored until some of those are fetched.  It doesn't
+// block.
+func (s *Syncer) Advertised(p *Peer, hashes [][]byte) {
+	limit := s.MaxWanted
+	if limit <= 0 {
+		limit = defaultMaxWanted
+	}
+
+	s.mu.Lock()
+	for _, h := range hashes {
+		if s.advertised[p] >= limit {
+			break
+		}
+		key := hex.EncodeToString(h)
+		if _, ok := s.Node.object(key, s.Node.Streams()); ok || s.Node.Expired(h) {
+			continue
+		}
+		w := s.wanted[key]
+		if w == nil {
+			w = &wantedObject{hash: h, tried: map[*Peer]bool{}}
+			s.wanted[key] = w
+		} else if w.advertisedBy(p) {
+			continue
+		}
+		w.from = append(w.from, p)
+		s.advertised[p]++
+	}
+	s.mu.Unlock()
+	s.poke()
+}
+
+func (w *wantedObject) advertisedBy(p *Peer) bool {
+	for _, q := range w.from {
+		if q == p {
+			return true
+		}
+	}
+	return false
+}
+
+// forget stops wanting the object with key.  The caller must hold s.mu.
+func (s *Syncer) forget(key string) {
+	for _, p := range s.wanted[key].from {
+		if s.advertised[p]--; s.advertised[p] <= 0 {
+			delete(s.advertised, p)
+		}
+	}
+	delete(s.wanted, key)
+}
+
+// dropClosed removes the peers whose sessions have ended from every wanted
+// object, leaving objects no other peer advertised to be counted as failed.
+// The caller must hold s.mu.
+func (s *Syncer) dropClosed() {
+	closed := map[*Peer]bool{}
+	for p := range s.advertised {
+		if p.Err() != nil {
+			closed[p] = true
+			delete(s.advertised, p)
+		}
+	}
+	if len(closed) == 0 {
+		return
+	}
+	for _, w := range s.wanted {
+		from := w.from[:0]
+		for _, p := range w.from {
+			if closed[p] {
+				delete(w.tried, p)
+			} else {
+				from = append(from, p)
+			}
+		}
+		w.from = from
+	}
+}
+
+func (s *Syncer) poke() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Progress returns the Syncer's current progress.
+func (s *Syncer) Progress() SyncProgress {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p := s.progress
+	p.Wanted = len(s.wanted)
+	for _, n := range s.inFlight {
+		p.InFlight += n
+	}
+	return p
+}
+
+// Run sends requests for wanted objects until ctx is done or the node
+// stops.
+func (s *Syncer) Run(ctx context.Context) {
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	lastLog := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.Node.ctx.Done():
+			return
+		case <-s.wake:
+		case <-t.C:
+		}
+		s.schedule()
+
+		if p := s.Progress(); p.Wanted > 0 && time.Since(lastLog) > syncLogInterval {
+			s.Node.Log.Info("sync progress", "wanted", p.Wanted, "inflight", p.InFlight, "fetched", p.Fetched)
+			lastLog = time.Now()
+		}
+	}
+}
+
+// schedule drops disconnected peers, assigns unrequested objects to the
+// first untried peer advertising them that has room, and sends the
+// requests.
+func (s *Syncer) schedule() {
+	limit := s.MaxInFlight
+	if limit <= 0 {
+		limit = defaultMaxInFlight
+	}
+	// each peer's requests must fit in a single getdata
+	limit = min(limit, maxInvEntries)
+
+	s.mu.Lock()
+	s.dropClosed()
+	batches := map[*Peer][][]byte{}
+	for key, w := range s.wanted {
+		if w.requested {
+			continue
+		}
+		p := s.candidate(w, limit)
+		if p == nil {
+			if s.exhausted(w) {
+				s.forget(key)
+				s.progress.Failed++
+			}
+			continue
+		}
+		w.requested = true
+		s.inFlight[p]++
+		batches[p] = append(batches[p], w.hash)
+	}
+	s.mu.Unlock()
+
+	for p, hashes := range batches {
+		p, hashes := p, hashes
+		if !s.Node.spawn(func() { s.fetch(p, hashes) }) {
+			return
+		}
+	}
+}
+
+// candidate returns a peer to request w from, or nil.  The caller must hold
+// s.mu.
+func (s *Syncer) candidate(w *wantedObject, limit int) *Peer {
+	for _, p := range w.from {
+		if !w.tried[p] && s.inFlight[p] < limit && p.Err() == nil {
+			return p
+		}
+	}
+	return nil
+}
+
+// exhausted reports whether every peer advertising w has failed to send
+// it.  The caller must hold s.mu.
+func (s *Syncer) exhausted(w *wantedObject) bool {
+	for _, p := range w.from {
+		if !w.tried[p] && p.Err() == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// fetch requests hashes from p and hands over what arrives in time.
+// Objects that don't arrive are left to be requested from other peers.
+func (s *Syncer) fetch(p *Peer, hashes [][]byte) {
+	timeout := s.RequestTimeout
+	if timeout <= 0 {
+		timeout = defaultRequestTimeout
+	}
+	ctx, cancel := context.WithTimeout(s.Node.ctx, timeout)
+	objs, err := s.Node.GetData(ctx, p, hashes)
+	cancel()
+
+	got := map[string]bool{}
+	for _, m := range objs {
+		got[hex.EncodeToString(invHash(m.Payload()))] = true
+		if s.Handle != nil {
+			s.Handle(m)
+		}
+	}
+
+	s.mu.Lock()
+	s.inFlight[p] -= len(hashes)
+	if s.inFlight[p] <= 0 {
+		delete(s.inFlight, p)
+	}
+	for _, h := range hashes {
+		key := hex.EncodeToString(h)
+		w := s.wanted[key]
+		if w == nil {
+			continue
+		} else if got[key] {
+			s.forget(key)
+			s.progress.Fetched++
+			continue
+		} else if s.Node.Expired(h) {
+			// GetData doesn't ask for expired objects
+			s.forget(key)
+			continue
+		}
+		w.tried[p] = true
+		w.requested = false
+		s.progress.Retried++
+	}
+	s.mu.Unlock()
+
+	if err != nil {
+		s.Node.Log.Info("getdata incomplete", "peer", p.Addr, "requested", len(hashes), "received", len(objs), "err", err)
+	}
+	s.poke()
+}
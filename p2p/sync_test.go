@@ -0,0 +1,126 @@
+package p2p
+
+import (
+	"context"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/rwcarlsen/gobitmsg/msg"
+)
+
+func TestSync(t *testing.T) {
+	defer func(size int) { invChunkSize = size }(invChunkSize)
+	invChunkSize = 2
+
+	node1 := NewNode("127.0.0.1", 22355, testLog("node1"))
+	node1.TrialsPerByte, node1.ExtraBytes = 1, 1
+	var hashes [][]byte
+	for _, data := range []string{"one", "two", "three"} {
+		m := object(msg.Cmsg, data)
+		node1.AddObject(m)
+		hashes = append(hashes, invHash(m.Payload()))
+	}
+	node3 := NewNode("127.0.0.1", 22356, testLog("node3"))
+	for _, n := range []*Node{node1, node3} {
+		if err := n.Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer stop(t, n)
+	}
+
+	node2 := NewNode("127.0.0.1", 22357, testLog("node2"))
+	node2.TrialsPerByte, node2.ExtraBytes = 1, 1
+	defer stop(t, node2)
+	s := NewSyncer(node2, func(m *msg.Msg) { node2.AddObject(m) })
+	s.RequestTimeout = 300 * time.Millisecond
+	node2.OnInv = s.Advertised
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	// node3 claims to have the objects but never sends them, so they must
+	// be fetched from node1 once the requests to it time out
+	peer3, err := node2.Handshake(ctx, node3.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Advertised(peer3, hashes)
+	go s.Run(ctx)
+	if _, err := node2.Handshake(ctx, node1.Addr); err != nil {
+		t.Fatal(err)
+	}
+
+	for s.Progress().Fetched < len(hashes) {
+		select {
+		case <-ctx.Done():
+			t.Fatalf("sync stalled: %+v", s.Progress())
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	if n := node2.InvSize(); n != len(hashes) {
+		t.Errorf("node2 has %v objects", n)
+	}
+	p := s.Progress()
+	if p.Wanted != 0 || p.InFlight != 0 || p.Fetched != 3 || p.Retried != 3 || p.Failed != 0 {
+		t.Errorf("unexpected progress %+v", p)
+	}
+}
+
+func TestSyncAdvertised(t *testing.T) {
+	s := NewSyncer(NewNode("127.0.0.1", 22363, testLog("node")), nil)
+	s.MaxWanted = 2
+	p, q := &Peer{}, &Peer{}
+	one, two, three := []byte("one"), []byte("two"), []byte("three")
+
+	s.Advertised(p, [][]byte{one, one, two, three})
+	s.Advertised(q, [][]byte{one})
+	s.Advertised(q, [][]byte{one})
+	if n := len(s.wanted); n != 2 {
+		t.Errorf("wanted %v objects, expected 2", n)
+	}
+	if w := s.wanted[hex.EncodeToString(one)]; len(w.from) != 2 {
+		t.Errorf("object listed for %v peers, expected 2", len(w.from))
+	}
+	if s.advertised[p] != 2 || s.advertised[q] != 1 {
+		t.Errorf("unexpected advertisement counts %v and %v", s.advertised[p], s.advertised[q])
+	}
+
+	// fetching an object makes room for more
+	s.mu.Lock()
+	s.forget(hex.EncodeToString(two))
+	s.mu.Unlock()
+	s.Advertised(p, [][]byte{three})
+	if _, ok := s.wanted[hex.EncodeToString(three)]; !ok || s.advertised[p] != 2 {
+		t.Error("advertisement ignored after making room")
+	}
+}
+
+func TestSyncDropped(t *testing.T) {
+	node := NewNode("127.0.0.1", 22374, testLog("node"))
+	s := NewSyncer(node, nil)
+	p, q := &Peer{}, &Peer{done: make(chan struct{})}
+	one, two := []byte("one"), []byte("two")
+	s.Advertised(p, [][]byte{one, two})
+	s.Advertised(q, [][]byte{one})
+
+	// a peer that disconnects is dropped from every object it advertised
+	q.err = ErrPeerClosed
+	close(q.done)
+	s.mu.Lock()
+	s.dropClosed()
+	s.mu.Unlock()
+	if w := s.wanted[hex.EncodeToString(one)]; w == nil || len(w.from) != 1 || w.from[0] != p {
+		t.Errorf("closed peer still listed for %+v", w)
+	} else if _, ok := s.advertised[q]; ok {
+		t.Error("closed peer's advertisements still counted")
+	}
+
+	// objects that expire while requested are forgotten, not retried
+	node.recentlyExpired[hex.EncodeToString(two)] = time.Now()
+	s.fetch(p, [][]byte{two})
+	if _, ok := s.wanted[hex.EncodeToString(two)]; ok {
+		t.Error("expired object still wanted")
+	} else if pr := s.Progress(); pr.Retried != 0 || pr.Failed != 0 {
+		t.Errorf("expired object counted in %+v", pr)
+	}
+}
@@ -0,0 +1,112 @@
+package payload
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	// AddressVersion is the version of addresses created by this package.
+	AddressVersion = 3
+	addressPrefix  = "BM-"
+)
+
+// Address identifies a bitmessage identity by its address version, stream
+// and ripe hash.
+type Address struct {
+	Version int
+	Stream  int
+	// Ripe is the full 20 byte ripe hash of the identity's public keys.
+	Ripe []byte
+}
+
+// RipeHash computes the ripe hash that identifies the owner of the given
+// signing and encryption public keys.
+func RipeHash(signKey, encryptKey *Key) []byte {
+	h := powHash.New()
+	h.Write(signKey.EncodePub())
+	h.Write(encryptKey.EncodePub())
+	return ripemd160(h.Sum(nil))
+}
+
+// BroadcastKey returns the key broadcasts from the address are encrypted
+// to.  Its private key is derived from the address, so anyone subscribed to
+// the address can decrypt them.
+func (a *Address) BroadcastKey() (*Key, error) {
+	data := varIntEncode(a.Version)
+	data = append(data, varIntEncode(a.Stream)...)
+	sum := sha512.Sum512(append(data, a.Ripe...))
+	return DecodePrivKey(sum[:32])
+}
+
+// String returns the "BM-" prefixed base58 encoding of the address.
+func (a *Address) String() string {
+	ripe := a.Ripe
+	if a.Version >= 4 {
+		ripe = bytes.TrimLeft(ripe, "\x00")
+	} else if bytes.HasPrefix(ripe, []byte{0, 0}) {
+		ripe = ripe[2:]
+	} else if bytes.HasPrefix(ripe, []byte{0}) {
+		ripe = ripe[1:]
+	}
+
+	data := varIntEncode(a.Version)
+	data = append(data, varIntEncode(a.Stream)...)
+	data = append(data, ripe...)
+	data = append(data, addressChecksum(data)...)
+	return addressPrefix + base58Encode(data)
+}
+
+// AddressDecode parses a bitmessage address string.  The "BM-" prefix is
+// optional.
+func AddressDecode(s string) (a *Address, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			a = nil
+			err = errors.New("payload: failed to decode address (malformed)")
+		}
+	}()
+
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(strings.ToUpper(s), addressPrefix) {
+		s = s[len(addressPrefix):]
+	}
+
+	data, err := base58Decode(s)
+	if err != nil {
+		return nil, err
+	} else if len(data) < 4 {
+		return nil, errors.New("payload: address is too short")
+	}
+
+	body, sum := data[:len(data)-4], data[len(data)-4:]
+	if !bytes.Equal(sum, addressChecksum(body)) {
+		return nil, errors.New("payload: address checksum failed")
+	}
+
+	a = &Address{}
+	var n, offset int
+	a.Version, n = varIntDecode(body)
+	offset += n
+	a.Stream, n = varIntDecode(body[offset:])
+	offset += n
+
+	ripe := body[offset:]
+	if len(ripe) > 20 {
+		return nil, fmt.Errorf("payload: address ripe hash is too long (%v bytes)", len(ripe))
+	}
+	a.Ripe = append(make([]byte, 20-len(ripe)), ripe...)
+	return a, nil
+}
+
+func addressChecksum(data []byte) []byte {
+	h := powHash.New()
+	h.Write(data)
+	sum := h.Sum(nil)
+	h.Reset()
+	h.Write(sum)
+	return h.Sum(nil)[:4]
+}
@@ -0,0 +1,58 @@
+package payload
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func TestRipemd160(t *testing.T) {
+	tests := map[string]string{
+		"":    "9c1185a5c5e9fc54612808977ee8f548b2258d31",
+		"abc": "8eb208f7e05d987a9b044a8e98c6b087f15a0bfc",
+		"abcdbcdecdefdefgefghfghighijhijkijkljklmklmnlmnomnopnopq": "12a053384a9c0c88e405a06c27dcf49ada62eb2b",
+	}
+
+	for in, expect := range tests {
+		if got := hex.EncodeToString(ripemd160([]byte(in))); got != expect {
+			t.Errorf("ripemd160(%q): expected %v, got %v", in, expect, got)
+		}
+	}
+}
+
+func TestBase58(t *testing.T) {
+	data := []byte{0, 0, 1, 2, 3, 250, 251}
+	s := base58Encode(data)
+	got, err := base58Decode(s)
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(got, data) {
+		t.Errorf("expected %x, got %x", data, got)
+	}
+
+	if _, err := base58Decode("0OIl"); err == nil {
+		t.Error("decoded invalid base58 characters")
+	}
+}
+
+func TestAddress(t *testing.T) {
+	// address and ripe taken from the bitmessage wiki
+	const s = "BM-2DAjcCFrqFrp88FUxExhJ9kPqHdunQmiyn"
+	a, err := AddressDecode(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Version != 3 || a.Stream != 1 {
+		t.Errorf("expected version 3 stream 1, got version %v stream %v", a.Version, a.Stream)
+	}
+	if len(a.Ripe) != 20 {
+		t.Errorf("expected 20 byte ripe, got %v bytes", len(a.Ripe))
+	}
+	if got := a.String(); got != s {
+		t.Errorf("round trip: expected %v, got %v", s, got)
+	}
+
+	if _, err := AddressDecode(s[:len(s)-1] + "m"); err == nil {
+		t.Error("decoded address with bad checksum")
+	}
+}
@@ -0,0 +1,54 @@
+package payload
+
+import (
+	"errors"
+	"math/big"
+	"strings"
+)
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+var bigRadix = big.NewInt(58)
+
+// base58Encode encodes data using the bitcoin base58 alphabet.  Leading zero
+// bytes are preserved as leading '1' characters.
+func base58Encode(data []byte) string {
+	x := new(big.Int).SetBytes(data)
+	mod := new(big.Int)
+
+	var enc []byte
+	for x.Sign() > 0 {
+		x.DivMod(x, bigRadix, mod)
+		enc = append(enc, base58Alphabet[mod.Int64()])
+	}
+	for _, b := range data {
+		if b != 0 {
+			break
+		}
+		enc = append(enc, base58Alphabet[0])
+	}
+
+	for i, j := 0, len(enc)-1; i < j; i, j = i+1, j-1 {
+		enc[i], enc[j] = enc[j], enc[i]
+	}
+	return string(enc)
+}
+
+// base58Decode decodes a string encoded with base58Encode.
+func base58Decode(s string) ([]byte, error) {
+	x := new(big.Int)
+	for _, c := range s {
+		i := strings.IndexRune(base58Alphabet, c)
+		if i < 0 {
+			return nil, errors.New("payload: invalid base58 character")
+		}
+		x.Mul(x, bigRadix)
+		x.Add(x, big.NewInt(int64(i)))
+	}
+
+	var zeros int
+	for zeros < len(s) && s[zeros] == base58Alphabet[0] {
+		zeros++
+	}
+	return append(make([]byte, zeros), x.Bytes()...), nil
+}
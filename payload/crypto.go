@@ -1,24 +1,40 @@
 package payload
 
 import (
+	"bytes"
+	"context"
 	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
 	"crypto/ecdsa"
 	"crypto/elliptic"
+	"crypto/hmac"
 	"crypto/rand"
 	_ "crypto/sha1"
-	_ "crypto/sha512"
+	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/asn1"
+	"encoding/hex"
+	"errors"
 	"math"
 	"math/big"
 	mrand "math/rand"
+	"strings"
 	"time"
 
+	"github.com/rwcarlsen/gobitmsg/pow"
 	"github.com/rwcarlsen/koblitz/kelliptic"
 )
 
-var signHash = crypto.SHA1
 var powHash = crypto.SHA512
 
+// Signatures are made with SHA-256.  Older clients sign with SHA-1, which is
+// still accepted.
+var (
+	signHash     = crypto.SHA256
+	verifyHashes = []crypto.Hash{crypto.SHA256, crypto.SHA1}
+)
+
 func getCurve() elliptic.Curve {
 	return kelliptic.S256()
 }
@@ -29,23 +45,16 @@ func FuzzyTime(giveTake time.Duration) time.Time {
 	return t.Add(fuzz)
 }
 
+// Solver does the proof of work for DoPOW.  Nonces it returns are checked,
+// and the work is redone in process if it fails.
+var Solver pow.Solver = pow.Local{}
+
 // DoPOW returns a proof of work nonce for data.
 func DoPOW(trialsPerByte, extraLen int, data []byte) (nonce uint64) {
-	h := powHash.New()
-	h.Write(data)
-	kernel := h.Sum(nil)
-
-	trial := uint64(math.MaxUint64)
-	target := math.MaxUint64 / uint64((len(data)+extraLen+8)*trialsPerByte)
-	for trial > target {
-		nonce++
-		h.Reset()
-		h.Write(append(packUint(order, nonce), kernel...))
-		sum := h.Sum(nil)
-		h.Reset()
-		h.Write(sum)
-		trial = order.Uint64(h.Sum(nil)[:8])
-		if nonce == math.MaxUint64 {
+	target, kernel := pow.Target(trialsPerByte, extraLen, data)
+	nonce, err := pow.Solve(context.Background(), Solver, target, kernel)
+	if err != nil || !pow.Check(nonce, target, kernel) {
+		if nonce, err = pow.Solve(context.Background(), pow.Local{}, target, kernel); err != nil {
 			panic("payload: Failed to calculate POW")
 		}
 	}
@@ -84,50 +93,248 @@ func NewKey() (*Key, error) {
 // Decode decodes a public key from data into k.
 func DecodePubKey(data []byte) (k *Key, n int) {
 	// PUBLIC KEY ONLY !!!
-	x, y := elliptic.Unmarshal(getCurve(), data[:64])
-	pub := ecdsa.PublicKey{getCurve(), x, y}
+	x, y := elliptic.Unmarshal(getCurve(), append([]byte{4}, data[:64]...))
+	pub := ecdsa.PublicKey{Curve: getCurve(), X: x, Y: y}
 	return &Key{&ecdsa.PrivateKey{PublicKey: pub}}, 64
 }
 
+// DecodePrivKey creates a key from the 32 byte big-endian private
+// exponent in data.  The public key is derived from it.
+func DecodePrivKey(data []byte) (*Key, error) {
+	c := getCurve()
+	d := new(big.Int).SetBytes(data)
+	if len(data) != 32 || d.Sign() == 0 || d.Cmp(c.Params().N) >= 0 {
+		return nil, errors.New("payload: invalid private key")
+	}
+	priv := &ecdsa.PrivateKey{D: d}
+	priv.Curve = c
+	priv.X, priv.Y = c.ScalarBaseMult(data)
+	return &Key{priv}, nil
+}
+
+// EncodePriv encodes the private exponent of this key as 32 big-endian
+// bytes.
+func (k *Key) EncodePriv() []byte {
+	return k.D.FillBytes(make([]byte, 32))
+}
+
+// wifPrefix starts wallet import format private keys.
+const wifPrefix = 0x80
+
+// EncodeWIF encodes the private key in the wallet import format keys.dat
+// uses: base58 of 0x80, the private exponent and the first 4 bytes of its
+// double SHA-256.
+func (k *Key) EncodeWIF() string {
+	data := append([]byte{wifPrefix}, k.EncodePriv()...)
+	return base58Encode(append(data, wifChecksum(data)...))
+}
+
+// DecodeWIF decodes a private key encoded with EncodeWIF.
+func DecodeWIF(s string) (*Key, error) {
+	data, err := base58Decode(strings.TrimSpace(s))
+	if err != nil {
+		return nil, err
+	} else if len(data) != 37 || data[0] != wifPrefix {
+		return nil, errors.New("payload: malformed WIF private key")
+	} else if !bytes.Equal(data[33:], wifChecksum(data[:33])) {
+		return nil, errors.New("payload: WIF private key checksum failed")
+	}
+	return DecodePrivKey(data[1:33])
+}
+
+func wifChecksum(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	sum = sha256.Sum256(sum[:])
+	return sum[:4]
+}
+
+// EncodeHex encodes the private exponent as 64 hex digits.
+func (k *Key) EncodeHex() string {
+	return hex.EncodeToString(k.EncodePriv())
+}
+
+// DecodeHex decodes a private key encoded with EncodeHex.
+func DecodeHex(s string) (*Key, error) {
+	data, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, errors.New("payload: malformed hex private key")
+	}
+	return DecodePrivKey(data)
+}
+
+// ParsePrivKey decodes a private key in wallet import format or hex.
+func ParsePrivKey(s string) (*Key, error) {
+	if s = strings.TrimSpace(s); len(s) == 64 {
+		return DecodeHex(s)
+	}
+	return DecodeWIF(s)
+}
+
 // Encode encodes the public key portion of this key.
 func (k *Key) EncodePub() []byte {
 	return elliptic.Marshal(k.Curve, k.X, k.Y)
 }
 
+// encodeWirePub encodes the public key as objects carry it: the 64 bytes
+// of X and Y without EncodePub's 0x04 prefix.
+func (k *Key) encodeWirePub() []byte {
+	return k.EncodePub()[1:]
+}
+
+// ErrBadSignature is returned when a signature doesn't match the signed data
+// and key.
+var ErrBadSignature = errors.New("payload: invalid signature")
+
+// Verify reports whether sig is a valid signature of data by k, made with
+// any accepted hash.
 func (k *Key) Verify(data, sig []byte) bool {
-	h := signHash.New()
-	h.Write(data)
-	hash := h.Sum(nil)
+	_, ok := k.VerifyHash(data, sig)
+	return ok
+}
 
+// VerifyHash is like Verify, also returning the hash the signature was
+// made with.
+func (k *Key) VerifyHash(data, sig []byte) (crypto.Hash, bool) {
+	if k.X == nil {
+		// not a point on the curve
+		return 0, false
+	}
 	vals := signVals{}
 	if _, err := asn1.Unmarshal(sig, &vals); err != nil {
-		return false
+		return 0, false
 	}
 
-	return ecdsa.Verify(&k.PublicKey, hash, vals.R, vals.S)
+	for _, hash := range verifyHashes {
+		h := hash.New()
+		h.Write(data)
+		if ecdsa.Verify(&k.PublicKey, h.Sum(nil), vals.R, vals.S) {
+			return hash, true
+		}
+	}
+	return 0, false
 }
 
 type signVals struct {
 	R, S *big.Int
 }
 
-// TODO: make sure hash and signature encoding are correct
+// Sign returns a DER encoded ECDSA signature of the SHA-256 hash of data.
 func (k *Key) Sign(data []byte) (signature []byte, err error) {
-	h := signHash.New()
+	return k.SignHash(signHash, data)
+}
+
+// SignHash is like Sign using the given hash, which must be SHA-256 or
+// SHA-1.
+func (k *Key) SignHash(hash crypto.Hash, data []byte) (signature []byte, err error) {
+	if hash != crypto.SHA256 && hash != crypto.SHA1 {
+		return nil, errors.New("payload: unsupported signature hash")
+	}
+	h := hash.New()
 	h.Write(data)
-	hash := h.Sum(nil)
 
-	r, s, err := ecdsa.Sign(rand.Reader, k.PrivateKey, hash)
+	r, s, err := ecdsa.Sign(rand.Reader, k.PrivateKey, h.Sum(nil))
 	if err != nil {
 		return nil, err
 	}
 	return asn1.Marshal(signVals{r, s})
 }
 
-func (k *Key) Encrypt(data []byte) []byte {
-	panic("not implemented")
+// eciesCurve is the curve id pyelliptic writes before secp256k1 public keys.
+const eciesCurve = 0x02ca
+
+// eciesPubLen is the length of an encoded ECIES public key: the curve id
+// and the length prefixed X and Y coordinates.
+const eciesPubLen = 2 + 2 + 32 + 2 + 32
+
+// ErrDecrypt is returned when data wasn't encrypted to a key or has been
+// altered.
+var ErrDecrypt = errors.New("payload: decryption failed")
+
+// Encrypt encrypts data to the public key k the way PyBitmessage does.  An
+// ephemeral key's ECDH secret with k is hashed with SHA-512 into an
+// AES-256-CBC key and an HMAC-SHA256 key.  The result is the IV, the
+// ephemeral public key, the ciphertext and the MAC of all three.
+func (k *Key) Encrypt(data []byte) ([]byte, error) {
+	eph, err := NewKey()
+	if err != nil {
+		return nil, err
+	}
+	encKey, macKey := eciesKeys(&k.PublicKey, eph.D)
+	block, err := aes.NewCipher(encKey)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, aes.BlockSize, aes.BlockSize+eciesPubLen+len(data)+2*aes.BlockSize+sha256.Size)
+	if _, err := rand.Read(out); err != nil {
+		return nil, err
+	}
+	iv := out[:aes.BlockSize]
+	out = append(out, packUint(order, uint16(eciesCurve))...)
+	for _, v := range []*big.Int{eph.X, eph.Y} {
+		out = append(out, packUint(order, uint16(32))...)
+		out = append(out, v.FillBytes(make([]byte, 32))...)
+	}
+
+	pad := aes.BlockSize - len(data)%aes.BlockSize
+	ciphertext := append(append([]byte{}, data...), bytes.Repeat([]byte{byte(pad)}, pad)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, ciphertext)
+	out = append(out, ciphertext...)
+
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write(out)
+	return mac.Sum(out), nil
+}
+
+// Decrypt decrypts data encrypted to k with Encrypt.  k must have its
+// private key.
+func (k *Key) Decrypt(data []byte) ([]byte, error) {
+	if k.D == nil {
+		return nil, errors.New("payload: decrypting needs a private key")
+	}
+	const head = aes.BlockSize + eciesPubLen
+	if len(data) < head+aes.BlockSize+sha256.Size || (len(data)-head-sha256.Size)%aes.BlockSize != 0 {
+		return nil, ErrDecrypt
+	}
+	pub := data[aes.BlockSize:head]
+	if order.Uint16(pub) != eciesCurve || order.Uint16(pub[2:]) != 32 || order.Uint16(pub[36:]) != 32 {
+		return nil, ErrDecrypt
+	}
+	eph := &ecdsa.PublicKey{Curve: getCurve(), X: new(big.Int).SetBytes(pub[4:36]), Y: new(big.Int).SetBytes(pub[38:])}
+	if !eph.Curve.IsOnCurve(eph.X, eph.Y) {
+		return nil, ErrDecrypt
+	}
+	encKey, macKey := eciesKeys(eph, k.D)
+
+	macAt := len(data) - sha256.Size
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write(data[:macAt])
+	if !hmac.Equal(mac.Sum(nil), data[macAt:]) {
+		return nil, ErrDecrypt
+	}
+
+	block, err := aes.NewCipher(encKey)
+	if err != nil {
+		return nil, err
+	}
+	plain := make([]byte, macAt-head)
+	cipher.NewCBCDecrypter(block, data[:aes.BlockSize]).CryptBlocks(plain, data[head:macAt])
+	pad := int(plain[len(plain)-1])
+	if pad == 0 || pad > aes.BlockSize {
+		return nil, ErrDecrypt
+	}
+	for _, c := range plain[len(plain)-pad:] {
+		if int(c) != pad {
+			return nil, ErrDecrypt
+		}
+	}
+	return plain[:len(plain)-pad], nil
 }
 
-func (k *Key) Decrypt(data []byte) []byte {
-	panic("not implemented")
+// eciesKeys derives the encryption and MAC keys from the ECDH secret of pub
+// and the private exponent d.
+func eciesKeys(pub *ecdsa.PublicKey, d *big.Int) (encKey, macKey []byte) {
+	x, _ := getCurve().ScalarMult(pub.X, pub.Y, d.Bytes())
+	sum := sha512.Sum512(x.FillBytes(make([]byte, 32)))
+	return sum[:32], sum[32:]
 }
@@ -2,7 +2,12 @@ package payload
 
 import (
 	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
 	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/sha256"
 	"encoding/hex"
 	"math/big"
 	"testing"
@@ -50,17 +55,30 @@ func TestVerify(t *testing.T) {
 	k.X, _ = new(big.Int).SetString(x, 16)
 	k.Y, _ = new(big.Int).SetString(y, 16)
 
+	// signatures of "hello" made with OpenSSL, which PyBitmessage signs
+	// through
 	data := []byte("hello")
-	sigs := []string{
-		"304502204a8d238fbd74639790c5282c8da79c83a518e1e5ea520271a39624c3e1eb3f68022100abadb64f9f45d036e89b775938bda8ee8d0f80a78d72fa72c45b71209aedae8e",
-		"3045022100998555e3a7586f2f44aee20de7cb1930f9cf4358a415c4a032d8eb12ca5d210f02203cb1eed05383e11f9ffd07acaadd26ea733bc4bde37e80f6d18cfc54128ae857",
-		"30450220712c00262b21ffd7c5f98d353bd9427af6f4d4e5065bb87cbf7f18dc8fa0a2c602210083e830de1a7250a9dbe678b023601b1b78f1f5da125e6f4f52c43cd0ff1fccfc",
+	sigs := []struct {
+		hash crypto.Hash
+		sig  string
+	}{
+		{crypto.SHA1, "304502204a8d238fbd74639790c5282c8da79c83a518e1e5ea520271a39624c3e1eb3f68022100abadb64f9f45d036e89b775938bda8ee8d0f80a78d72fa72c45b71209aedae8e"},
+		{crypto.SHA1, "3045022100998555e3a7586f2f44aee20de7cb1930f9cf4358a415c4a032d8eb12ca5d210f02203cb1eed05383e11f9ffd07acaadd26ea733bc4bde37e80f6d18cfc54128ae857"},
+		{crypto.SHA1, "30450220712c00262b21ffd7c5f98d353bd9427af6f4d4e5065bb87cbf7f18dc8fa0a2c602210083e830de1a7250a9dbe678b023601b1b78f1f5da125e6f4f52c43cd0ff1fccfc"},
+		{crypto.SHA256, "3044022047f6b4f26f5a643418900b3a5aa7b0cc832a067108097871a0ce203393f1114e02207c9fcd2efb24b917001b035c9b3323edaf9d37109ead1fa2c8cc4fde3baef55b"},
+		{crypto.SHA256, "30450221009ec4c751917f9ff68b764632525f91fc0431402725eb13a3406f75ad270ef2910220670b5f9c265731f943bb7f0d0208c65bdaf3d56c00c94e8d9ef52650c4e01d56"},
+		{crypto.SHA256, "3045022100979f8d28b86b4b8f8e7de8f86f97dad09bd3203fad2dbdfe1a84ae226339966a022022596ad54f01517e47b26c17c0f2a333d5dea13d69d6cf976c571dd9dd1eac6d"},
 	}
 
-	for i, s := range sigs {
-		sig, _ := hex.DecodeString(s)
-		if !k.Verify(data, sig) {
+	for i, tt := range sigs {
+		sig, _ := hex.DecodeString(tt.sig)
+		if hash, ok := k.VerifyHash(data, sig); !ok {
 			t.Errorf("Failed to verify signature %v", i)
+		} else if hash != tt.hash {
+			t.Errorf("signature %v verified with %v, expected %v", i, hash, tt.hash)
+		}
+		if k.Verify([]byte("hellp"), sig) {
+			t.Errorf("signature %v verified for the wrong data", i)
 		}
 	}
 }
@@ -76,7 +94,118 @@ func TestSign(t *testing.T) {
 	sig, err := k.Sign(data)
 	if err != nil {
 		t.Error("failed to sign data")
-	} else if !k.Verify(data, sig) {
-		t.Error("failed to verify own signature")
+	} else if hash, ok := k.VerifyHash(data, sig); !ok || hash != crypto.SHA256 {
+		t.Errorf("failed to verify own signature as SHA-256 (%v, %v)", hash, ok)
+	}
+
+	sig, err = k.SignHash(crypto.SHA1, data)
+	if err != nil {
+		t.Error("failed to sign data with SHA-1")
+	} else if hash, ok := k.VerifyHash(data, sig); !ok || hash != crypto.SHA1 {
+		t.Errorf("failed to verify own signature as SHA-1 (%v, %v)", hash, ok)
+	}
+	if _, err := k.SignHash(crypto.MD5, data); err == nil {
+		t.Error("signed with an unsupported hash")
+	}
+}
+
+func TestWIF(t *testing.T) {
+	// the wallet import format example from the bitcoin wiki, which
+	// PyBitmessage's keys.dat shares
+	priv := "0c28fca386c7a227600b2fe50b7cae11ec86d3bf1fbe471be89827e19d72aa1d"
+	wif := "5HueCGU8rMjxEXxiPuD5BDku4MkFqeZyd4dZ1jvhTVqvbTLvyTJ"
+
+	k, err := DecodeWIF(wif)
+	if err != nil {
+		t.Fatal(err)
+	} else if got := k.EncodeHex(); got != priv {
+		t.Errorf("decoded %v, expected %v", got, priv)
+	}
+	if got := k.EncodeWIF(); got != wif {
+		t.Errorf("encoded %v, expected %v", got, wif)
+	}
+
+	for _, s := range []string{wif, priv, " " + wif + "\n"} {
+		k2, err := ParsePrivKey(s)
+		if err != nil {
+			t.Errorf("%q: %v", s, err)
+		} else if k2.D.Cmp(k.D) != 0 || k2.X.Cmp(k.X) != 0 {
+			t.Errorf("%q: parsed the wrong key", s)
+		}
+	}
+	for _, s := range []string{wif[:len(wif)-1] + "K", "5HueCGU8", priv[2:] + "zz", ""} {
+		if _, err := ParsePrivKey(s); err == nil {
+			t.Errorf("parsed invalid key %q", s)
+		}
+	}
+}
+
+func TestEncrypt(t *testing.T) {
+	k, err := NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, data := range [][]byte{nil, []byte("hello"), bytes.Repeat([]byte("0123456789abcdef"), 4)} {
+		pub, _ := DecodePubKey(k.EncodePub()[1:])
+		encrypted, err := pub.Encrypt(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := k.Decrypt(encrypted); err != nil {
+			t.Errorf("%q: %v", data, err)
+		} else if !bytes.Equal(got, data) {
+			t.Errorf("decrypted %q, expected %q", got, data)
+		}
+		if _, err := other.Decrypt(encrypted); err != ErrDecrypt {
+			t.Errorf("%q: decrypted with the wrong key (%v)", data, err)
+		}
+		encrypted[len(encrypted)/2] ^= 1
+		if _, err := k.Decrypt(encrypted); err != ErrDecrypt {
+			t.Errorf("%q: decrypted altered data (%v)", data, err)
+		}
+		if _, err := pub.Decrypt(encrypted); err == nil {
+			t.Error("decrypted without a private key")
+		}
+	}
+	if _, err := k.Decrypt([]byte("short")); err != ErrDecrypt {
+		t.Errorf("decrypted truncated data (%v)", err)
+	}
+
+	// a block ending in 2 after a byte that isn't is badly padded, even
+	// with a good MAC
+	eph, err := NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := k.Encrypt(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const head = aes.BlockSize + eciesPubLen
+	encKey, macKey := eciesKeys(&k.PublicKey, eph.D)
+	for i, v := range []*big.Int{eph.X, eph.Y} {
+		v.FillBytes(encrypted[aes.BlockSize+4+i*34 : aes.BlockSize+36+i*34])
+	}
+	block, _ := aes.NewCipher(encKey)
+	plain := append(bytes.Repeat([]byte{7}, aes.BlockSize-1), 2)
+	cipher.NewCBCEncrypter(block, encrypted[:aes.BlockSize]).CryptBlocks(encrypted[head:head+aes.BlockSize], plain)
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write(encrypted[:head+aes.BlockSize])
+	copy(encrypted[head+aes.BlockSize:], mac.Sum(nil))
+	if _, err := k.Decrypt(encrypted); err != ErrDecrypt {
+		t.Errorf("decrypted badly padded data (%v)", err)
+	}
+	plain[aes.BlockSize-2] = 2
+	cipher.NewCBCEncrypter(block, encrypted[:aes.BlockSize]).CryptBlocks(encrypted[head:head+aes.BlockSize], plain)
+	mac.Reset()
+	mac.Write(encrypted[:head+aes.BlockSize])
+	copy(encrypted[head+aes.BlockSize:], mac.Sum(nil))
+	if got, err := k.Decrypt(encrypted); err != nil || !bytes.Equal(got, plain[:aes.BlockSize-2]) {
+		t.Errorf("failed to decrypt well padded data (%v)", err)
 	}
 }
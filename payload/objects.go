@@ -2,7 +2,11 @@ package payload
 
 import (
 	"errors"
+	"fmt"
 	"time"
+
+	"github.com/rwcarlsen/gobitmsg/msg"
+	"github.com/rwcarlsen/gobitmsg/pow"
 )
 
 const (
@@ -11,6 +15,107 @@ const (
 	DefaultFuzz      = 300 * time.Second
 )
 
+// ErrTooDifficult is returned when a recipient asks for more proof of work
+// than the sender is willing to do.
+var ErrTooDifficult = errors.New("payload: recipient asks for too much proof of work")
+
+// ErrInsufficientPOW is returned when an object's nonce doesn't meet the
+// proof of work difficulty.
+var ErrInsufficientPOW = errors.New("payload: insufficient proof of work")
+
+// ErrMalformed is wrapped by the errors returned for objects that can't be
+// decoded.  Objects that are well formed but unsupported, such as pubkeys of
+// unknown address versions, are refused with other errors.
+var ErrMalformed = errors.New("malformed")
+
+// Object is a proof of work protected network object.  Building an object,
+// doing its proof of work and serializing it are separate steps, so the
+// work can be done elsewhere and the nonce checked or reused.
+//
+// Verify is taken by the full check of an object, so signatures alone are
+// checked with VerifySignature, on PubKey and on the decrypted MsgInfo and
+// BroadcastInfo.
+type Object interface {
+	// PayloadForPOW returns the object without its nonce, which is the data
+	// the proof of work covers.
+	PayloadForPOW() []byte
+	// SetNonce sets the object's proof of work nonce.
+	SetNonce(nonce uint64)
+	PowNonce() uint64
+	// Bytes returns the object with its current nonce.
+	Bytes() []byte
+	// Verify returns ErrInsufficientPOW if the nonce doesn't meet the given
+	// difficulty, and ErrBadSignature if the object is signed in the clear
+	// and the signature is invalid.  Values below 1 mean the network
+	// minimum.
+	Verify(trialsPerByte, extraBytes int) error
+}
+
+// DecodeObject decodes an object sent with the command cmd.  Protocol v3
+// objects are decoded as RawObjects.
+func DecodeObject(cmd msg.Command, data []byte) (Object, error) {
+	var o Object
+	var err error
+	switch cmd {
+	case msg.CgetpubKey:
+		o, err = GetPubKeyDecode(data)
+	case msg.Cpubkey:
+		o, err = PubKeyDecode(data)
+	case msg.Cmsg:
+		o, err = MessageDecode(data)
+	case msg.Cbroadcast:
+		o, err = BroadcastDecode(data)
+	case msg.Cobject:
+		o, err = RawObjectDecode(data)
+	default:
+		err = fmt.Errorf("payload: %v is not a known object type", cmd)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// DecodePOWObject decodes an object sent with the command cmd from the data
+// its proof of work covers, leaving its nonce zero.  It lets a pow.Queue
+// restore the objects it saved.
+func DecodePOWObject(cmd string, data []byte) (pow.Object, error) {
+	o, err := DecodeObject(msg.Command(cmd), append(make([]byte, 8), data...))
+	if err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// encode returns o with its nonce, doing proof of work at the given
+// difficulty first if it has none.
+func encode(o Object, trialsPerByte, extraBytes int) []byte {
+	data := o.PayloadForPOW()
+	if o.PowNonce() == 0 {
+		o.SetNonce(DoPOW(trialsPerByte, extraBytes, data))
+	}
+	return append(packUint(order, o.PowNonce()), data...)
+}
+
+func verify(o Object, trialsPerByte, extraBytes int) error {
+	if trialsPerByte < 1 {
+		trialsPerByte = PowTrialsPerByte
+	}
+	if extraBytes < 1 {
+		extraBytes = PowExtraLen
+	}
+	target, initialHash := pow.Target(trialsPerByte, extraBytes, o.PayloadForPOW())
+	if !pow.Check(o.PowNonce(), target, initialHash) {
+		return ErrInsufficientPOW
+	}
+	return nil
+}
+
+// powDifficulty raises a proof of work difficulty to the network minimum.
+func powDifficulty(trialsPerByte, extraBytes int) (int, int) {
+	return max(trialsPerByte, PowTrialsPerByte), max(extraBytes, PowExtraLen)
+}
+
 type GetPubKey struct {
 	powNonce    uint64
 	Time        time.Time
@@ -23,7 +128,7 @@ func GetPubKeyDecode(data []byte) (g *GetPubKey, err error) {
 	defer func() {
 		if r := recover(); r != nil {
 			g = nil
-			err = errors.New("payload: failed to decode getpubkey payload (malformed)")
+			err = fmt.Errorf("payload: failed to decode getpubkey payload (%w)", ErrMalformed)
 		}
 	}()
 
@@ -47,22 +152,35 @@ func GetPubKeyDecode(data []byte) (g *GetPubKey, err error) {
 	return g, nil
 }
 
+// Encode returns the object, doing proof of work at the network minimum
+// difficulty if it has no nonce yet.
 func (g *GetPubKey) Encode() []byte {
-	data := packUint(order, g.Time.Unix())
+	return encode(g, PowTrialsPerByte, PowExtraLen)
+}
+
+func (g *GetPubKey) PayloadForPOW() []byte {
+	data := packUint(order, uint64(g.Time.Unix()))
 	data = append(data, varIntEncode(g.AddrVersion)...)
 	data = append(data, varIntEncode(g.Stream)...)
-	data = append(data, g.RipeHash...)
+	return append(data, g.RipeHash...)
+}
 
-	if g.powNonce == 0 {
-		g.powNonce = DoPOW(PowTrialsPerByte, PowExtraLen, data)
-	}
-	return append(packUint(order, g.powNonce), data...)
+func (g *GetPubKey) SetNonce(nonce uint64) {
+	g.powNonce = nonce
 }
 
 func (g *GetPubKey) PowNonce() uint64 {
 	return g.powNonce
 }
 
+func (g *GetPubKey) Bytes() []byte {
+	return append(packUint(order, g.powNonce), g.PayloadForPOW()...)
+}
+
+func (g *GetPubKey) Verify(trialsPerByte, extraBytes int) error {
+	return verify(g, trialsPerByte, extraBytes)
+}
+
 type PubKey struct {
 	powNonce      uint64
 	Time          time.Time
@@ -80,7 +198,7 @@ func PubKeyDecode(data []byte) (k *PubKey, err error) {
 	defer func() {
 		if r := recover(); r != nil {
 			k = nil
-			err = errors.New("payload: failed to decode pubkey payload (malformed)")
+			err = fmt.Errorf("payload: failed to decode pubkey payload (%w)", ErrMalformed)
 		}
 	}()
 
@@ -102,12 +220,21 @@ func PubKeyDecode(data []byte) (k *PubKey, err error) {
 	k.Behavior = order.Uint32(data[offset : offset+4])
 	offset += 4
 
+	if k.AddrVersion != 2 && k.AddrVersion != 3 {
+		return nil, fmt.Errorf("payload: unsupported pubkey address version %v", k.AddrVersion)
+	}
+
 	k.SignKey, n = DecodePubKey(data[offset:])
 	offset += n
 
 	k.EncryptKey, n = DecodePubKey(data[offset:])
 	offset += n
 
+	// version 2 pubkeys end with the keys
+	if k.AddrVersion < 3 {
+		return k, nil
+	}
+
 	k.TrialsPerByte, n = varIntDecode(data[offset:])
 	offset += n
 
@@ -122,27 +249,95 @@ func PubKeyDecode(data []byte) (k *PubKey, err error) {
 	return k, nil
 }
 
+// Encode returns the object.  If it has no nonce yet, it is signed and
+// proof of work is done at the network minimum difficulty first.
 func (k *PubKey) Encode() []byte {
-	data := packUint(order, k.Time.Unix())
+	if k.powNonce == 0 && k.AddrVersion >= 3 {
+		if err := k.Sign(); err != nil {
+			panic("signature failed")
+		}
+	}
+	return encode(k, PowTrialsPerByte, PowExtraLen)
+}
+
+// Sign signs the pubkey with its SignKey.  It must be called again after
+// changing any field but the nonce, and before doing proof of work, since
+// the signature is part of what the work covers.
+func (k *PubKey) Sign() error {
+	sig, err := k.SignKey.Sign(k.signedData())
+	if err != nil {
+		return err
+	}
+	k.signature = sig
+	return nil
+}
+
+// PayloadForPOW returns the pubkey and its signature without its nonce.
+// Version 2 pubkeys have no signature.
+func (k *PubKey) PayloadForPOW() []byte {
+	data := k.signedData()
+	if k.AddrVersion < 3 {
+		return data
+	}
+	data = append(data, varIntEncode(len(k.signature))...)
+	return append(data, k.signature...)
+}
+
+// signedData returns the part of the pubkey its signature covers, from Time
+// through ExtraBytes.  Version 2 pubkeys end with EncryptKey.
+func (k *PubKey) signedData() []byte {
+	data := packUint(order, uint64(k.Time.Unix()))
 	data = append(data, varIntEncode(k.AddrVersion)...)
 	data = append(data, varIntEncode(k.Stream)...)
 	data = append(data, packUint(order, k.Behavior)...)
-	data = append(data, k.SignKey.EncodePub()...)
-	data = append(data, k.EncryptKey.EncodePub()...)
+	data = append(data, k.SignKey.encodeWirePub()...)
+	data = append(data, k.EncryptKey.encodeWirePub()...)
+	if k.AddrVersion < 3 {
+		return data
+	}
 	data = append(data, varIntEncode(k.TrialsPerByte)...)
-	data = append(data, varIntEncode(k.ExtraBytes)...)
+	return append(data, varIntEncode(k.ExtraBytes)...)
+}
 
-	var err error
-	if k.signature, err = k.SignKey.Sign(data); err != nil {
-		panic("signature failed")
+func (k *PubKey) SetNonce(nonce uint64) {
+	k.powNonce = nonce
+}
+
+func (k *PubKey) Bytes() []byte {
+	return append(packUint(order, k.powNonce), k.PayloadForPOW()...)
+}
+
+func (k *PubKey) Verify(trialsPerByte, extraBytes int) error {
+	if err := verify(k, trialsPerByte, extraBytes); err != nil {
+		return err
 	}
-	data = append(data, varIntEncode(len(k.signature))...)
-	data = append(data, k.signature...)
+	return k.VerifySignature()
+}
+
+// VerifySignature returns ErrBadSignature unless the pubkey is signed by its
+// own SignKey.  Version 2 pubkeys are unsigned and always pass.  Verify also
+// checks the proof of work.
+func (k *PubKey) VerifySignature() error {
+	if k.AddrVersion < 3 {
+		return nil
+	}
+	if !k.SignKey.Verify(k.signedData(), k.signature) {
+		return ErrBadSignature
+	}
+	return nil
+}
 
-	if k.powNonce == 0 {
-		k.powNonce = DoPOW(PowTrialsPerByte, PowExtraLen, data)
+// Difficulty returns the proof of work difficulty k asks senders for,
+// raised to the network minimum.  If it exceeds maxTrialsPerByte or
+// maxExtraBytes it is returned with ErrTooDifficult.  Zero maximums mean no
+// limit.
+func (k *PubKey) Difficulty(maxTrialsPerByte, maxExtraBytes int) (trialsPerByte, extraBytes int, err error) {
+	trialsPerByte, extraBytes = powDifficulty(k.TrialsPerByte, k.ExtraBytes)
+	if (maxTrialsPerByte > 0 && trialsPerByte > maxTrialsPerByte) ||
+		(maxExtraBytes > 0 && extraBytes > maxExtraBytes) {
+		err = ErrTooDifficult
 	}
-	return append(packUint(order, k.powNonce), data...)
+	return trialsPerByte, extraBytes, err
 }
 
 func (k *PubKey) Signature() []byte {
@@ -159,13 +354,18 @@ type Message struct {
 	// Stream is the destination/recipient's stream #
 	Stream int
 	Data   []byte
+	// TrialsPerByte and ExtraBytes are the proof of work difficulty asked
+	// for by the recipient's pubkey.  Values below the network minimum are
+	// raised to it.
+	TrialsPerByte int
+	ExtraBytes    int
 }
 
 func MessageDecode(data []byte) (m *Message, err error) {
 	defer func() {
 		if r := recover(); r != nil {
 			m = nil
-			err = errors.New("payload: failed to decode msg payload (malformed)")
+			err = fmt.Errorf("payload: failed to decode msg payload (%w)", ErrMalformed)
 		}
 	}()
 
@@ -186,33 +386,49 @@ func MessageDecode(data []byte) (m *Message, err error) {
 	return m, nil
 }
 
-// NewMessage is a convenience function for creating a message with
-// encrypted MsgInfo payload data.
-func NewMessage(mi *MsgInfo, stream int) *Message {
-	data := mi.Encode()
-	encrypted := mi.EncryptKey.Encrypt(data)
+// NewMessage is a convenience function for creating a message in stream
+// with MsgInfo payload data encrypted to the recipient's key to.
+func NewMessage(mi *MsgInfo, to *Key, stream int) (*Message, error) {
+	encrypted, err := to.Encrypt(mi.Encode())
+	if err != nil {
+		return nil, err
+	}
 	return &Message{
 		Time:   FuzzyTime(DefaultFuzz),
 		Stream: stream,
 		Data:   encrypted,
-	}
+	}, nil
 }
 
+// Encode returns the object, doing proof of work at the recipient's
+// difficulty if it has no nonce yet.
 func (m *Message) Encode() []byte {
-	data := packUint(order, m.Time.Unix())
+	trialsPerByte, extraBytes := powDifficulty(m.TrialsPerByte, m.ExtraBytes)
+	return encode(m, trialsPerByte, extraBytes)
+}
+
+func (m *Message) PayloadForPOW() []byte {
+	data := packUint(order, uint64(m.Time.Unix()))
 	data = append(data, varIntEncode(m.Stream)...)
-	data = append(data, m.Data...)
+	return append(data, m.Data...)
+}
 
-	if m.powNonce == 0 {
-		m.powNonce = DoPOW(PowTrialsPerByte, PowExtraLen, data)
-	}
-	return append(packUint(order, m.powNonce), data...)
+func (m *Message) SetNonce(nonce uint64) {
+	m.powNonce = nonce
 }
 
 func (m *Message) PowNonce() uint64 {
 	return m.powNonce
 }
 
+func (m *Message) Bytes() []byte {
+	return append(packUint(order, m.powNonce), m.PayloadForPOW()...)
+}
+
+func (m *Message) Verify(trialsPerByte, extraBytes int) error {
+	return verify(m, trialsPerByte, extraBytes)
+}
+
 const BroadcastVersion = 2
 
 type Broadcast struct {
@@ -224,23 +440,30 @@ type Broadcast struct {
 }
 
 // NewBroadcast is a convenience function for creating a broadcast message with
-// encrypted BroadcastInfo payload data.
-func NewBroadcast(bi *BroadcastInfo, stream int) *Broadcast {
-	data := bi.Encode()
-	encrypted := bi.EncryptKey.Encrypt(data)
+// BroadcastInfo payload data encrypted to its sender's broadcast key.
+func NewBroadcast(bi *BroadcastInfo, stream int) (*Broadcast, error) {
+	from := &Address{Version: bi.AddrVersion, Stream: bi.Stream, Ripe: RipeHash(bi.SignKey, bi.EncryptKey)}
+	key, err := from.BroadcastKey()
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := key.Encrypt(bi.Encode())
+	if err != nil {
+		return nil, err
+	}
 	return &Broadcast{
 		Time:    FuzzyTime(DefaultFuzz),
 		Stream:  stream,
 		Data:    encrypted,
 		version: BroadcastVersion,
-	}
+	}, nil
 }
 
 func BroadcastDecode(data []byte) (b *Broadcast, err error) {
 	defer func() {
 		if r := recover(); r != nil {
 			b = nil
-			err = errors.New("payload: failed to decode broadcast payload (malformed)")
+			err = fmt.Errorf("payload: failed to decode broadcast payload (%w)", ErrMalformed)
 		}
 	}()
 
@@ -264,22 +487,70 @@ func BroadcastDecode(data []byte) (b *Broadcast, err error) {
 	return b, nil
 }
 
+// Encode returns the object, doing proof of work at the network minimum
+// difficulty if it has no nonce yet.
 func (b *Broadcast) Encode() []byte {
-	data := packUint(order, b.Time.Unix())
+	return encode(b, PowTrialsPerByte, PowExtraLen)
+}
+
+func (b *Broadcast) PayloadForPOW() []byte {
+	data := packUint(order, uint64(b.Time.Unix()))
 	data = append(data, varIntEncode(b.version)...)
 	data = append(data, varIntEncode(b.Stream)...)
-	data = append(data, b.Data...)
+	return append(data, b.Data...)
+}
 
-	if b.powNonce == 0 {
-		b.powNonce = DoPOW(PowTrialsPerByte, PowExtraLen, data)
-	}
-	return append(packUint(order, b.powNonce), data...)
+func (b *Broadcast) SetNonce(nonce uint64) {
+	b.powNonce = nonce
 }
 
 func (b *Broadcast) PowNonce() uint64 {
 	return b.powNonce
 }
 
+func (b *Broadcast) Bytes() []byte {
+	return append(packUint(order, b.powNonce), b.PayloadForPOW()...)
+}
+
+func (b *Broadcast) Verify(trialsPerByte, extraBytes int) error {
+	return verify(b, trialsPerByte, extraBytes)
+}
+
 func (b *Broadcast) Version() int {
 	return b.version
 }
+
+// RawObject is an object of a type this package doesn't decode further,
+// such as a protocol v3 object.  Only its proof of work can be verified.
+type RawObject struct {
+	powNonce uint64
+	// Data is the object after its nonce.
+	Data []byte
+}
+
+func RawObjectDecode(data []byte) (*RawObject, error) {
+	if len(data) < 8 {
+		return nil, fmt.Errorf("payload: failed to decode object payload (%w)", ErrMalformed)
+	}
+	return &RawObject{powNonce: order.Uint64(data[:8]), Data: data[8:]}, nil
+}
+
+func (o *RawObject) PayloadForPOW() []byte {
+	return o.Data
+}
+
+func (o *RawObject) SetNonce(nonce uint64) {
+	o.powNonce = nonce
+}
+
+func (o *RawObject) PowNonce() uint64 {
+	return o.powNonce
+}
+
+func (o *RawObject) Bytes() []byte {
+	return append(packUint(order, o.powNonce), o.Data...)
+}
+
+func (o *RawObject) Verify(trialsPerByte, extraBytes int) error {
+	return verify(o, trialsPerByte, extraBytes)
+}
@@ -0,0 +1,149 @@
+package payload
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/rwcarlsen/gobitmsg/msg"
+	"github.com/rwcarlsen/gobitmsg/pow"
+)
+
+func TestObjects(t *testing.T) {
+	signKey, err := NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryptKey, err := NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(time.Now().Unix(), 0)
+	objs := map[msg.Command]Object{
+		msg.CgetpubKey: &GetPubKey{Time: now, AddrVersion: 3, Stream: 1, RipeHash: make([]byte, 20)},
+		msg.Cpubkey: &PubKey{Time: now, AddrVersion: 3, Stream: 1, SignKey: signKey, EncryptKey: encryptKey,
+			TrialsPerByte: PowTrialsPerByte, ExtraBytes: PowExtraLen},
+		msg.Cmsg:       &Message{Time: now, Stream: 1, Data: []byte("encrypted")},
+		msg.Cbroadcast: &Broadcast{Time: now, Stream: 1, Data: []byte("encrypted"), version: BroadcastVersion},
+		msg.Cobject:    &RawObject{Data: []byte("a v3 object")},
+	}
+	if err := objs[msg.Cpubkey].(*PubKey).Sign(); err != nil {
+		t.Fatal(err)
+	}
+
+	for cmd, o := range objs {
+		data := o.PayloadForPOW()
+		if !bytes.Equal(o.PayloadForPOW(), data) {
+			t.Errorf("%v: payload changed between calls", cmd)
+		}
+		// a zero nonce meets the lowest difficulty by chance every so often
+		if err := o.Verify(1<<40, 1); err != ErrInsufficientPOW {
+			t.Errorf("%v: unsolved object verified (%v)", cmd, err)
+		}
+
+		target, initialHash := pow.Target(1, 1, data)
+		nonce, err := pow.Local{}.Solve(context.Background(), target, initialHash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		o.SetNonce(nonce)
+		if err := o.Verify(1, 1); err != nil {
+			t.Errorf("%v: %v", cmd, err)
+		}
+		if err := o.Verify(1<<40, 1); err != ErrInsufficientPOW {
+			t.Errorf("%v: verified at a higher difficulty (%v)", cmd, err)
+		}
+
+		decoded, err := DecodeObject(cmd, o.Bytes())
+		if err != nil {
+			t.Fatalf("%v: %v", cmd, err)
+		} else if decoded.PowNonce() != nonce || !bytes.Equal(decoded.PayloadForPOW(), data) {
+			t.Errorf("%v: decoded object differs", cmd)
+		} else if err := decoded.Verify(1, 1); err != nil {
+			t.Errorf("%v: decoded object: %v", cmd, err)
+		}
+	}
+
+	if _, err := DecodeObject(msg.Cinv, nil); err == nil {
+		t.Error("decoded an inv as an object")
+	}
+}
+
+func TestSignatures(t *testing.T) {
+	signKey, err := NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryptKey, err := NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	k := &PubKey{Time: time.Now(), AddrVersion: 3, Stream: 1, SignKey: signKey, EncryptKey: encryptKey,
+		TrialsPerByte: PowTrialsPerByte, ExtraBytes: PowExtraLen}
+	mi := &MsgInfo{MsgVersion: 1, AddrVersion: 3, Stream: 1, SignKey: signKey, EncryptKey: encryptKey,
+		DestRipe: make([]byte, 20), Encoding: EncSimple, Content: []byte("hello"), AckData: []byte("ack")}
+	bi := &BroadcastInfo{BroadcastVersion: 2, AddrVersion: 3, Stream: 1, SignKey: signKey, EncryptKey: encryptKey,
+		TrialsPerByte: PowTrialsPerByte, ExtraBytes: PowExtraLen, Encoding: EncSimple, Msg: []byte("hello")}
+
+	if err := k.Sign(); err != nil {
+		t.Fatal(err)
+	}
+	// a changed pubkey needs signing again
+	k.Stream = 2
+	if err := k.VerifySignature(); err != ErrBadSignature {
+		t.Errorf("changed pubkey verified (%v)", err)
+	}
+	k.Stream = 1
+	k.TrialsPerByte *= 2
+	if err := k.Sign(); err != nil {
+		t.Fatal(err)
+	} else if err := k.VerifySignature(); err != nil {
+		t.Errorf("re-signed pubkey: %v", err)
+	}
+
+	verifiers := map[string]func(data []byte) error{
+		"pubkey": func(data []byte) error {
+			k, err := PubKeyDecode(data)
+			if err != nil {
+				return err
+			}
+			return k.VerifySignature()
+		},
+		"msg": func(data []byte) error {
+			m, err := MsgInfoDecode(data)
+			if err != nil {
+				return err
+			}
+			return m.VerifySignature()
+		},
+		"broadcast": func(data []byte) error {
+			b, err := BroadcastInfoDecode(data)
+			if err != nil {
+				return err
+			}
+			return b.VerifySignature()
+		},
+	}
+	encoded := map[string][]byte{
+		"pubkey":    k.Bytes(),
+		"msg":       mi.Encode(),
+		"broadcast": bi.Encode(),
+	}
+	for kind, data := range encoded {
+		if err := verifiers[kind](data); err != nil {
+			t.Errorf("%v: %v", kind, err)
+		}
+		// the stream varint is signed in all three
+		tampered := bytes.Replace(data, []byte{3, 1}, []byte{3, 2}, 1)
+		if bytes.Equal(tampered, data) {
+			t.Fatalf("%v: nothing to tamper with", kind)
+		} else if err := verifiers[kind](tampered); err != ErrBadSignature {
+			t.Errorf("%v: tampered data verified (%v)", kind, err)
+		}
+		if err := verifiers[kind](data[:20]); err == nil || err == ErrBadSignature {
+			t.Errorf("%v: truncated data decoded (%v)", kind, err)
+		}
+	}
+}
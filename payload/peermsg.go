@@ -13,6 +13,12 @@ var order = msg.Order
 
 const ProtocolVersion = 2
 
+// Service bits advertised in Version messages.
+const (
+	ServiceNetwork   = 1
+	ServiceDandelion = 8 // relays objects in a Dandelion++ stem phase
+)
+
 // RandNonce is used in Version messages to detect connections to self
 var RandNonce = uint64(rand.Uint32())
 
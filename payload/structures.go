@@ -2,6 +2,7 @@ package payload
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"strconv"
 	"strings"
@@ -49,7 +50,6 @@ func varIntEncode(i int) (data []byte) {
 		order.PutUint64(data[1:], uint64(v))
 		return data
 	}
-	panic("not reached")
 }
 
 // varIntDecode decodes a variable length integer from data and returns the
@@ -66,7 +66,6 @@ func varIntDecode(data []byte) (val int, n int) {
 	default:
 		return int(data[0]), 1
 	}
-	panic("not reached")
 }
 
 // varStrEncode encodes a string as a variable length string.
@@ -183,35 +182,56 @@ type MsgInfo struct {
 
 // Encode encodes MsgInfo struct into a byte slice.
 func (m *MsgInfo) Encode() []byte {
+	data := m.signedData()
+	var err error
+	if m.signature, err = m.SignKey.Sign(data); err != nil {
+		panic("signature failed")
+	}
+	data = append(data, varIntEncode(len(m.signature))...)
+	data = append(data, m.signature...)
+
+	return data
+}
+
+// signedData returns the part of the message its signature covers, which
+// is everything before it.
+func (m *MsgInfo) signedData() []byte {
 	data := varIntEncode(m.MsgVersion)
 	data = append(data, varIntEncode(m.AddrVersion)...)
 	data = append(data, varIntEncode(m.Stream)...)
 	data = append(data, packUint(order, m.Behavior)...)
-	data = append(data, m.SignKey.EncodePub()...)
-	data = append(data, m.EncryptKey.EncodePub()...)
+	data = append(data, m.SignKey.encodeWirePub()...)
+	data = append(data, m.EncryptKey.encodeWirePub()...)
 	data = append(data, m.DestRipe...)
 	data = append(data, varIntEncode(m.Encoding)...)
 	data = append(data, varIntEncode(len(m.Content))...)
 	data = append(data, m.Content...)
 	data = append(data, varIntEncode(len(m.AckData))...)
-	data = append(data, m.AckData...)
-
-	var err error
-	if m.signature, err = m.SignKey.Sign(data); err != nil {
-		panic("signature failed")
-	}
-	data = append(data, varIntEncode(len(m.signature))...)
-	data = append(data, m.signature...)
-
-	return data
+	return append(data, m.AckData...)
 }
 
 func (m *MsgInfo) Signature() []byte {
 	return m.signature
 }
 
-func MsgInfoDecode(data []byte) *MsgInfo {
-	m := &MsgInfo{}
+// VerifySignature returns ErrBadSignature unless the message is signed by its
+// sender's SignKey.
+func (m *MsgInfo) VerifySignature() error {
+	if !m.SignKey.Verify(m.signedData(), m.signature) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+func MsgInfoDecode(data []byte) (m *MsgInfo, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			m = nil
+			err = errors.New("payload: failed to decode msg (malformed)")
+		}
+	}()
+
+	m = &MsgInfo{}
 	var offset, n, length int
 
 	m.MsgVersion, offset = varIntDecode(data)
@@ -254,7 +274,7 @@ func MsgInfoDecode(data []byte) *MsgInfo {
 
 	m.signature = append([]byte{}, data[offset:offset+length]...)
 
-	return m
+	return m, nil
 }
 
 type BroadcastInfo struct {
@@ -271,8 +291,15 @@ type BroadcastInfo struct {
 	signature        []byte
 }
 
-func BroadcastInfoDecode(data []byte) *BroadcastInfo {
-	b := &BroadcastInfo{}
+func BroadcastInfoDecode(data []byte) (b *BroadcastInfo, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			b = nil
+			err = errors.New("payload: failed to decode broadcast (malformed)")
+		}
+	}()
+
+	b = &BroadcastInfo{}
 	var length, offset, n int
 
 	b.BroadcastVersion, n = varIntDecode(data[offset:])
@@ -313,30 +340,44 @@ func BroadcastInfoDecode(data []byte) *BroadcastInfo {
 
 	b.signature = append([]byte{}, data[offset:offset+length]...)
 
-	return b
+	return b, nil
 }
 
 func (b *BroadcastInfo) Encode() []byte {
+	data := b.signedData()
+	var err error
+	if b.signature, err = b.SignKey.Sign(data); err != nil {
+		panic("signature failed")
+	}
+	data = append(data, varIntEncode(len(b.signature))...)
+	data = append(data, b.signature...)
+
+	return data
+}
+
+// signedData returns the part of the broadcast its signature covers, which
+// is everything before it.
+func (b *BroadcastInfo) signedData() []byte {
 	data := varIntEncode(b.BroadcastVersion)
 	data = append(data, varIntEncode(b.AddrVersion)...)
 	data = append(data, varIntEncode(b.Stream)...)
 	data = append(data, packUint(order, b.Behavior)...)
-	data = append(data, b.SignKey.EncodePub()...)
-	data = append(data, b.EncryptKey.EncodePub()...)
+	data = append(data, b.SignKey.encodeWirePub()...)
+	data = append(data, b.EncryptKey.encodeWirePub()...)
 	data = append(data, varIntEncode(b.TrialsPerByte)...)
 	data = append(data, varIntEncode(b.ExtraBytes)...)
 	data = append(data, varIntEncode(b.Encoding)...)
 	data = append(data, varIntEncode(len(b.Msg))...)
-	data = append(data, b.Msg...)
+	return append(data, b.Msg...)
+}
 
-	var err error
-	if b.signature, err = b.SignKey.Sign(data); err != nil {
-		panic("signature failed")
+// VerifySignature returns ErrBadSignature unless the broadcast is signed by its
+// sender's SignKey.
+func (b *BroadcastInfo) VerifySignature() error {
+	if !b.SignKey.Verify(b.signedData(), b.signature) {
+		return ErrBadSignature
 	}
-	data = append(data, varIntEncode(len(b.signature))...)
-	data = append(data, b.signature...)
-
-	return data
+	return nil
 }
 
 func (b *BroadcastInfo) Signature() []byte {
@@ -0,0 +1,102 @@
+// Package pow finds bitmessage proof of work nonces, either in process or by
+// handing the work to a separate worker.
+//
+// A nonce solves a job when the first 8 bytes of
+// sha512(sha512(nonce || initialHash)), read as a big-endian integer, are
+// no more than the job's target.  Workers speak a line protocol: each
+// request is the target in decimal and the initial hash in hex separated by
+// a space, and each response is the nonce in decimal or "error" followed by
+// a message.
+package pow
+
+import (
+	"context"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"log/slog"
+	"math"
+	"time"
+
+	"github.com/rwcarlsen/gobitmsg/metrics"
+)
+
+// ErrNoSolution is returned when every nonce has been tried.
+var ErrNoSolution = errors.New("pow: no nonce found")
+
+// Solver finds a nonce for a proof of work job.
+type Solver interface {
+	// Solve returns a nonce solving the job for target and initialHash,
+	// giving up with ctx's error when ctx is done.
+	Solve(ctx context.Context, target uint64, initialHash []byte) (uint64, error)
+}
+
+var (
+	powJobs    = metrics.Default.NewCounter("bitmsg_pow_jobs_total", "Proof of work calculations completed.")
+	powSeconds = metrics.Default.NewCounter("bitmsg_pow_seconds_total", "Time spent calculating proof of work.")
+)
+
+// Solve solves the job for target and initialHash with s, counting the
+// work in the proof of work metrics.
+func Solve(ctx context.Context, s Solver, target uint64, initialHash []byte) (uint64, error) {
+	start := time.Now()
+	nonce, err := s.Solve(ctx, target, initialHash)
+	powSeconds.Add(time.Since(start).Seconds())
+	if err == nil {
+		powJobs.Inc()
+	}
+	return nonce, err
+}
+
+// Trial returns the trial value of nonce for initialHash.
+func Trial(nonce uint64, initialHash []byte) uint64 {
+	buf := make([]byte, 8, 8+len(initialHash))
+	binary.BigEndian.PutUint64(buf, nonce)
+	first := sha512.Sum512(append(buf, initialHash...))
+	second := sha512.Sum512(first[:])
+	return binary.BigEndian.Uint64(second[:8])
+}
+
+// Check reports whether nonce solves the job for target and initialHash.
+func Check(nonce, target uint64, initialHash []byte) bool {
+	return Trial(nonce, initialHash) <= target
+}
+
+// Local solves jobs in process on a single goroutine.
+type Local struct{}
+
+func (Local) Solve(ctx context.Context, target uint64, initialHash []byte) (uint64, error) {
+	buf := make([]byte, 8+len(initialHash))
+	copy(buf[8:], initialHash)
+	for nonce := uint64(1); nonce < math.MaxUint64; nonce++ {
+		if nonce&0xffff == 0 && ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+		binary.BigEndian.PutUint64(buf, nonce)
+		first := sha512.Sum512(buf)
+		second := sha512.Sum512(first[:])
+		if binary.BigEndian.Uint64(second[:8]) <= target {
+			return nonce, nil
+		}
+	}
+	return 0, ErrNoSolution
+}
+
+// Fallback solves jobs with Primary, falling back to Local when Primary
+// fails for any reason other than ctx being done.
+type Fallback struct {
+	Primary Solver
+	// Log, if set, records Primary's failures.
+	Log *slog.Logger
+}
+
+func (f *Fallback) Solve(ctx context.Context, target uint64, initialHash []byte) (uint64, error) {
+	nonce, err := f.Primary.Solve(ctx, target, initialHash)
+	if err == nil || ctx.Err() != nil {
+		return nonce, err
+	}
+	if f.Log != nil {
+		f.Log.Warn("pow worker failed, solving locally", "err", err)
+	}
+	return Local{}.Solve(ctx, target, initialHash)
+}
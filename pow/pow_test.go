@@ -0,0 +1,141 @@
+package pow
+
+import (
+	"context"
+	"crypto/sha512"
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+// The test binary runs as a worker when POW_WORKER is set, serving standard
+// input and output for "stdio" or else listening on the given address.
+func TestMain(m *testing.M) {
+	switch addr := os.Getenv("POW_WORKER"); addr {
+	case "":
+		os.Exit(m.Run())
+	case "stdio":
+		Serve(os.Stdin, os.Stdout, Local{})
+	default:
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			os.Exit(1)
+		}
+		ServeListener(ln, Local{})
+	}
+	os.Exit(0)
+}
+
+// job returns an easy job's target and initial hash.
+func job(data string) (uint64, []byte) {
+	sum := sha512.Sum512([]byte(data))
+	return 1 << 52, sum[:]
+}
+
+func TestLocal(t *testing.T) {
+	target, hash := job("hello")
+	nonce, err := Local{}.Solve(context.Background(), target, hash)
+	if err != nil {
+		t.Fatal(err)
+	} else if !Check(nonce, target, hash) {
+		t.Errorf("nonce %v doesn't solve the job", nonce)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := (Local{}).Solve(ctx, 0, hash); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected a canceled solve, got %v", err)
+	}
+}
+
+func TestCmdWorker(t *testing.T) {
+	t.Setenv("POW_WORKER", "stdio")
+	w := NewCmdWorker(os.Args[0])
+	for _, data := range []string{"one", "two"} {
+		target, hash := job(data)
+		nonce, err := w.Solve(context.Background(), target, hash)
+		if err != nil {
+			t.Fatal(err)
+		} else if !Check(nonce, target, hash) {
+			t.Errorf("nonce %v doesn't solve the job", nonce)
+		}
+	}
+
+	// a job that is abandoned stops the worker, which is restarted for the
+	// next one
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := w.Solve(ctx, 0, []byte("impossible")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the impossible job to time out, got %v", err)
+	}
+	target, hash := job("three")
+	if _, err := w.Solve(context.Background(), target, hash); err != nil {
+		t.Errorf("restarted worker failed (%v)", err)
+	}
+	w.conn.Close()
+}
+
+func TestTCPWorker(t *testing.T) {
+	const addr = "127.0.0.1:22370"
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), "POW_WORKER="+addr)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+
+	w := NewTCPWorker(addr)
+	target, hash := job("hello")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		nonce, err := w.Solve(context.Background(), target, hash)
+		if err == nil {
+			if !Check(nonce, target, hash) {
+				t.Errorf("nonce %v doesn't solve the job", nonce)
+			}
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("worker never answered (%v)", err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	w.conn.Close()
+}
+
+// wrong answers every job with a nonce that doesn't solve it.
+type wrong struct{}
+
+func (wrong) Solve(ctx context.Context, target uint64, initialHash []byte) (uint64, error) {
+	for nonce := uint64(1); ; nonce++ {
+		if !Check(nonce, target, initialHash) {
+			return nonce, nil
+		}
+	}
+}
+
+func TestFallback(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go ServeListener(ln, wrong{})
+
+	target, hash := job("hello")
+	w := NewTCPWorker(ln.Addr().String())
+	if _, err := w.Solve(context.Background(), target, hash); err == nil {
+		t.Error("accepted a wrong nonce from the worker")
+	}
+	for _, primary := range []Solver{w, NewTCPWorker("127.0.0.1:1")} {
+		f := &Fallback{Primary: primary}
+		if nonce, err := f.Solve(context.Background(), target, hash); err != nil || !Check(nonce, target, hash) {
+			t.Errorf("fallback failed (%v)", err)
+		}
+	}
+}
@@ -0,0 +1,393 @@
+package pow
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Job kinds, each with a default priority.  Higher priorities run first.
+const (
+	KindPubKey    = "pubkey"
+	KindAck       = "ack"
+	KindMsg       = "msg"
+	KindGetPubKey = "getpubkey"
+	KindBroadcast = "broadcast"
+)
+
+var defaultPriority = map[string]int{
+	KindPubKey:    30,
+	KindAck:       20,
+	KindMsg:       10,
+	KindGetPubKey: 10,
+	KindBroadcast: 0,
+}
+
+// DefaultPriority returns the priority jobs of kind are queued with when
+// they don't ask for one.
+func DefaultPriority(kind string) int {
+	return defaultPriority[kind]
+}
+
+// Job states.
+const (
+	StateQueued  = "queued"
+	StateRunning = "running"
+	StateFailed  = "failed"
+)
+
+// Target returns the proof of work target and initial hash for object data
+// without its nonce.
+func Target(trialsPerByte, extraBytes int, data []byte) (target uint64, initialHash []byte) {
+	sum := sha512.Sum512(data)
+	return math.MaxUint64 / uint64((len(data)+extraBytes+8)*trialsPerByte), sum[:]
+}
+
+// Object is a network object needing proof of work.  The objects in
+// package payload implement it.
+type Object interface {
+	// PayloadForPOW returns the object without its nonce.
+	PayloadForPOW() []byte
+	SetNonce(nonce uint64)
+	// Bytes returns the object with its nonce.
+	Bytes() []byte
+	// Verify checks the object's nonce against a difficulty.
+	Verify(trialsPerByte, extraBytes int) error
+}
+
+// DecodeFunc restores an object from the command it is sent with and its
+// PayloadForPOW.
+type DecodeFunc func(cmd string, data []byte) (Object, error)
+
+// Job is a queued proof of work calculation for an object.
+type Job struct {
+	ID       string `json:"id"`
+	Kind     string `json:"kind"`
+	Priority int    `json:"priority"`
+	// Cmd is the command the finished object is sent with.
+	Cmd string `json:"cmd"`
+	// Ref is what the job is for, such as a message ID, for the queue's
+	// Done function.
+	Ref string `json:"ref,omitempty"`
+	// Object is the object to solve.  Its nonce is set before the job is
+	// handed to the queue's Done function.
+	Object        Object    `json:"-"`
+	TrialsPerByte int       `json:"trialsPerByte"`
+	ExtraBytes    int       `json:"extraBytes"`
+	Created       time.Time `json:"created"`
+	State         string    `json:"state"`
+	// Error is why a failed job failed.
+	Error string `json:"error,omitempty"`
+	// Trials is the number of trials the job is expected to take.
+	Trials float64 `json:"trials"`
+	// Started is when the job last started running.
+	Started time.Time `json:"started"`
+	// Progress and ETA, in seconds, estimate how far a running job has got
+	// from the rate earlier jobs were solved at.  They are zero until a job
+	// has been solved.
+	Progress float64 `json:"progress,omitempty"`
+	ETA      float64 `json:"eta,omitempty"`
+}
+
+// expectedTrials returns the number of trials solving j is expected to
+// take.
+func expectedTrials(j *Job) float64 {
+	target, _ := Target(j.TrialsPerByte, j.ExtraBytes, j.Object.PayloadForPOW())
+	return math.Exp2(64) / float64(target)
+}
+
+// savedJob is a job as written to the queue's file.
+type savedJob struct {
+	*Job
+	Data []byte `json:"data"`
+}
+
+// Queue runs proof of work jobs, highest priority first, a few at a time.
+// Pending jobs are saved to a file whenever they change, so jobs left when
+// the queue stops are resumed by the next one opened on that file.  It is
+// safe for concurrent use.
+type Queue struct {
+	Solver Solver
+	// Workers is how many jobs run at once.  Zero means one.
+	Workers int
+	// Done is called with each solved job.
+	Done func(j *Job)
+
+	path    string
+	wake    chan struct{}
+	mu      sync.Mutex
+	jobs    map[string]*Job
+	cancels map[string]context.CancelFunc
+	// rate is the average number of trials solved jobs took per second.
+	rate float64
+}
+
+// OpenQueue returns a queue solving jobs with s, loading the jobs saved at
+// path and restoring their objects with decode.  A missing file gives an
+// empty queue, and an empty path gives a queue that is never saved.
+func OpenQueue(path string, s Solver, decode DecodeFunc) (*Queue, error) {
+	q := &Queue{
+		Solver:  s,
+		path:    path,
+		wake:    make(chan struct{}, 1),
+		jobs:    map[string]*Job{},
+		cancels: map[string]context.CancelFunc{},
+	}
+	if path == "" {
+		return q, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return q, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var jobs []savedJob
+	if err := json.Unmarshal(data, &jobs); err != nil {
+		return nil, fmt.Errorf("pow: bad job queue %v (%v)", path, err)
+	}
+	for _, sj := range jobs {
+		j := sj.Job
+		if j == nil {
+			continue
+		}
+		if j.Object, err = decode(j.Cmd, sj.Data); err != nil {
+			return nil, fmt.Errorf("pow: bad %v job %v in %v (%v)", j.Kind, j.ID, path, err)
+		}
+		if j.State == StateRunning {
+			j.State = StateQueued
+		}
+		j.Trials = expectedTrials(j)
+		q.jobs[j.ID] = j
+	}
+	return q, nil
+}
+
+// Add queues j, filling in its ID, creation time and state, and a default
+// priority if it has none.
+func (q *Queue) Add(j *Job) error {
+	if j.Object == nil {
+		return errors.New("pow: job has no object")
+	} else if j.TrialsPerByte < 1 || j.ExtraBytes < 0 {
+		return fmt.Errorf("pow: invalid difficulty %v trials per byte, %v extra bytes", j.TrialsPerByte, j.ExtraBytes)
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	j.ID = hex.EncodeToString(id)
+	j.Created = time.Now()
+	j.State = StateQueued
+	j.Error = ""
+	j.Trials = expectedTrials(j)
+	if j.Priority == 0 {
+		j.Priority = DefaultPriority(j.Kind)
+	}
+
+	q.mu.Lock()
+	q.jobs[j.ID] = j
+	err := q.save()
+	q.mu.Unlock()
+	q.poke()
+	return err
+}
+
+// Jobs returns copies of the queued, running and failed jobs in the order
+// they run, with the progress of running jobs estimated.
+func (q *Queue) Jobs() []Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	jobs := make([]Job, 0, len(q.jobs))
+	for _, j := range q.jobs {
+		cp := *j
+		if cp.State == StateRunning && q.rate > 0 {
+			done := time.Since(cp.Started).Seconds() * q.rate
+			// a job may take longer than expected
+			cp.Progress = min(done/cp.Trials, 0.99)
+			cp.ETA = max(cp.Trials-done, 0) / q.rate
+		}
+		jobs = append(jobs, cp)
+	}
+	sort.Slice(jobs, func(i, k int) bool { return before(&jobs[i], &jobs[k]) })
+	return jobs
+}
+
+// before reports whether a runs before b.
+func before(a, b *Job) bool {
+	if a.Priority != b.Priority {
+		return a.Priority > b.Priority
+	}
+	return a.Created.Before(b.Created)
+}
+
+// SetPriority changes the priority of the job with id.  A failed job is
+// queued again.  It returns false if there is no such job.
+func (q *Queue) SetPriority(id string, priority int) (bool, error) {
+	q.mu.Lock()
+	j, ok := q.jobs[id]
+	if !ok {
+		q.mu.Unlock()
+		return false, nil
+	}
+	j.Priority = priority
+	if j.State == StateFailed {
+		j.State, j.Error = StateQueued, ""
+	}
+	err := q.save()
+	q.mu.Unlock()
+	q.poke()
+	return true, err
+}
+
+// Cancel removes the job with id, stopping it if it is running.  It returns
+// false if there is no such job.
+func (q *Queue) Cancel(id string) (bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, ok := q.jobs[id]; !ok {
+		return false, nil
+	}
+	delete(q.jobs, id)
+	if cancel := q.cancels[id]; cancel != nil {
+		cancel()
+		delete(q.cancels, id)
+	}
+	return true, q.save()
+}
+
+// Run runs jobs until ctx is done.  Jobs interrupted by ctx stay queued.
+func (q *Queue) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i := 0; i < max(q.Workers, 1); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q.work(ctx)
+		}()
+	}
+	wg.Wait()
+}
+
+func (q *Queue) work(ctx context.Context) {
+	for {
+		j, jobCtx := q.next(ctx)
+		if j == nil {
+			return
+		}
+		target, hash := Target(j.TrialsPerByte, j.ExtraBytes, j.Object.PayloadForPOW())
+		nonce, err := Solve(jobCtx, q.Solver, target, hash)
+		if err == nil {
+			j.Object.SetNonce(nonce)
+			if verr := j.Object.Verify(j.TrialsPerByte, j.ExtraBytes); verr != nil {
+				err = fmt.Errorf("pow: solved object doesn't verify (%v)", verr)
+			}
+		}
+		if q.finish(j, err) && q.Done != nil {
+			q.Done(j)
+		}
+	}
+}
+
+// next waits for the highest priority queued job and marks it running.  It
+// returns a nil job once ctx is done.
+func (q *Queue) next(ctx context.Context) (*Job, context.Context) {
+	for ctx.Err() == nil {
+		q.mu.Lock()
+		var next *Job
+		for _, j := range q.jobs {
+			if j.State == StateQueued && (next == nil || before(j, next)) {
+				next = j
+			}
+		}
+		if next != nil {
+			next.State = StateRunning
+			next.Started = time.Now()
+			jobCtx, cancel := context.WithCancel(ctx)
+			q.cancels[next.ID] = cancel
+			q.mu.Unlock()
+			// other workers may have more to do
+			q.poke()
+			return next, jobCtx
+		}
+		q.mu.Unlock()
+
+		select {
+		case <-q.wake:
+		case <-ctx.Done():
+		}
+	}
+	return nil, nil
+}
+
+// finish records the outcome of running j, reporting whether it was solved
+// and should be handed to Done.
+func (q *Queue) finish(j *Job, err error) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	cancel := q.cancels[j.ID]
+	if cancel == nil {
+		// cancelled
+		return false
+	}
+	cancel()
+	delete(q.cancels, j.ID)
+
+	switch {
+	case err == nil:
+		delete(q.jobs, j.ID)
+		if secs := time.Since(j.Started).Seconds(); secs > 0 {
+			rate := j.Trials / secs
+			if q.rate > 0 {
+				// weigh recent jobs more, as the solver may change
+				rate = 0.7*q.rate + 0.3*rate
+			}
+			q.rate = rate
+		}
+	case errors.Is(err, context.Canceled):
+		// the queue was stopped
+		j.State = StateQueued
+	default:
+		j.State, j.Error = StateFailed, err.Error()
+	}
+	// a stale file only means a finished job is redone after a restart
+	q.save()
+	return err == nil
+}
+
+func (q *Queue) poke() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// save writes the jobs to the queue's file.  The caller must hold q.mu.
+func (q *Queue) save() error {
+	if q.path == "" {
+		return nil
+	}
+	jobs := make([]savedJob, 0, len(q.jobs))
+	for _, j := range q.jobs {
+		jobs = append(jobs, savedJob{Job: j, Data: j.Object.PayloadForPOW()})
+	}
+	sort.Slice(jobs, func(i, k int) bool { return before(jobs[i].Job, jobs[k].Job) })
+	data, err := json.MarshalIndent(jobs, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp := q.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, q.path)
+}
@@ -0,0 +1,171 @@
+package pow
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rwcarlsen/gobitmsg/metrics"
+)
+
+// hardTrials makes a job that won't be solved during a test.
+const hardTrials = 1 << 50
+
+type testObject struct {
+	nonce uint64
+	data  []byte
+}
+
+func decodeTest(cmd string, data []byte) (Object, error) {
+	return &testObject{data: data}, nil
+}
+
+func (o *testObject) PayloadForPOW() []byte { return o.data }
+func (o *testObject) SetNonce(nonce uint64) { o.nonce = nonce }
+func (o *testObject) Bytes() []byte         { return binary.BigEndian.AppendUint64(nil, o.nonce) }
+
+func (o *testObject) Verify(trialsPerByte, extraBytes int) error {
+	target, hash := Target(trialsPerByte, extraBytes, o.data)
+	if !Check(o.nonce, target, hash) {
+		return errors.New("unsolved")
+	}
+	return nil
+}
+
+func newJob(kind, data string, trials int) *Job {
+	return &Job{Kind: kind, Object: &testObject{data: []byte(data)}, TrialsPerByte: trials}
+}
+
+func waitState(t *testing.T, q *Queue, id, state string) {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, j := range q.Jobs() {
+			if j.ID == id && j.State == state {
+				return
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("job %v never %v", id, state)
+}
+
+func TestQueue(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pow.json")
+	q, err := OpenQueue(path, Local{}, decodeTest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, kind := range []string{KindBroadcast, KindPubKey, KindMsg} {
+		if err := q.Add(newJob(kind, kind, 1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := q.Add(newJob(KindMsg, "easy", 0)); err == nil {
+		t.Error("job without a difficulty queued")
+	} else if err := q.Add(&Job{Kind: KindMsg, TrialsPerByte: 1}); err == nil {
+		t.Error("job without an object queued")
+	}
+
+	// a restart picks up the saved jobs
+	if q, err = OpenQueue(path, Local{}, decodeTest); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan *Job, 10)
+	q.Done = func(j *Job) {
+		if err := j.Object.Verify(j.TrialsPerByte, j.ExtraBytes); err != nil {
+			t.Errorf("%v job: %v", j.Kind, err)
+		} else if string(j.Object.PayloadForPOW()) != j.Kind {
+			t.Errorf("%v job restored with the wrong object", j.Kind)
+		}
+		done <- j
+	}
+	solved := powJobsTotal(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		q.Run(ctx)
+		close(stopped)
+	}()
+	for _, kind := range []string{KindPubKey, KindMsg, KindBroadcast} {
+		select {
+		case j := <-done:
+			if j.Kind != kind {
+				t.Errorf("ran %v job, expected %v", j.Kind, kind)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("%v job never finished", kind)
+		}
+	}
+	if n := powJobsTotal(t) - solved; n != 3 {
+		t.Errorf("%v solved jobs counted, expected 3", n)
+	}
+
+	// a running job can be cancelled
+	hard := newJob(KindMsg, "hard", hardTrials)
+	if err := q.Add(hard); err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, q, hard.ID, StateRunning)
+	// the solved jobs give a rate to estimate the running one's progress by
+	if j := q.Jobs()[0]; j.Started.IsZero() || j.Trials < hardTrials || j.ETA <= 0 || j.Progress >= 1 {
+		t.Errorf("unexpected progress for a running job %+v", j)
+	}
+	if ok, err := q.Cancel(hard.ID); !ok || err != nil {
+		t.Fatalf("cancel failed (%v, %v)", ok, err)
+	}
+	easy := newJob(KindAck, "ack", 1)
+	if err := q.Add(easy); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case j := <-done:
+		if j.ID != easy.ID {
+			t.Errorf("ran %v job, expected the ack", j.Kind)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("job after a cancelled one never finished")
+	}
+
+	// a job interrupted by stopping the queue is resumed later
+	hard = newJob(KindBroadcast, "hard", hardTrials)
+	if err := q.Add(hard); err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, q, hard.ID, StateRunning)
+	cancel()
+	<-stopped
+	if q, err = OpenQueue(path, Local{}, decodeTest); err != nil {
+		t.Fatal(err)
+	}
+	if jobs := q.Jobs(); len(jobs) != 1 || jobs[0].ID != hard.ID || jobs[0].State != StateQueued {
+		t.Errorf("unexpected jobs after a restart %+v", jobs)
+	}
+	if ok, _ := q.SetPriority("missing", 1); ok {
+		t.Error("reprioritized a missing job")
+	}
+}
+
+// powJobsTotal returns bitmsg_pow_jobs_total from the default registry.
+func powJobsTotal(t *testing.T) float64 {
+	t.Helper()
+	var buf bytes.Buffer
+	if _, err := metrics.Default.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if v, ok := strings.CutPrefix(line, "bitmsg_pow_jobs_total "); ok {
+			n, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return n
+		}
+	}
+	return 0
+}
@@ -0,0 +1,165 @@
+package pow
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Worker solves jobs by sending them to a worker process, one at a time.
+// A broken connection is reopened for the next job.
+type Worker struct {
+	dial func(ctx context.Context) (io.ReadWriteCloser, error)
+
+	mu   sync.Mutex
+	conn io.ReadWriteCloser
+	r    *bufio.Reader
+}
+
+// NewTCPWorker returns a Worker for the worker listening at addr.
+func NewTCPWorker(addr string) *Worker {
+	return &Worker{dial: func(ctx context.Context) (io.ReadWriteCloser, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "tcp", addr)
+	}}
+}
+
+// NewCmdWorker returns a Worker that runs name with args and talks to it
+// over its standard input and output.  The command is started again if it
+// exits.
+func NewCmdWorker(name string, args ...string) *Worker {
+	return &Worker{dial: func(ctx context.Context) (io.ReadWriteCloser, error) {
+		return startCmd(name, args...)
+	}}
+}
+
+func (w *Worker) Solve(ctx context.Context, target uint64, initialHash []byte) (uint64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.conn == nil {
+		conn, err := w.dial(ctx)
+		if err != nil {
+			return 0, fmt.Errorf("pow: failed to reach worker (%w)", err)
+		}
+		w.conn, w.r = conn, bufio.NewReader(conn)
+	}
+
+	// the protocol can't cancel a job, so the connection is dropped
+	conn := w.conn
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	nonce, err := w.solve(target, initialHash)
+	if !stop() || err != nil {
+		w.conn.Close()
+		w.conn, w.r = nil, nil
+		if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+		return 0, err
+	}
+	return nonce, nil
+}
+
+func (w *Worker) solve(target uint64, initialHash []byte) (uint64, error) {
+	if _, err := fmt.Fprintf(w.conn, "%d %x\n", target, initialHash); err != nil {
+		return 0, fmt.Errorf("pow: failed to send job to worker (%w)", err)
+	}
+	line, err := w.r.ReadString('\n')
+	if err != nil {
+		return 0, fmt.Errorf("pow: failed to read worker response (%w)", err)
+	}
+	line = strings.TrimSpace(line)
+	if msg, ok := strings.CutPrefix(line, "error"); ok {
+		return 0, fmt.Errorf("pow: worker failed (%v)", strings.TrimSpace(msg))
+	}
+	nonce, err := strconv.ParseUint(line, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("pow: malformed worker response %q", line)
+	} else if !Check(nonce, target, initialHash) {
+		return 0, fmt.Errorf("pow: worker returned nonce %v, which doesn't solve the job", nonce)
+	}
+	return nonce, nil
+}
+
+// cmdConn is a connection to a worker command's standard input and output.
+type cmdConn struct {
+	io.WriteCloser
+	io.Reader
+	cmd  *exec.Cmd
+	once sync.Once
+}
+
+func startCmd(name string, args ...string) (*cmdConn, error) {
+	cmd := exec.Command(name, args...)
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &cmdConn{WriteCloser: in, Reader: out, cmd: cmd}, nil
+}
+
+func (c *cmdConn) Close() error {
+	c.once.Do(func() {
+		c.WriteCloser.Close()
+		c.cmd.Process.Kill()
+		c.cmd.Wait()
+	})
+	return nil
+}
+
+// Serve reads jobs from r and writes their solutions, found with s, to w
+// until r is exhausted.
+func Serve(r io.Reader, w io.Writer, s Solver) error {
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		var resp string
+		if nonce, err := serveJob(s, sc.Text()); err != nil {
+			resp = "error " + err.Error()
+		} else {
+			resp = strconv.FormatUint(nonce, 10)
+		}
+		if _, err := io.WriteString(w, resp+"\n"); err != nil {
+			return err
+		}
+	}
+	return sc.Err()
+}
+
+func serveJob(s Solver, line string) (uint64, error) {
+	var target uint64
+	var hash []byte
+	if _, err := fmt.Sscanf(line, "%d %x", &target, &hash); err != nil {
+		return 0, fmt.Errorf("malformed job %q", line)
+	}
+	return s.Solve(context.Background(), target, hash)
+}
+
+// ServeListener serves the connections accepted from ln with s until ln is
+// closed.
+func ServeListener(ln net.Listener, s Solver) error {
+	for {
+		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			Serve(conn, conn, s)
+		}()
+	}
+}
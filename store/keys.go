@@ -0,0 +1,11 @@
+package store
+
+import "github.com/rwcarlsen/gobitmsg/payload"
+
+func encodePriv(k *payload.Key) string {
+	return k.EncodeHex()
+}
+
+func decodePriv(s string) (*payload.Key, error) {
+	return payload.DecodeHex(s)
+}
@@ -0,0 +1,601 @@
+// Package store keeps the identities, subscriptions, address book and
+// messages belonging to a node's user and persists them to disk.
+package store
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rwcarlsen/gobitmsg/payload"
+)
+
+// Message folders
+const (
+	Inbox = "inbox"
+	Sent  = "sent"
+	Trash = "trash"
+)
+
+// Outbound message statuses.  These match the names used by PyBitmessage.
+const (
+	StatusQueued        = "msgqueued"
+	StatusBroadcast     = "broadcastqueued"
+	StatusSent          = "msgsent"
+	StatusBroadcastSent = "broadcastsent"
+	StatusAcked         = "ackreceived"
+	// StatusAwaitingPubKey messages wait for their recipient's pubkey,
+	// which has been asked for.
+	StatusAwaitingPubKey = "awaitingpubkey"
+	// StatusTooDifficult messages wait for the user to confirm doing the
+	// proof of work their recipient asks for.
+	StatusTooDifficult = "toodifficult"
+)
+
+// Events passed to watchers registered with Watch.
+const (
+	EventNewMessage  = "new-message"
+	EventAckReceived = "ack-received"
+)
+
+var ErrNotFound = errors.New("store: not found")
+
+// ErrExists is returned when adding an identity that is already present.
+var ErrExists = errors.New("store: identity already exists")
+
+type Identity struct {
+	Label      string
+	Address    string
+	Stream     int
+	Enabled    bool
+	SignKey    *payload.Key `json:"-"`
+	EncryptKey *payload.Key `json:"-"`
+	// TrialsPerByte and ExtraBytes are the proof of work difficulty the
+	// identity's pubkey asks senders for.  Zero means the network minimum.
+	TrialsPerByte int
+	ExtraBytes    int
+}
+
+// PubKey returns the pubkey to publish for the identity.
+func (id *Identity) PubKey() *payload.PubKey {
+	a, _ := payload.AddressDecode(id.Address)
+	k := &payload.PubKey{
+		Time:          time.Now(),
+		Stream:        id.Stream,
+		SignKey:       id.SignKey,
+		EncryptKey:    id.EncryptKey,
+		TrialsPerByte: id.TrialsPerByte,
+		ExtraBytes:    id.ExtraBytes,
+	}
+	if a != nil {
+		k.AddrVersion = a.Version
+	}
+	k.TrialsPerByte, k.ExtraBytes, _ = k.Difficulty(0, 0)
+	return k
+}
+
+// Entry is an address book entry or a subscription.
+type Entry struct {
+	Label   string
+	Address string
+	Enabled bool
+}
+
+type Message struct {
+	ID        string
+	Folder    string
+	To        string
+	From      string
+	Subject   string
+	Body      string
+	Encoding  int
+	Time      time.Time
+	Read      bool
+	Broadcast bool
+	// Status, AckData and TTL are only used for outbound messages.
+	Status  string
+	AckData []byte
+	TTL     time.Duration
+	// Confirmed is set once the user agrees to do more proof of work than
+	// their limits allow to send the message.
+	Confirmed bool `json:",omitempty"`
+}
+
+type storeData struct {
+	Identities    []*identityJSON
+	Subscriptions []*Entry
+	AddressBook   []*Entry
+	Messages      []*Message
+	// PubKeys are the pubkey objects received for other addresses.
+	PubKeys map[string][]byte `json:",omitempty"`
+}
+
+type identityJSON struct {
+	Identity
+	SignPriv    string
+	EncryptPriv string
+}
+
+// Store is safe for concurrent use.
+type Store struct {
+	path string
+
+	mu            sync.Mutex
+	identities    []*Identity
+	subscriptions []*Entry
+	addressBook   []*Entry
+	messages      map[string]*Message
+	pubkeys       map[string][]byte
+	watchers      []func(event string, m *Message)
+}
+
+// Open loads the store saved at path.  If path doesn't exist, an empty store
+// is returned that will be created on the first Save.  An empty path gives
+// a store that is kept only in memory.
+func Open(path string) (*Store, error) {
+	s := &Store{path: path, messages: map[string]*Message{}, pubkeys: map[string][]byte{}}
+	if path == "" {
+		return s, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var sd storeData
+	if err := json.Unmarshal(data, &sd); err != nil {
+		return nil, fmt.Errorf("store: failed to decode %v (%v)", path, err)
+	}
+
+	for _, idj := range sd.Identities {
+		id := idj.Identity
+		if id.SignKey, err = decodePriv(idj.SignPriv); err != nil {
+			return nil, err
+		} else if id.EncryptKey, err = decodePriv(idj.EncryptPriv); err != nil {
+			return nil, err
+		}
+		s.identities = append(s.identities, &id)
+	}
+	s.subscriptions = sd.Subscriptions
+	s.addressBook = sd.AddressBook
+	for _, m := range sd.Messages {
+		s.messages[m.ID] = m
+	}
+	for addr, data := range sd.PubKeys {
+		s.pubkeys[addr] = data
+	}
+	return s, nil
+}
+
+// Save writes the store to disk.  It is a no-op for in-memory stores.
+func (s *Store) Save() error {
+	if s.path == "" {
+		return nil
+	}
+
+	s.mu.Lock()
+	sd := storeData{
+		Subscriptions: s.subscriptions,
+		AddressBook:   s.addressBook,
+		Messages:      s.sortedMessages(""),
+		PubKeys:       s.pubkeys,
+	}
+	for _, id := range s.identities {
+		sd.Identities = append(sd.Identities, &identityJSON{
+			Identity:    *id,
+			SignPriv:    encodePriv(id.SignKey),
+			EncryptPriv: encodePriv(id.EncryptKey),
+		})
+	}
+	data, err := json.MarshalIndent(sd, "", "\t")
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// write then rename so a crash never leaves a truncated store behind
+	tmp := s.path + ".tmp"
+	if err := os.MkdirAll(filepath.Dir(s.path), 0700); err != nil {
+		return err
+	} else if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// NewIdentity generates a new identity in stream.  Keys are generated until
+// the ripe hash has at least zeros leading zero bytes, which shortens the
+// address.
+func (s *Store) NewIdentity(label string, stream, zeros int) (*Identity, error) {
+	sign, err := payload.NewKey()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		enc, err := payload.NewKey()
+		if err != nil {
+			return nil, err
+		}
+		ripe := payload.RipeHash(sign, enc)
+		if !leadingZeros(ripe, zeros) {
+			continue
+		}
+
+		addr := &payload.Address{Version: payload.AddressVersion, Stream: stream, Ripe: ripe}
+		id := &Identity{
+			Label:      label,
+			Address:    addr.String(),
+			Stream:     stream,
+			Enabled:    true,
+			SignKey:    sign,
+			EncryptKey: enc,
+		}
+		s.mu.Lock()
+		s.identities = append(s.identities, id)
+		s.mu.Unlock()
+		cp := *id
+		return &cp, nil
+	}
+}
+
+// ImportIdentity adds the identity with the given private keys.  If address
+// is empty a version 3 address in stream is assumed, otherwise the keys must
+// belong to address.
+func (s *Store) ImportIdentity(label, address string, stream int, sign, enc *payload.Key) (*Identity, error) {
+	addr := &payload.Address{Version: payload.AddressVersion, Stream: stream}
+	ripe := payload.RipeHash(sign, enc)
+	if address != "" {
+		var err error
+		if addr, err = payload.AddressDecode(address); err != nil {
+			return nil, err
+		} else if !bytes.Equal(addr.Ripe, ripe) {
+			return nil, fmt.Errorf("store: keys don't belong to %v", address)
+		}
+	}
+	addr.Ripe = ripe
+
+	id := &Identity{
+		Label:      label,
+		Address:    addr.String(),
+		Stream:     addr.Stream,
+		Enabled:    true,
+		SignKey:    sign,
+		EncryptKey: enc,
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, other := range s.identities {
+		if other.Address == id.Address {
+			return nil, ErrExists
+		}
+	}
+	s.identities = append(s.identities, id)
+	cp := *id
+	return &cp, nil
+}
+
+func leadingZeros(b []byte, n int) bool {
+	for i := 0; i < n; i++ {
+		if b[i] != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Identities returns copies of the identities.
+func (s *Store) Identities() []*Identity {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := make([]*Identity, 0, len(s.identities))
+	for _, id := range s.identities {
+		cp := *id
+		ids = append(ids, &cp)
+	}
+	return ids
+}
+
+// Identity returns a copy of the identity with addr.
+func (s *Store) Identity(addr string) (*Identity, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range s.identities {
+		if id.Address == addr {
+			cp := *id
+			return &cp, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// SetDifficulty sets the proof of work difficulty the identity with addr
+// asks senders for.
+func (s *Store) SetDifficulty(addr string, trialsPerByte, extraBytes int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range s.identities {
+		if id.Address == addr {
+			id.TrialsPerByte, id.ExtraBytes = trialsPerByte, extraBytes
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (s *Store) DeleteIdentity(addr string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, id := range s.identities {
+		if id.Address == addr {
+			s.identities = append(s.identities[:i], s.identities[i+1:]...)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (s *Store) Subscriptions() []*Entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*Entry{}, s.subscriptions...)
+}
+
+// Subscribe adds a subscription to broadcasts from addr.  An error is
+// returned if the subscription already exists.
+func (s *Store) Subscribe(label, addr string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if findEntry(s.subscriptions, addr) >= 0 {
+		return fmt.Errorf("store: already subscribed to %v", addr)
+	}
+	s.subscriptions = append(s.subscriptions, &Entry{Label: label, Address: addr, Enabled: true})
+	return nil
+}
+
+func (s *Store) Unsubscribe(addr string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := findEntry(s.subscriptions, addr)
+	if i < 0 {
+		return ErrNotFound
+	}
+	s.subscriptions = append(s.subscriptions[:i], s.subscriptions[i+1:]...)
+	return nil
+}
+
+func (s *Store) AddressBook() []*Entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*Entry{}, s.addressBook...)
+}
+
+// AddContact adds addr to the address book.  An error is returned if it
+// is already there.
+func (s *Store) AddContact(label, addr string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if findEntry(s.addressBook, addr) >= 0 {
+		return fmt.Errorf("store: %v is already in the address book", addr)
+	}
+	s.addressBook = append(s.addressBook, &Entry{Label: label, Address: addr, Enabled: true})
+	return nil
+}
+
+func (s *Store) DeleteContact(addr string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := findEntry(s.addressBook, addr)
+	if i < 0 {
+		return ErrNotFound
+	}
+	s.addressBook = append(s.addressBook[:i], s.addressBook[i+1:]...)
+	return nil
+}
+
+// AddPubKey stores the pubkey k of another address unless a newer one is
+// stored, and returns the address.  k should be verified first.
+func (s *Store) AddPubKey(k *payload.PubKey) string {
+	a := &payload.Address{Version: k.AddrVersion, Stream: k.Stream, Ripe: payload.RipeHash(k.SignKey, k.EncryptKey)}
+	addr := a.String()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if old, err := payload.PubKeyDecode(s.pubkeys[addr]); err == nil && old.Time.After(k.Time) {
+		return addr
+	}
+	s.pubkeys[addr] = k.Bytes()
+	return addr
+}
+
+// PubKey returns the stored pubkey of addr.
+func (s *Store) PubKey(addr string) (*payload.PubKey, error) {
+	s.mu.Lock()
+	data, ok := s.pubkeys[addr]
+	s.mu.Unlock()
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return payload.PubKeyDecode(data)
+}
+
+func findEntry(entries []*Entry, addr string) int {
+	for i, e := range entries {
+		if e.Address == addr {
+			return i
+		}
+	}
+	return -1
+}
+
+// AddMessage stores m, assigning it a random ID if it doesn't have one.
+func (s *Store) AddMessage(m *Message) error {
+	if m.ID == "" {
+		id := make([]byte, 32)
+		if _, err := rand.Read(id); err != nil {
+			return err
+		}
+		m.ID = hex.EncodeToString(id)
+	}
+	if m.Time.IsZero() {
+		m.Time = time.Now()
+	}
+
+	cp := *m
+	s.mu.Lock()
+	s.messages[m.ID] = &cp
+	s.mu.Unlock()
+
+	if m.Folder == Inbox {
+		s.notify(EventNewMessage, m)
+	}
+	return nil
+}
+
+// Messages returns copies of all messages in folder ordered oldest first.
+// An empty folder returns messages from every folder.
+func (s *Store) Messages(folder string) []*Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sortedMessages(folder)
+}
+
+func (s *Store) sortedMessages(folder string) []*Message {
+	msgs := []*Message{}
+	for _, m := range s.messages {
+		if folder == "" || m.Folder == folder {
+			cp := *m
+			msgs = append(msgs, &cp)
+		}
+	}
+	sort.Slice(msgs, func(i, j int) bool {
+		if msgs[i].Time.Equal(msgs[j].Time) {
+			return msgs[i].ID < msgs[j].ID
+		}
+		return msgs[i].Time.Before(msgs[j].Time)
+	})
+	return msgs
+}
+
+// Message returns a copy of the message with id.
+func (s *Store) Message(id string) (*Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if m, ok := s.messages[id]; ok {
+		cp := *m
+		return &cp, nil
+	}
+	return nil, ErrNotFound
+}
+
+// MessageByAck returns a copy of the outbound message with the given ack
+// data.
+func (s *Store) MessageByAck(ack []byte) (*Message, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, m := range s.messages {
+		if len(m.AckData) > 0 && string(m.AckData) == string(ack) {
+			cp := *m
+			return &cp, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (s *Store) MarkRead(id string, read bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, ok := s.messages[id]
+	if !ok {
+		return ErrNotFound
+	}
+	m.Read = read
+	return nil
+}
+
+// SetStatus updates the status of the outbound message with id.
+func (s *Store) SetStatus(id, status string) error {
+	s.mu.Lock()
+	m, ok := s.messages[id]
+	if !ok {
+		s.mu.Unlock()
+		return ErrNotFound
+	}
+	m.Status = status
+	cp := *m
+	s.mu.Unlock()
+
+	if status == StatusAcked {
+		s.notify(EventAckReceived, &cp)
+	}
+	return nil
+}
+
+// ConfirmDifficulty lets the outbound message with id waiting in
+// StatusTooDifficult be sent despite its recipient's difficulty.
+func (s *Store) ConfirmDifficulty(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, ok := s.messages[id]
+	if !ok {
+		return ErrNotFound
+	} else if m.Status != StatusTooDifficult {
+		return fmt.Errorf("store: message %v isn't waiting for confirmation", id)
+	}
+	m.Confirmed = true
+	m.Status = StatusQueued
+	return nil
+}
+
+// Watch registers fn to be called with a copy of the message involved
+// whenever a new message arrives in the inbox or an outbound message is
+// acknowledged.  fn must not block.
+func (s *Store) Watch(fn func(event string, m *Message)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.watchers = append(s.watchers, fn)
+}
+
+func (s *Store) notify(event string, m *Message) {
+	s.mu.Lock()
+	watchers := append([]func(string, *Message){}, s.watchers...)
+	s.mu.Unlock()
+
+	for _, fn := range watchers {
+		cp := *m
+		fn(event, &cp)
+	}
+}
+
+// TrashMessage moves the message with id into the trash folder.
+func (s *Store) TrashMessage(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, ok := s.messages[id]
+	if !ok {
+		return ErrNotFound
+	}
+	m.Folder = Trash
+	return nil
+}
+
+// DeleteMessage permanently removes the message with id.
+func (s *Store) DeleteMessage(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.messages[id]; !ok {
+		return ErrNotFound
+	}
+	delete(s.messages, id)
+	return nil
+}
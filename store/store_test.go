@@ -0,0 +1,105 @@
+package store
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestSaveOpen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.json")
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := s.NewIdentity("me", 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Subscribe("news", "BM-2DAjcCFrqFrp88FUxExhJ9kPqHdunQmiyn"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Subscribe("news", "BM-2DAjcCFrqFrp88FUxExhJ9kPqHdunQmiyn"); err == nil {
+		t.Error("duplicate subscription was allowed")
+	}
+	if err := s.SetDifficulty(id.Address, 1000, 20000); err != nil {
+		t.Fatal(err)
+	} else if id.TrialsPerByte != 0 {
+		t.Error("SetDifficulty changed an identity already handed out")
+	}
+	if addr := s.AddPubKey(id.PubKey()); addr != id.Address {
+		t.Errorf("pubkey stored for %v, expected %v", addr, id.Address)
+	}
+	m := &Message{Folder: Inbox, To: id.Address, Subject: "hi", Body: "there"}
+	if err := s.AddMessage(m); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	s2, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id2, err := s2.Identity(id.Address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id2.SignKey.D.Cmp(id.SignKey.D) != 0 || id2.SignKey.X.Cmp(id.SignKey.X) != 0 {
+		t.Error("signing key did not survive a round trip")
+	}
+	if id2.EncryptKey.Y.Cmp(id.EncryptKey.Y) != 0 {
+		t.Error("encryption key did not survive a round trip")
+	}
+	if k := id2.PubKey(); k.TrialsPerByte != 1000 || k.ExtraBytes != 20000 {
+		t.Errorf("pubkey advertises difficulty %v/%v, expected 1000/20000", k.TrialsPerByte, k.ExtraBytes)
+	}
+	if k, err := s2.PubKey(id.Address); err != nil {
+		t.Errorf("pubkey did not survive a round trip (%v)", err)
+	} else if k.EncryptKey.X.Cmp(id.EncryptKey.X) != 0 {
+		t.Error("pubkey has the wrong encryption key")
+	}
+	if n := len(s2.Subscriptions()); n != 1 {
+		t.Errorf("expected 1 subscription, got %v", n)
+	}
+
+	m2, err := s2.Message(m.ID)
+	if err != nil {
+		t.Fatal(err)
+	} else if m2.Subject != "hi" || m2.Body != "there" {
+		t.Errorf("message did not survive a round trip: %+v", m2)
+	}
+
+	if err := s2.TrashMessage(m.ID); err != nil {
+		t.Fatal(err)
+	} else if n := len(s2.Messages(Inbox)); n != 0 {
+		t.Errorf("expected empty inbox after trashing, got %v messages", n)
+	}
+}
+
+func TestImportIdentity(t *testing.T) {
+	s, err := Open("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := s.NewIdentity("me", 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.ImportIdentity("again", id.Address, 1, id.SignKey, id.EncryptKey); err != ErrExists {
+		t.Errorf("expected ErrExists importing an identity twice, got %v", err)
+	}
+	if err := s.DeleteIdentity(id.Address); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.ImportIdentity("swapped", id.Address, 1, id.EncryptKey, id.SignKey); err == nil {
+		t.Error("imported keys that don't belong to the address")
+	}
+	id2, err := s.ImportIdentity("restored", "", 1, id.SignKey, id.EncryptKey)
+	if err != nil {
+		t.Fatal(err)
+	} else if id2.Address != id.Address || id2.Label != "restored" || !id2.Enabled {
+		t.Errorf("unexpected restored identity %+v", id2)
+	}
+}